@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// Server is a read-only http api exposing the current state snapshot as
+// json, along with prometheus metrics on '/metrics'.
+//
+// Addresses prefixed with 'unix:' are unix socket paths, anything else is
+// a tcp listen address.
+type Server struct {
+	Addr string
+	TTL  uint32
+	Errs <-chan error
+
+	errs   chan error
+	server *http.Server
+}
+
+func NewServer(addr string, ttl uint32) *Server {
+	errs := make(chan error, 1)
+
+	s := &Server{
+		Addr: addr,
+		TTL:  ttl,
+		Errs: errs,
+		errs: errs,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", s.handleNetworks)
+	mux.HandleFunc("/endpoints", s.handleEndpoints)
+	mux.HandleFunc("/containers", s.handleContainers)
+	mux.HandleFunc("/records", s.handleRecords)
+	mux.HandleFunc("/lookup", s.handleLookup)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	s.server = &http.Server{Handler: mux}
+
+	return s
+}
+
+// Start begins serving the api. Listener failures are reported on Errs.
+func (s *Server) Start() error {
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Printf("admin api listening on %s", s.Addr)
+
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.errs <- fmt.Errorf("admin api on %s failed: %v", s.Addr, err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Printf("admin api on %s shutdown error: %v", s.Addr, err)
+	}
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	if !strings.HasPrefix(s.Addr, "unix:") {
+		listener, err := net.Listen("tcp", s.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("could not listen on %s: %v", s.Addr, err)
+		}
+
+		return listener, nil
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(s.Addr, "unix:"), "//")
+
+	// A socket left behind by a previous instance would make listen fail.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("could not remove stale unix socket %s: %v", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on unix socket %s: %v", path, err)
+	}
+
+	return listener, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(v); err != nil {
+		log.Printf("admin api failed to write reply: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
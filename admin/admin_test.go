@@ -0,0 +1,245 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rakshasa/docker-container-dns/dockertest"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// publishTestState publishes a snapshot with a web container on the
+// backend network, reachable as 'api' through the backend search zone,
+// and a db container on the frontend network.
+func publishTestState(t *testing.T) {
+	cli := &dockertest.Client{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "client", cli))
+
+	backend := dockertest.Network("a000000000000000000000000000000000000000000000000000000000000001", "backend", "172.20.0.0/16")
+	frontend := dockertest.Network("a000000000000000000000000000000000000000000000000000000000000002", "frontend", "172.21.0.0/16")
+	cli.AddNetwork(backend)
+	cli.AddNetwork(frontend)
+
+	web := dockertest.Container("c000000000000000000000000000000000000000000000000000000000000001", "web", map[string]string{"tier": "web"})
+	dockertest.Connect(web, backend, "172.20.0.2", "")
+	web.NetworkSettings.Networks[backend.Name].Aliases = []string{"api"}
+	cli.AddContainer(web)
+
+	db := dockertest.Container("c000000000000000000000000000000000000000000000000000000000000002", "db", map[string]string{"tier": "db"})
+	dockertest.Connect(db, frontend, "172.21.0.2", "")
+	cli.AddContainer(db)
+
+	state.Networks = state.NewNetworkList(ctx, cli, state.NetworkEventActions)
+	state.Containers = state.NewContainerList(ctx, cli, state.ContainerEventActions)
+	state.SearchZones = []string{"backend.docker."}
+
+	t.Cleanup(func() {
+		cancel()
+
+		state.Networks, state.Containers, state.SearchZones = nil, nil, nil
+		state.Publish()
+	})
+
+	if err := state.Sync(ctx); err != nil {
+		t.Fatalf("could not sync test state: %v", err)
+	}
+
+	state.Publish()
+}
+
+func get(t *testing.T, s *Server, target string, v interface{}) {
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status for %s: %d %s", target, w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid json reply for %s: %v", target, err)
+	}
+}
+
+func TestServerHandlers(t *testing.T) {
+	publishTestState(t)
+
+	s := NewServer("127.0.0.1:0", 30)
+
+	for _, tc := range []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/networks", http.StatusOK},
+		{http.MethodGet, "/endpoints?network=backend&label=dns.zone", http.StatusOK},
+		{http.MethodGet, "/containers", http.StatusOK},
+		{http.MethodGet, "/records", http.StatusOK},
+		{http.MethodGet, "/lookup?name=web.docker", http.StatusOK},
+		{http.MethodGet, "/lookup?ip=172.20.0.2", http.StatusOK},
+		{http.MethodGet, "/lookup?ip=web", http.StatusBadRequest},
+		{http.MethodGet, "/lookup", http.StatusBadRequest},
+		{http.MethodGet, "/lookup?name=web.docker&container=web", http.StatusBadRequest},
+		{http.MethodPost, "/records", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+
+		if w.Code != tc.status {
+			t.Errorf("unexpected status for %s %s: %d", tc.method, tc.target, w.Code)
+		}
+
+		var v interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Errorf("invalid json reply for %s %s: %v", tc.method, tc.target, err)
+		}
+	}
+}
+
+func TestServerFilters(t *testing.T) {
+	publishTestState(t)
+
+	s := NewServer("127.0.0.1:0", 30)
+
+	var networks []networkJSON
+	if get(t, s, "/networks?network=back", &networks); len(networks) != 0 {
+		t.Errorf("expected networks to match by full name: %v", networks)
+	}
+	if get(t, s, "/networks?network=a000000000000000000000000000000000000000000000000000000000000002", &networks); len(networks) != 1 || networks[0].Name != "frontend" || networks[0].Endpoints != 1 {
+		t.Errorf("unexpected networks matching by id: %v", networks)
+	}
+
+	for target, expected := range map[string]string{
+		"/endpoints?network=backend":               "web",
+		"/endpoints?network=frontend":              "db",
+		"/endpoints?label=tier=db":                 "db",
+		"/endpoints?label=tier":                    "db,web",
+		"/endpoints?network=backend&label=tier=db": "",
+		"/containers?label=tier=web":               "web",
+		"/containers?network=frontend":             "db",
+	} {
+		// Endpoints have a container name and containers a name.
+		var reply []struct {
+			ContainerName string `json:"container_name"`
+			Name          string `json:"name"`
+		}
+		get(t, s, target, &reply)
+
+		var names []string
+		for _, v := range reply {
+			names = append(names, v.ContainerName+v.Name)
+		}
+		sort.Strings(names)
+
+		if strings.Join(names, ",") != expected {
+			t.Errorf("unexpected reply for %s: %v", target, names)
+		}
+	}
+}
+
+func TestServerLookup(t *testing.T) {
+	publishTestState(t)
+
+	s := NewServer("127.0.0.1:0", 30)
+
+	recordNames := func(lookup lookupJSON) map[string]bool {
+		names := make(map[string]bool)
+		for _, record := range lookup.Records {
+			names[record.Name+" "+record.Type] = true
+		}
+		return names
+	}
+
+	var lookup lookupJSON
+
+	get(t, s, "/lookup?name=api.docker", &lookup)
+	if len(lookup.Containers) != 1 || lookup.Containers[0].Name != "web" || len(lookup.Endpoints) != 1 || !recordNames(lookup)["api.backend.docker. A"] {
+		t.Errorf("expected name in search zone to be looked up with its records: %+v", lookup)
+	}
+
+	lookup = lookupJSON{}
+	get(t, s, "/lookup?name=db.frontend.docker.", &lookup)
+	if len(lookup.Containers) != 1 || lookup.Containers[0].Name != "db" || len(lookup.Records) != 1 || !recordNames(lookup)["db.frontend.docker. A"] {
+		t.Errorf("unexpected lookup by name: %+v", lookup)
+	}
+
+	lookup = lookupJSON{}
+	get(t, s, "/lookup?name=web.frontend.docker", &lookup)
+	if len(lookup.Containers) != 0 || len(lookup.Records) != 0 {
+		t.Errorf("expected no results for a name on another network: %+v", lookup)
+	}
+
+	lookup = lookupJSON{}
+	get(t, s, "/lookup?ip=172.21.0.2", &lookup)
+	if len(lookup.Endpoints) != 1 || lookup.Endpoints[0].ContainerName != "db" || !recordNames(lookup)["2.0.21.172.in-addr.arpa. PTR"] || !recordNames(lookup)["db.docker. A"] {
+		t.Errorf("unexpected lookup by ip: %+v", lookup)
+	}
+
+	lookup = lookupJSON{}
+	get(t, s, "/lookup?container=c000000000000000000000000000000000000000000000000000000000000001", &lookup)
+	if len(lookup.Containers) != 1 || lookup.Containers[0].Name != "web" || !recordNames(lookup)["web.docker. A"] {
+		t.Errorf("unexpected lookup by container id: %+v", lookup)
+	}
+	for _, record := range lookup.Records {
+		if record.ContainerID != "c000000000000000000000000000000000000000000000000000000000000001" {
+			t.Errorf("unexpected record of another container: %+v", record)
+		}
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+
+	s := NewServer("unix:"+path, 30)
+	if err := s.Start(); err != nil {
+		t.Fatalf("could not start admin api: %v", err)
+	}
+	defer s.Shutdown()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://admin/networks")
+	if err != nil {
+		t.Fatalf("could not query admin api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var networks []networkJSON
+	if err := json.NewDecoder(resp.Body).Decode(&networks); err != nil || networks == nil {
+		t.Errorf("unexpected networks reply: %v %v", networks, err)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	s := NewServer("127.0.0.1:0", 30)
+
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected metrics status: %d", w.Code)
+	}
+
+	for _, name := range []string{"docker_container_dns_networks", "docker_container_dns_endpoints", "docker_container_dns_records"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("expected metric %s in reply", name)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+type statusJSON struct {
+	Serving bool   `json:"serving"`
+	Reason  string `json:"reason"`
+}
+
+type networkJSON struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Zone      string            `json:"zone"`
+	Disabled  bool              `json:"disabled"`
+	Subnets   []string          `json:"subnets"`
+	Gateways  []string          `json:"gateways"`
+	Endpoints int               `json:"endpoints"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type endpointJSON struct {
+	NetworkID     string            `json:"network_id"`
+	Network       string            `json:"network"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	IPv4Address   string            `json:"ipv4_address,omitempty"`
+	IPv6Address   string            `json:"ipv6_address,omitempty"`
+	Aliases       []string          `json:"aliases,omitempty"`
+	Links         []string          `json:"links,omitempty"`
+	Hostname      string            `json:"hostname,omitempty"`
+	Ports         []string          `json:"ports,omitempty"`
+	Names         []string          `json:"names"`
+	Status        statusJSON        `json:"status"`
+	Labels        map[string]string `json:"labels"`
+}
+
+type containerJSON struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Running      bool              `json:"running"`
+	Paused       bool              `json:"paused"`
+	Health       string            `json:"health,omitempty"`
+	HealthPolicy string            `json:"health_policy"`
+	Status       statusJSON        `json:"status"`
+	Networks     []string          `json:"networks"`
+	Labels       map[string]string `json:"labels"`
+}
+
+type recordJSON struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	TTL         uint32 `json:"ttl"`
+	Data        string `json:"data"`
+	ContainerID string `json:"container_id"`
+	Network     string `json:"network"`
+}
+
+type lookupJSON struct {
+	Containers []containerJSON `json:"containers"`
+	Endpoints  []endpointJSON  `json:"endpoints"`
+	Records    []recordJSON    `json:"records"`
+}
+
+// filter selects networks, endpoints and containers with the '?network='
+// and '?label=' query parameters. Networks match by name or id prefix, and
+// labels are either 'key' or 'key=value', all of which must match.
+type filter struct {
+	network string
+	labels  map[string]*string
+}
+
+func parseFilter(r *http.Request) filter {
+	query := r.URL.Query()
+
+	f := filter{
+		network: query.Get("network"),
+		labels:  make(map[string]*string),
+	}
+
+	for _, label := range query["label"] {
+		parts := strings.SplitN(label, "=", 2)
+
+		if len(parts) == 2 {
+			f.labels[parts[0]] = &parts[1]
+		} else {
+			f.labels[parts[0]] = nil
+		}
+	}
+
+	return f
+}
+
+func (f filter) matchNetwork(nw *state.Network) bool {
+	if len(f.network) == 0 {
+		return true
+	}
+
+	return strings.EqualFold(nw.Name, f.network) || strings.HasPrefix(nw.ID, f.network)
+}
+
+func (f filter) matchLabels(labels map[string]string) bool {
+	for key, value := range f.labels {
+		v, exists := labels[key]
+		if !exists || (value != nil && v != *value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f filter) matchEndpoint(snapshot *state.Snapshot, e *state.ContainerEndpoint) bool {
+	nw, exists := snapshot.Networks[e.NetworkID]
+
+	return exists && f.matchNetwork(nw) && f.matchLabels(e.Labels)
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handleNetworks(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	snapshot, f := state.Current(), parseFilter(r)
+	networks := []networkJSON{}
+
+	for _, nw := range snapshot.Networks {
+		if !f.matchNetwork(nw) || !f.matchLabels(nw.Labels) {
+			continue
+		}
+
+		networks = append(networks, newNetworkJSON(snapshot, nw))
+	}
+
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+
+	writeJSON(w, http.StatusOK, networks)
+}
+
+func (s *Server) handleEndpoints(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	snapshot, f := state.Current(), parseFilter(r)
+	records := s.records(snapshot)
+
+	writeJSON(w, http.StatusOK, endpoints(snapshot, records, func(e *state.ContainerEndpoint) bool {
+		return f.matchEndpoint(snapshot, e)
+	}))
+}
+
+func (s *Server) handleContainers(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	snapshot, f := state.Current(), parseFilter(r)
+
+	writeJSON(w, http.StatusOK, containers(snapshot, func(id string, c *state.Container) bool {
+		if !f.matchLabels(c.Labels) {
+			return false
+		}
+		if len(f.network) == 0 {
+			return true
+		}
+
+		for _, nw := range containerNetworks(snapshot, id) {
+			if f.matchNetwork(nw) {
+				return true
+			}
+		}
+
+		return false
+	}))
+}
+
+func (s *Server) handleRecords(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	snapshot, f := state.Current(), parseFilter(r)
+
+	writeJSON(w, http.StatusOK, recordsJSON(snapshot, s.records(snapshot), func(record *state.Record) bool {
+		return f.matchEndpoint(snapshot, record.Endpoint)
+	}))
+}
+
+// handleLookup returns the containers, endpoints and records matching
+// exactly one of the 'name', 'ip' or 'container' query parameters.
+// Containers are matched by id prefix or name.
+func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	snapshot, query := state.Current(), r.URL.Query()
+	name, address, container := query.Get("name"), query.Get("ip"), query.Get("container")
+
+	matched := make(map[*state.ContainerEndpoint]bool)
+	var matchRecord func(record *state.Record) bool
+
+	switch {
+	case len(name) != 0 && len(address) == 0 && len(container) == 0:
+		name = dns.Fqdn(strings.ToLower(name))
+
+		found, _ := snapshot.LookupName(name)
+		for _, e := range found {
+			matched[e] = true
+		}
+		for _, service := range snapshot.LookupServices(name) {
+			matched[service.Endpoint] = true
+		}
+
+		// Names found through a search zone are answered with the
+		// records of the name in that zone.
+		resolved := snapshot.ResolveName(name)
+
+		matchRecord = func(record *state.Record) bool {
+			return record.RR.Header().Name == name || record.RR.Header().Name == resolved
+		}
+
+	case len(address) != 0 && len(name) == 0 && len(container) == 0:
+		ip := net.ParseIP(address)
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ip address: %s", address))
+			return
+		}
+
+		for _, e := range snapshot.LookupAddress(ip) {
+			matched[e] = true
+		}
+
+		reverse, _ := dns.ReverseAddr(ip.String())
+
+		matchRecord = func(record *state.Record) bool {
+			switch rr := record.RR.(type) {
+			case *dns.A:
+				return rr.A.Equal(ip)
+			case *dns.AAAA:
+				return rr.AAAA.Equal(ip)
+			case *dns.PTR:
+				return rr.Hdr.Name == reverse
+			}
+			return false
+		}
+
+	case len(container) != 0 && len(name) == 0 && len(address) == 0:
+		for _, nw := range snapshot.Networks {
+			for id, e := range nw.ContainerEndpoints {
+				if strings.HasPrefix(id, container) || strings.EqualFold(e.ContainerName, container) {
+					matched[e] = true
+				}
+			}
+		}
+
+		matchRecord = func(record *state.Record) bool {
+			return matched[record.Endpoint]
+		}
+
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("lookup requires exactly one of the 'name', 'ip' or 'container' parameters"))
+		return
+	}
+
+	containerIDs := make(map[string]bool)
+	for e := range matched {
+		containerIDs[e.ContainerID] = true
+	}
+
+	records := s.records(snapshot)
+
+	writeJSON(w, http.StatusOK, lookupJSON{
+		Containers: containers(snapshot, func(id string, c *state.Container) bool {
+			return containerIDs[id]
+		}),
+		Endpoints: endpoints(snapshot, records, func(e *state.ContainerEndpoint) bool {
+			return matched[e]
+		}),
+		Records: recordsJSON(snapshot, records, matchRecord),
+	})
+}
+
+func (s *Server) records(snapshot *state.Snapshot) []*state.Record {
+	return snapshot.Records(s.TTL)
+}
+
+func endpoints(snapshot *state.Snapshot, records []*state.Record, match func(*state.ContainerEndpoint) bool) []endpointJSON {
+	names := make(map[*state.ContainerEndpoint][]string)
+
+	for _, record := range records {
+		if t := record.RR.Header().Rrtype; t != dns.TypeA && t != dns.TypeAAAA {
+			continue
+		}
+
+		name, e := record.RR.Header().Name, record.Endpoint
+		if n := len(names[e]); n == 0 || names[e][n-1] != name {
+			names[e] = append(names[e], name)
+		}
+	}
+
+	endpoints := []endpointJSON{}
+
+	for _, nw := range snapshot.Networks {
+		for _, e := range snapshot.NetworkEndpoints(nw.ID) {
+			if !match(e) {
+				continue
+			}
+
+			endpoint := endpointJSON{
+				NetworkID:     e.NetworkID,
+				Network:       nw.Name,
+				ContainerID:   e.ContainerID,
+				ContainerName: e.ContainerName,
+				IPv4Address:   e.IPv4Address,
+				IPv6Address:   e.IPv6Address,
+				Aliases:       e.Aliases,
+				Links:         e.Links,
+				Hostname:      e.FQDN(),
+				Names:         names[e],
+				Status:        newStatusJSON(snapshot.RecordStatus(e.ContainerID)),
+				Labels:        e.Labels,
+			}
+
+			if endpoint.Names == nil {
+				endpoint.Names = []string{}
+			}
+
+			for _, port := range e.Ports {
+				endpoint.Ports = append(endpoint.Ports, port.String())
+			}
+
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Network != endpoints[j].Network {
+			return endpoints[i].Network < endpoints[j].Network
+		}
+
+		return endpoints[i].ContainerName < endpoints[j].ContainerName
+	})
+
+	return endpoints
+}
+
+func containers(snapshot *state.Snapshot, match func(string, *state.Container) bool) []containerJSON {
+	containers := []containerJSON{}
+
+	for id, c := range snapshot.Containers {
+		if !match(id, c) {
+			continue
+		}
+
+		container := containerJSON{
+			ID:           id,
+			Name:         c.Name,
+			Running:      c.Running,
+			Paused:       c.Paused,
+			Health:       c.Health,
+			HealthPolicy: c.HealthPolicy,
+			Status:       newStatusJSON(snapshot.RecordStatus(id)),
+			Networks:     []string{},
+			Labels:       c.Labels,
+		}
+
+		if len(container.HealthPolicy) == 0 {
+			container.HealthPolicy = snapshot.HealthPolicy
+		}
+
+		for _, nw := range containerNetworks(snapshot, id) {
+			container.Networks = append(container.Networks, nw.Name)
+		}
+
+		sort.Strings(container.Networks)
+
+		containers = append(containers, container)
+	}
+
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+
+	return containers
+}
+
+func recordsJSON(snapshot *state.Snapshot, records []*state.Record, match func(*state.Record) bool) []recordJSON {
+	matched := []recordJSON{}
+
+	for _, record := range records {
+		if !match(record) {
+			continue
+		}
+
+		hdr := record.RR.Header()
+
+		r := recordJSON{
+			Name:        hdr.Name,
+			Type:        dns.TypeToString[hdr.Rrtype],
+			TTL:         hdr.Ttl,
+			Data:        strings.TrimPrefix(record.RR.String(), hdr.String()),
+			ContainerID: record.Endpoint.ContainerID,
+		}
+
+		if nw, exists := snapshot.Networks[record.Endpoint.NetworkID]; exists {
+			r.Network = nw.Name
+		}
+
+		matched = append(matched, r)
+	}
+
+	return matched
+}
+
+func newNetworkJSON(snapshot *state.Snapshot, nw *state.Network) networkJSON {
+	network := networkJSON{
+		ID:        nw.ID,
+		Name:      nw.Name,
+		Zone:      snapshot.NetworkZone(nw),
+		Disabled:  nw.DNS.Disable,
+		Subnets:   []string{},
+		Gateways:  []string{},
+		Endpoints: len(nw.ContainerEndpoints),
+		Labels:    nw.Labels,
+	}
+
+	for _, subnet := range nw.Subnets {
+		network.Subnets = append(network.Subnets, subnet.String())
+	}
+	for _, gateway := range nw.Gateways {
+		network.Gateways = append(network.Gateways, gateway.String())
+	}
+
+	return network
+}
+
+func newStatusJSON(status state.RecordStatus) statusJSON {
+	return statusJSON{Serving: status.Serving, Reason: status.Reason}
+}
+
+func containerNetworks(snapshot *state.Snapshot, containerID string) []*state.Network {
+	var networks []*state.Network
+
+	for _, nw := range snapshot.Networks {
+		if _, exists := nw.ContainerEndpoints[containerID]; exists {
+			networks = append(networks, nw)
+		}
+	}
+
+	return networks
+}
@@ -0,0 +1,883 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/dnssec"
+	"github.com/rakshasa/docker-container-dns/server"
+	"github.com/rakshasa/docker-container-dns/state"
+	"github.com/rakshasa/docker-container-dns/tsig"
+	"github.com/rakshasa/docker-container-dns/update"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of environment variables overriding config
+// keys, e.g. 'DCDNS_SPLIT_HORIZON' for 'split-horizon'.
+const EnvPrefix = "DCDNS_"
+
+// Config is the effective configuration, merged from the defaults, the
+// config file, environment variables and flags, in increasing order of
+// precedence.
+type Config struct {
+	Listen          string        `yaml:"listen"`
+	Domain          string        `yaml:"domain"`
+	TTL             uint32        `yaml:"ttl"`
+	Upstream        []string      `yaml:"upstream"`
+	Forward         []string      `yaml:"forward"`
+	Search          []string      `yaml:"search"`
+	SplitHorizon    string        `yaml:"split-horizon"`
+	AnswerOrder     string        `yaml:"answer-order"`
+	MaxAnswers      uint32        `yaml:"max-answers"`
+	ExternalPolicy  string        `yaml:"external-policy"`
+	HealthPolicy    string        `yaml:"health-policy"`
+	AdminListen     string        `yaml:"admin-listen"`
+	DockerVersion   string        `yaml:"docker-version"`
+	StatusInterval  time.Duration `yaml:"status-interval"`
+	NetworkEvents   []string      `yaml:"network-events"`
+	ContainerEvents []string      `yaml:"container-events"`
+	HostsFile       string        `yaml:"hosts-file"`
+	HostsInterval   time.Duration `yaml:"hosts-interval"`
+	Nameserver      string        `yaml:"nameserver"`
+	NameserverAddrs []string      `yaml:"nameserver-address"`
+	SerialScheme    string        `yaml:"serial-scheme"`
+	ZoneDir         string        `yaml:"zone-dir"`
+	ZoneInterval    time.Duration `yaml:"zone-interval"`
+	UpdateServer    string        `yaml:"update-server"`
+	UpdateZones     []string      `yaml:"update-zones"`
+	UpdateOwner     string        `yaml:"update-owner"`
+	UpdateTSIGKey   string        `yaml:"update-tsig-key"`
+	UpdateInterval  time.Duration `yaml:"update-interval"`
+	TSIGKeys        []string      `yaml:"tsig-keys"`
+	TransferACL     []string      `yaml:"transfer-acl"`
+	QueryACL        []string      `yaml:"query-acl"`
+	Notify          []string      `yaml:"notify"`
+	NotifyInterval  time.Duration `yaml:"notify-interval"`
+	TLSListen       string        `yaml:"tls-listen"`
+	TLSCert         string        `yaml:"tls-cert"`
+	TLSKey          string        `yaml:"tls-key"`
+	TLSClientCA     string        `yaml:"tls-client-ca"`
+	TLSReload       time.Duration `yaml:"tls-reload-interval"`
+	TLSIdleTimeout  time.Duration `yaml:"tls-idle-timeout"`
+	TLSMaxQueries   uint32        `yaml:"tls-max-queries"`
+	DoHListen       string        `yaml:"doh-listen"`
+	DoHClientCA     string        `yaml:"doh-client-ca"`
+	DoHProxies      []string      `yaml:"doh-trusted-proxies"`
+	DNSSECDir       string        `yaml:"dnssec-dir"`
+	DNSSECAlgorithm string        `yaml:"dnssec-algorithm"`
+	DNSSECDenial    string        `yaml:"dnssec-denial"`
+	DNSSECValidity  time.Duration `yaml:"dnssec-validity"`
+	KSKLifetime     time.Duration `yaml:"dnssec-ksk-lifetime"`
+	ZSKLifetime     time.Duration `yaml:"dnssec-zsk-lifetime"`
+	RolloverDelay   time.Duration `yaml:"dnssec-rollover-delay"`
+
+	// File is the config file the config was loaded from, if any.
+	File string `yaml:"-"`
+	// PrintConfig is set if the effective config should be printed instead
+	// of starting the server.
+	PrintConfig bool `yaml:"-"`
+
+	sources map[string]string
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Listen:          ":53",
+		Domain:          "docker.",
+		TTL:             30,
+		SplitHorizon:    server.SplitHorizonOff,
+		AnswerOrder:     server.OrderNone,
+		ExternalPolicy:  server.ExternalPolicyAll,
+		HealthPolicy:    state.HealthPolicyHealthy,
+		DockerVersion:   "1.40",
+		StatusInterval:  30 * time.Second,
+		NetworkEvents:   append([]string(nil), state.NetworkEventActions...),
+		ContainerEvents: append([]string(nil), state.ContainerEventActions...),
+		HostsInterval:   time.Second,
+		SerialScheme:    state.SerialSchemeUnixTime,
+		ZoneInterval:    time.Second,
+		UpdateOwner:     update.DefaultOwner,
+		UpdateInterval:  time.Second,
+		NotifyInterval:  time.Second,
+		TLSReload:       10 * time.Second,
+		TLSIdleTimeout:  10 * time.Second,
+		TLSMaxQueries:   128,
+		DNSSECAlgorithm: dnssec.AlgorithmECDSAP256,
+		DNSSECDenial:    dnssec.DenialBlackLies,
+		DNSSECValidity:  7 * 24 * time.Hour,
+		RolloverDelay:   24 * time.Hour,
+	}
+}
+
+// option is a config key, settable from the config file, an environment
+// variable and a flag of the same name.
+type option struct {
+	key   string
+	usage string
+	field func(c *Config) interface{}
+}
+
+// secretOptions are the keys holding tsig keys, which are redacted when the
+// config is marshaled.
+var secretOptions = map[string]bool{
+	"update-tsig-key": true,
+	"tsig-keys":       true,
+}
+
+var options = []option{
+	{"listen", "address and port to serve dns on, both udp and tcp",
+		func(c *Config) interface{} { return &c.Listen }},
+	{"domain", "domain the server is authoritative for",
+		func(c *Config) interface{} { return &c.Domain }},
+	{"ttl", "ttl of answers and negative caching",
+		func(c *Config) interface{} { return &c.TTL }},
+	{"upstream", "upstream resolvers for names outside the domain, '[udp://|tcp://]ip[:port][,...]', may be repeated",
+		func(c *Config) interface{} { return &c.Upstream }},
+	{"forward", "conditional forwarding rule, 'zone=upstream[,...]', may be repeated",
+		func(c *Config) interface{} { return &c.Forward }},
+	{"search", "zones searched in order for names directly within the domain, and allowed in container 'dns.zone' labels, 'zone[,...]', may be repeated",
+		func(c *Config) interface{} { return &c.Search }},
+	{"split-horizon", "answer names not scoped to a network with endpoints on the client's network, 'off', 'prefer' or 'restrict'",
+		func(c *Config) interface{} { return &c.SplitHorizon }},
+	{"answer-order", "order of the addresses of a name, 'none', 'shuffle', 'rotate', 'subnet' sorting by the client's address, or 'hash' for a stable order per client",
+		func(c *Config) interface{} { return &c.AnswerOrder }},
+	{"max-answers", "maximum addresses of each type in an answer, unlimited if zero",
+		func(c *Config) interface{} { return &c.MaxAnswers }},
+	{"external-policy", "split horizon answers for clients not on a network, 'all', 'none' or a network name",
+		func(c *Config) interface{} { return &c.ExternalPolicy }},
+	{"health-policy", "withhold records of containers, 'ignore', 'running' or 'healthy', overridden by the 'dns.health' label",
+		func(c *Config) interface{} { return &c.HealthPolicy }},
+	{"admin-listen", "address or 'unix:<path>' socket to serve the json admin api and prometheus metrics on, disabled if empty",
+		func(c *Config) interface{} { return &c.AdminListen }},
+	{"docker-version", "docker api version to use",
+		func(c *Config) interface{} { return &c.DockerVersion }},
+	{"status-interval", "delay before logging the state after changes, disabled if zero",
+		func(c *Config) interface{} { return &c.StatusInterval }},
+	{"network-events", "network events to subscribe to, may be repeated",
+		func(c *Config) interface{} { return &c.NetworkEvents }},
+	{"container-events", "container events to subscribe to, may be repeated",
+		func(c *Config) interface{} { return &c.ContainerEvents }},
+	{"hosts-file", "hosts file to keep a managed block of container addresses in, disabled if empty",
+		func(c *Config) interface{} { return &c.HostsFile }},
+	{"hosts-interval", "minimum delay between writes of the hosts file",
+		func(c *Config) interface{} { return &c.HostsInterval }},
+	{"nameserver", "primary nameserver of the SOA and NS records, 'ns.<domain>' if empty",
+		func(c *Config) interface{} { return &c.Nameserver }},
+	{"nameserver-address", "addresses of the nameserver, published as glue when it is within the zones, as required to load exported zones, 'ip[,...]', may be repeated",
+		func(c *Config) interface{} { return &c.NameserverAddrs }},
+	{"serial-scheme", "how zone serials are incremented when records change, 'unixtime' or 'date-counter'",
+		func(c *Config) interface{} { return &c.SerialScheme }},
+	{"zone-dir", "directory to continuously export zone files to, with serials continuing from the files of a previous run, disabled if empty",
+		func(c *Config) interface{} { return &c.ZoneDir }},
+	{"zone-interval", "minimum delay between exports of the zone files",
+		func(c *Config) interface{} { return &c.ZoneInterval }},
+	{"update-server", "address and port of a server to push records to with dynamic updates, disabled if empty",
+		func(c *Config) interface{} { return &c.UpdateServer }},
+	{"update-zones", "zones on the update server to push records to, 'zone[,...]', may be repeated, the domain if empty, add reverse zones to push PTR records",
+		func(c *Config) interface{} { return &c.UpdateZones }},
+	{"update-owner", "label of the '_<owner>.<zone>' txt record listing the names owned by this instance",
+		func(c *Config) interface{} { return &c.UpdateOwner }},
+	{"update-tsig-key", "tsig key to sign dynamic updates with, '[algorithm:]name:secret'",
+		func(c *Config) interface{} { return &c.UpdateTSIGKey }},
+	{"update-interval", "minimum delay between dynamic updates",
+		func(c *Config) interface{} { return &c.UpdateInterval }},
+	{"tsig-keys", "tsig keys accepted for signed requests and used for notify, '[algorithm:]name:secret[,...]', may be repeated",
+		func(c *Config) interface{} { return &c.TSIGKeys }},
+	{"transfer-acl", "rules allowing zone transfers, 'key@network[,...]' with '*' matching anything, may be repeated, refused if empty",
+		func(c *Config) interface{} { return &c.TransferACL }},
+	{"query-acl", "query access rule, '[client=net,...] [listener=udp|tcp|tls|https,...] [network=name,...] [zones=zone,...|*|none] [recursion] [transfer] [deny]', may be repeated or separated by ';' in the environment, first match applies and unmatched queries are refused, all allowed if empty",
+		func(c *Config) interface{} { return &c.QueryACL }},
+	{"notify", "secondaries to notify when a zone serial changes, 'ip[:port][@key][,...]', may be repeated",
+		func(c *Config) interface{} { return &c.Notify }},
+	{"notify-interval", "minimum delay between notifications",
+		func(c *Config) interface{} { return &c.NotifyInterval }},
+	{"tls-listen", "address and port to serve dns-over-tls on, usually ':853', disabled if empty",
+		func(c *Config) interface{} { return &c.TLSListen }},
+	{"tls-cert", "pem certificate file of the tls and https listeners, reloaded on change and SIGHUP",
+		func(c *Config) interface{} { return &c.TLSCert }},
+	{"tls-key", "pem private key file of the tls and https listeners, reloaded on change and SIGHUP",
+		func(c *Config) interface{} { return &c.TLSKey }},
+	{"tls-client-ca", "pem ca certificates that dns-over-tls clients must present a certificate signed by, requires tls-listen, disabled if empty",
+		func(c *Config) interface{} { return &c.TLSClientCA }},
+	{"tls-reload-interval", "delay between checks of the tls certificate files for changes",
+		func(c *Config) interface{} { return &c.TLSReload }},
+	{"tls-idle-timeout", "close tls connections idle for longer than this",
+		func(c *Config) interface{} { return &c.TLSIdleTimeout }},
+	{"tls-max-queries", "queries answered on a tls connection before it is closed, unlimited if zero",
+		func(c *Config) interface{} { return &c.TLSMaxQueries }},
+	{"doh-listen", "address and port to serve dns-over-https on '/dns-query', using tls-cert if set and plain http otherwise, disabled if empty",
+		func(c *Config) interface{} { return &c.DoHListen }},
+	{"doh-client-ca", "pem ca certificates that dns-over-https clients must present a certificate signed by, requires tls-cert, disabled if empty",
+		func(c *Config) interface{} { return &c.DoHClientCA }},
+	{"doh-trusted-proxies", "proxies whose 'Forwarded' or 'X-Forwarded-For' headers give the dns-over-https client address used by query acls, split horizon and metrics, 'net[,...]', may be repeated, the proxy address is used if empty",
+		func(c *Config) interface{} { return &c.DoHProxies }},
+	{"dnssec-dir", "directory of the dnssec key files, enabling online signing of the zones and generating keys if there are none, disabled if empty",
+		func(c *Config) interface{} { return &c.DNSSECDir }},
+	{"dnssec-algorithm", "algorithm of generated dnssec keys, 'ecdsap256sha256' or 'ed25519'",
+		func(c *Config) interface{} { return &c.DNSSECAlgorithm }},
+	{"dnssec-denial", "denial of existence, 'black-lies' for compact NODATA answers or 'nsec' for minimally covering NSEC records",
+		func(c *Config) interface{} { return &c.DNSSECDenial }},
+	{"dnssec-validity", "validity period of dnssec signatures",
+		func(c *Config) interface{} { return &c.DNSSECValidity }},
+	{"dnssec-ksk-lifetime", "roll over the key signing key after this long, disabled if zero",
+		func(c *Config) interface{} { return &c.KSKLifetime }},
+	{"dnssec-zsk-lifetime", "roll over the zone signing key after this long, disabled if zero",
+		func(c *Config) interface{} { return &c.ZSKLifetime }},
+	{"dnssec-rollover-delay", "time a new key is published before it is used, and an old key after it was last used",
+		func(c *Config) interface{} { return &c.RolloverDelay }},
+}
+
+// EnvName returns the environment variable of a config key.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// Load parses the flags in args, then merges the config file given by the
+// '-config' flag or the DCDNS_CONFIG environment variable, the DCDNS_*
+// variables in environ and the flags that were set on top of the
+// defaults. The result is validated.
+//
+// List keys set from the environment are separated by whitespace, or by
+// newlines and semicolons for keys with values containing spaces, while list
+// flags replace the configured list when repeated.
+//
+// Invalid flags are reported on stderr with the usage and returned as an
+// error, which is flag.ErrHelp if help was requested.
+func Load(name string, args []string, environ []string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 && strings.HasPrefix(parts[0], EnvPrefix) {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	cfg := Default()
+	cfg.sources = make(map[string]string)
+
+	fs.StringVar(&cfg.File, "config", env[EnvName("config")], "yaml config file, also set with "+EnvName("config"))
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "print the effective config and exit")
+
+	flags := make(map[string]*optionFlag)
+
+	for _, opt := range options {
+		flags[opt.key] = &optionFlag{defaults: cfg, option: opt}
+		fs.Var(flags[opt.key], opt.key, opt.usage+", also set with "+EnvName(opt.key))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if len(cfg.File) != 0 {
+		if err := cfg.loadFile(cfg.File); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, opt := range options {
+		value, exists := env[EnvName(opt.key)]
+		if !exists {
+			continue
+		}
+
+		source := "environment variable " + EnvName(opt.key)
+
+		if err := setOption(cfg, opt, envValues(opt.key, value), value); err != nil {
+			return nil, fmt.Errorf("invalid config key '%s' from %s: %v", opt.key, source, err)
+		}
+
+		cfg.sources[opt.key] = source
+	}
+
+	for _, opt := range options {
+		f := flags[opt.key]
+		if len(f.values) == 0 {
+			continue
+		}
+
+		source := "flag -" + opt.key
+
+		if err := setOption(cfg, opt, f.values, f.values[len(f.values)-1]); err != nil {
+			return nil, fmt.Errorf("invalid config key '%s' from %s: %v", opt.key, source, err)
+		}
+
+		cfg.sources[opt.key] = source
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	for key := range keys {
+		c.sources[key] = "config file " + path
+	}
+
+	return nil
+}
+
+// Source returns where the value of a key was set.
+func (c *Config) Source(key string) string {
+	if source, exists := c.sources[key]; exists {
+		return source
+	}
+
+	return "default"
+}
+
+// Validate checks the value of every key, returning an error naming the
+// first invalid key and where it was set.
+func (c *Config) Validate() error {
+	for _, opt := range options {
+		if err := c.validateOption(opt.key); err != nil {
+			return fmt.Errorf("invalid config key '%s' from %s: %v", opt.key, c.Source(opt.key), err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateOption(key string) error {
+	switch key {
+	case "listen":
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("must be 'host:port': %v", err)
+		}
+	case "admin-listen":
+		if len(c.AdminListen) == 0 || strings.HasPrefix(c.AdminListen, "unix:") {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(c.AdminListen); err != nil {
+			return fmt.Errorf("must be 'host:port' or 'unix:<path>': %v", err)
+		}
+	case "domain":
+		if _, ok := dns.IsDomainName(c.Domain); !ok || len(c.Domain) == 0 || c.Domain == "." {
+			return fmt.Errorf("invalid domain name: %s", c.Domain)
+		}
+	case "ttl":
+		if c.TTL > 1<<31-1 {
+			return fmt.Errorf("must be at most %d", 1<<31-1)
+		}
+	case "upstream":
+		for _, value := range c.Upstream {
+			for _, addr := range strings.Split(value, ",") {
+				if _, err := server.ParseUpstream(strings.TrimSpace(addr)); err != nil {
+					return err
+				}
+			}
+		}
+	case "forward":
+		for _, value := range c.Forward {
+			if _, err := server.ParseForwardRule(value); err != nil {
+				return err
+			}
+		}
+	case "search":
+		for _, zone := range c.SearchZones() {
+			if _, ok := dns.IsDomainName(zone); !ok {
+				return fmt.Errorf("invalid zone: %s", zone)
+			}
+		}
+	case "answer-order":
+		return server.Ordering{Mode: c.AnswerOrder}.Validate()
+	case "split-horizon":
+		return server.SplitHorizon{Mode: c.SplitHorizon, ExternalPolicy: server.ExternalPolicyAll}.Validate()
+	case "external-policy":
+		return server.SplitHorizon{Mode: server.SplitHorizonOff, ExternalPolicy: c.ExternalPolicy}.Validate()
+	case "health-policy":
+		_, err := state.ParseHealthPolicy(c.HealthPolicy)
+		return err
+	case "docker-version":
+		if _, err := strconv.ParseFloat(c.DockerVersion, 64); err != nil {
+			return fmt.Errorf("must be an api version such as '1.40': %s", c.DockerVersion)
+		}
+	case "status-interval":
+		if c.StatusInterval < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+	case "hosts-interval":
+		if c.HostsInterval <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+	case "nameserver":
+		if _, ok := dns.IsDomainName(c.Nameserver); len(c.Nameserver) != 0 && !ok {
+			return fmt.Errorf("invalid domain name: %s", c.Nameserver)
+		}
+	case "nameserver-address":
+		_, err := c.NameserverAddresses()
+		return err
+	case "serial-scheme":
+		_, err := state.ParseSerialScheme(c.SerialScheme)
+		return err
+	case "zone-interval":
+		if c.ZoneInterval <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+	case "update-server":
+		if len(c.UpdateServer) == 0 {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(c.UpdateServer); err != nil {
+			return fmt.Errorf("must be 'host:port': %v", err)
+		}
+	case "update-zones":
+		for _, zone := range c.UpdateZoneNames() {
+			if _, ok := dns.IsDomainName(zone); !ok {
+				return fmt.Errorf("invalid zone: %s", zone)
+			}
+		}
+	case "update-owner":
+		if _, ok := dns.IsDomainName(c.UpdateOwner); !ok || len(c.UpdateOwner) == 0 || strings.Contains(c.UpdateOwner, ".") {
+			return fmt.Errorf("must be a single label: %s", c.UpdateOwner)
+		}
+	case "update-tsig-key":
+		if len(c.UpdateTSIGKey) == 0 {
+			return nil
+		}
+		_, err := tsig.ParseKey(c.UpdateTSIGKey)
+		return err
+	case "update-interval":
+		if c.UpdateInterval <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+	case "tsig-keys":
+		_, err := c.TSIGKeyMap()
+		return err
+	case "transfer-acl":
+		_, err := c.TransferRules()
+		return err
+	case "query-acl":
+		_, err := c.AccessRules()
+		return err
+	case "notify":
+		_, err := c.NotifyTargets()
+		return err
+	case "notify-interval":
+		if c.NotifyInterval <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+	case "tls-listen":
+		if len(c.TLSListen) == 0 {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(c.TLSListen); err != nil {
+			return fmt.Errorf("must be 'host:port': %v", err)
+		}
+	case "tls-cert":
+		if len(c.TLSListen) != 0 && len(c.TLSCert) == 0 {
+			return fmt.Errorf("required by tls-listen")
+		}
+	case "tls-client-ca":
+		if len(c.TLSClientCA) != 0 && len(c.TLSListen) == 0 {
+			return fmt.Errorf("requires tls-listen")
+		}
+	case "doh-client-ca":
+		if len(c.DoHClientCA) == 0 {
+			return nil
+		}
+		if len(c.DoHListen) == 0 {
+			return fmt.Errorf("requires doh-listen")
+		}
+		if len(c.TLSCert) == 0 {
+			return fmt.Errorf("requires tls-cert, as dns-over-https is served as plain http otherwise")
+		}
+	case "tls-key":
+		if len(c.TLSListen) != 0 && len(c.TLSKey) == 0 {
+			return fmt.Errorf("required by tls-listen")
+		}
+		if len(c.TLSCert) != 0 && len(c.TLSKey) == 0 {
+			return fmt.Errorf("required by tls-cert")
+		}
+	case "doh-listen":
+		if len(c.DoHListen) == 0 {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(c.DoHListen); err != nil {
+			return fmt.Errorf("must be 'host:port': %v", err)
+		}
+	case "doh-trusted-proxies":
+		_, err := c.TrustedProxies()
+		return err
+	case "tls-reload-interval":
+		if c.TLSReload <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+	case "tls-idle-timeout":
+		if c.TLSIdleTimeout <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+	case "dnssec-algorithm":
+		_, err := dnssec.ParseAlgorithm(c.DNSSECAlgorithm)
+		return err
+	case "dnssec-denial":
+		_, err := dnssec.ParseDenial(c.DNSSECDenial)
+		return err
+	case "dnssec-validity":
+		if c.DNSSECValidity < time.Hour {
+			return fmt.Errorf("must be at least an hour")
+		}
+	case "dnssec-ksk-lifetime":
+		return validateLifetime(c.KSKLifetime, c.RolloverDelay)
+	case "dnssec-zsk-lifetime":
+		return validateLifetime(c.ZSKLifetime, c.RolloverDelay)
+	case "dnssec-rollover-delay":
+		if c.RolloverDelay <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+	case "network-events":
+		return validateEvents(c.NetworkEvents, state.NetworkEventActions)
+	case "container-events":
+		return validateEvents(c.ContainerEvents, state.ContainerEventActions)
+	}
+
+	return nil
+}
+
+func validateLifetime(lifetime, delay time.Duration) error {
+	if lifetime != 0 && lifetime <= 2*delay {
+		return fmt.Errorf("must be zero or longer than twice dnssec-rollover-delay")
+	}
+
+	return nil
+}
+
+func validateEvents(actions, supported []string) error {
+	for _, action := range actions {
+		found := false
+
+		for _, s := range supported {
+			found = found || action == s
+		}
+
+		if !found {
+			return fmt.Errorf("unsupported event '%s', must be one of: %s", action, strings.Join(supported, ", "))
+		}
+	}
+
+	return nil
+}
+
+// SearchZones returns the search zones, splitting comma separated values.
+func (c *Config) SearchZones() []string {
+	return splitList(c.Search)
+}
+
+func splitList(values []string) []string {
+	var items []string
+
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				items = append(items, item)
+			}
+		}
+	}
+
+	return items
+}
+
+// UpdateZoneNames returns the update zones, splitting comma separated
+// values, or the domain if empty.
+func (c *Config) UpdateZoneNames() []string {
+	if zones := splitList(c.UpdateZones); len(zones) != 0 {
+		return zones
+	}
+
+	return []string{c.Domain}
+}
+
+// NameserverAddresses returns the nameserver addresses, splitting comma
+// separated values.
+func (c *Config) NameserverAddresses() ([]net.IP, error) {
+	var addresses []net.IP
+
+	for _, value := range splitList(c.NameserverAddrs) {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address: %s", value)
+		}
+
+		addresses = append(addresses, ip)
+	}
+
+	return addresses, nil
+}
+
+// TSIGKeyMap returns the tsig keys by name, splitting comma separated
+// values.
+func (c *Config) TSIGKeyMap() (map[string]*tsig.Key, error) {
+	return tsig.ParseKeys(splitList(c.TSIGKeys))
+}
+
+// TransferRules returns the transfer acl, splitting comma separated
+// values. Rules must use keys from the tsig keys.
+func (c *Config) TransferRules() ([]*server.TransferRule, error) {
+	keys, err := c.TSIGKeyMap()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tsig keys: %v", err)
+	}
+
+	var rules []*server.TransferRule
+
+	for _, value := range splitList(c.TransferACL) {
+		rule, err := server.ParseTransferRule(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := keys[rule.Key]; len(rule.Key) != 0 && !exists {
+			return nil, fmt.Errorf("unknown tsig key '%s' in transfer rule %s", strings.TrimSuffix(rule.Key, "."), value)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// AccessRules returns the query acl. Rules contain commas, so values are
+// not split.
+func (c *Config) AccessRules() ([]*server.AccessRule, error) {
+	var rules []*server.AccessRule
+
+	for _, value := range c.QueryACL {
+		rule, err := server.ParseAccessRule(value)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// NotifyTargets returns the notify targets, splitting comma separated
+// values.
+func (c *Config) NotifyTargets() ([]*server.NotifyTarget, error) {
+	keys, err := c.TSIGKeyMap()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tsig keys: %v", err)
+	}
+
+	var targets []*server.NotifyTarget
+
+	for _, value := range splitList(c.Notify) {
+		target, err := server.ParseNotifyTarget(value, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// TrustedProxies returns the dns-over-https trusted proxies, splitting
+// comma separated values.
+func (c *Config) TrustedProxies() ([]*net.IPNet, error) {
+	return server.ParseTrustedProxies(splitList(c.DoHProxies))
+}
+
+// Upstreams returns the default upstreams, splitting comma separated
+// values.
+func (c *Config) Upstreams() ([]*server.Upstream, error) {
+	var upstreams []*server.Upstream
+
+	for _, value := range c.Upstream {
+		for _, addr := range strings.Split(value, ",") {
+			upstream, err := server.ParseUpstream(strings.TrimSpace(addr))
+			if err != nil {
+				return nil, err
+			}
+
+			upstreams = append(upstreams, upstream)
+		}
+	}
+
+	return upstreams, nil
+}
+
+// redactedSecret replaces the secret of tsig keys in marshaled configs.
+const redactedSecret = "REDACTED"
+
+// redactKey replaces the secret of a '[algorithm:]name:secret' key, or of
+// each key in a comma separated list.
+func redactKey(value string) string {
+	keys := strings.Split(value, ",")
+
+	for i, key := range keys {
+		if n := strings.LastIndex(key, ":"); n != -1 {
+			keys[i] = key[:n+1] + redactedSecret
+		} else if len(strings.TrimSpace(key)) != 0 {
+			keys[i] = redactedSecret
+		}
+	}
+
+	return strings.Join(keys, ",")
+}
+
+// Marshal returns the config as yaml, with keys in the order of the
+// flags. The secrets of tsig keys are redacted.
+func (c *Config) Marshal() ([]byte, error) {
+	var m yaml.MapSlice
+
+	for _, opt := range options {
+		var value interface{}
+
+		switch v := opt.field(c).(type) {
+		case *time.Duration:
+			value = v.String()
+		case *[]string:
+			values := []string{}
+			for _, item := range *v {
+				if secretOptions[opt.key] {
+					item = redactKey(item)
+				}
+				values = append(values, item)
+			}
+			value = values
+		case *string:
+			value = *v
+			if secretOptions[opt.key] && len(*v) != 0 {
+				value = redactKey(*v)
+			}
+		case *uint32:
+			value = *v
+		}
+
+		m = append(m, yaml.MapItem{Key: opt.key, Value: value})
+	}
+
+	return yaml.Marshal(m)
+}
+
+// envValues splits the list value of a key set from the environment.
+// Query access rules contain spaces, so they are separated by newlines or
+// semicolons instead.
+func envValues(key, value string) []string {
+	switch key {
+	case "query-acl":
+		var values []string
+
+		for _, v := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == ';' }) {
+			if v = strings.TrimSpace(v); len(v) != 0 {
+				values = append(values, v)
+			}
+		}
+
+		return values
+	default:
+		return strings.Fields(value)
+	}
+}
+
+// setOption sets the key from a string. List keys are replaced by values.
+func setOption(c *Config, opt option, values []string, value string) error {
+	switch v := opt.field(c).(type) {
+	case *string:
+		*v = value
+	case *uint32:
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return fmt.Errorf("must be a non-negative integer: %s", value)
+		}
+		*v = uint32(n)
+	case *time.Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("must be a duration such as '30s': %s", value)
+		}
+		*v = d
+	case *[]string:
+		*v = append([]string(nil), values...)
+	default:
+		return fmt.Errorf("unsupported config key type %T", v)
+	}
+
+	return nil
+}
+
+// optionFlag records the values of a flag, which are applied after the
+// config file and environment.
+type optionFlag struct {
+	defaults *Config
+	option   option
+	values   []string
+}
+
+func (f *optionFlag) String() string {
+	if f == nil || f.defaults == nil {
+		return ""
+	}
+
+	switch v := f.option.field(f.defaults).(type) {
+	case *string:
+		return *v
+	case *uint32:
+		return strconv.FormatUint(uint64(*v), 10)
+	case *time.Duration:
+		return v.String()
+	case *[]string:
+		return strings.Join(*v, ",")
+	}
+
+	return ""
+}
+
+func (f *optionFlag) Set(value string) error {
+	f.values = append(f.values, value)
+	return nil
+}
+
+// Print writes the effective config as yaml, with comments noting where
+// keys were set if not by default.
+func (c *Config) Print(w io.Writer) error {
+	data, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if len(c.File) != 0 {
+		fmt.Fprintf(w, "# config file: %s\n", c.File)
+	}
+
+	for _, opt := range options {
+		if source := c.Source(opt.key); source != "default" {
+			fmt.Fprintf(w, "# %s: %s\n", opt.key, source)
+		}
+	}
+
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("could not write config file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load("test", nil, nil)
+	if err != nil {
+		t.Fatalf("could not load default config: %v", err)
+	}
+
+	if cfg.Listen != ":53" || cfg.Domain != "docker." || cfg.TTL != 30 || cfg.StatusInterval != 30*time.Second || cfg.DockerVersion != "1.40" {
+		t.Errorf("unexpected default config: %+v", cfg)
+	}
+	if len(cfg.NetworkEvents) != 4 || cfg.Source("listen") != "default" {
+		t.Errorf("unexpected default network events or source: %v %s", cfg.NetworkEvents, cfg.Source("listen"))
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+domain: example.internal.
+ttl: 60
+listen: 127.0.0.1:5353
+upstream:
+  - 10.0.0.53
+  - 10.0.0.54
+status-interval: 1m
+`)
+
+	cfg, err := Load("test",
+		[]string{"-config", path, "-ttl", "90", "-upstream", "192.0.2.53", "-upstream", "192.0.2.54"},
+		[]string{"DCDNS_TTL=120", "DCDNS_LISTEN=127.0.0.1:5454", "DCDNS_SEARCH=a.docker. b.docker.", "HOME=/root"},
+	)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	if cfg.Domain != "example.internal." || cfg.Source("domain") != "config file "+path {
+		t.Errorf("unexpected domain from config file: %s %s", cfg.Domain, cfg.Source("domain"))
+	}
+	if cfg.Listen != "127.0.0.1:5454" || cfg.Source("listen") != "environment variable DCDNS_LISTEN" {
+		t.Errorf("unexpected listen from environment: %s %s", cfg.Listen, cfg.Source("listen"))
+	}
+	if cfg.TTL != 90 || cfg.Source("ttl") != "flag -ttl" {
+		t.Errorf("unexpected ttl from flag: %d %s", cfg.TTL, cfg.Source("ttl"))
+	}
+	if strings.Join(cfg.Upstream, " ") != "192.0.2.53 192.0.2.54" {
+		t.Errorf("expected upstream flags to replace config file list: %v", cfg.Upstream)
+	}
+	if strings.Join(cfg.SearchZones(), " ") != "a.docker. b.docker." {
+		t.Errorf("unexpected search zones from environment: %v", cfg.SearchZones())
+	}
+	if cfg.StatusInterval != time.Minute {
+		t.Errorf("unexpected status interval: %v", cfg.StatusInterval)
+	}
+}
+
+func TestLoadQueryACL(t *testing.T) {
+	cfg, err := Load("test", nil, []string{"DCDNS_QUERY_ACL=client=10.0.0.0/8,fd00::/8 listener=udp,tcp recursion; \nzones=backend.docker transfer\ndeny"})
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	if len(cfg.QueryACL) != 3 || cfg.QueryACL[0] != "client=10.0.0.0/8,fd00::/8 listener=udp,tcp recursion" {
+		t.Fatalf("unexpected query acl from environment: %q", cfg.QueryACL)
+	}
+
+	rules, err := cfg.AccessRules()
+	if err != nil {
+		t.Fatalf("could not parse access rules: %v", err)
+	}
+
+	if len(rules) != 3 || len(rules[0].Clients) != 2 || len(rules[0].Listeners) != 2 || !rules[0].Recursion || !rules[1].Transfer || rules[2].AllowsZone("docker.") {
+		t.Errorf("unexpected access rules: %+v %+v %+v", rules[0], rules[1], rules[2])
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		args    []string
+		environ []string
+		err     string
+	}{
+		{content: "ttl: 30\nlisten-addr: :53\n", err: "field listen-addr not found"},
+		{args: []string{"-listen-addr", ":53"}, err: "flag provided but not defined: -listen-addr"},
+		{args: []string{"-ttl"}, err: "flag needs an argument: -ttl"},
+		{content: "ttl: thirty\n", err: "line 1"},
+		{content: "split-horizon: sometimes\n", err: "invalid config key 'split-horizon' from config file"},
+		{environ: []string{"DCDNS_TTL=-1"}, err: "invalid config key 'ttl' from environment variable DCDNS_TTL"},
+		{args: []string{"-upstream", "dns.example.com"}, err: "invalid config key 'upstream' from flag -upstream"},
+		{args: []string{"-container-events", "exec_start"}, err: "unsupported event 'exec_start'"},
+		{args: []string{"-admin-listen", "localhost"}, err: "invalid config key 'admin-listen' from flag -admin-listen"},
+		{args: []string{"-status-interval", "soon"}, err: "invalid config key 'status-interval'"},
+		{environ: []string{"DCDNS_SERIAL_SCHEME=date"}, err: "unknown serial scheme 'date'"},
+		{args: []string{"-update-tsig-key", "hmac-md5:key:c2VjcmV0"}, err: "unsupported tsig algorithm 'hmac-md5'"},
+		{args: []string{"-update-owner", "dcdns.example"}, err: "invalid config key 'update-owner'"},
+		{args: []string{"-transfer-acl", "xfr@10.0.0.0/8"}, err: "unknown tsig key 'xfr' in transfer rule"},
+		{args: []string{"-tsig-keys", "xfr:c2VjcmV0", "-notify", "ns2.example.com@xfr"}, err: "invalid config key 'notify'"},
+		{args: []string{"-tls-listen", ":853", "-tls-key", "key.pem"}, err: "invalid config key 'tls-cert' from default: required by tls-listen"},
+		{args: []string{"-doh-listen", "443"}, err: "invalid config key 'doh-listen'"},
+		{args: []string{"-tls-client-ca", "ca.pem"}, err: "invalid config key 'tls-client-ca' from flag -tls-client-ca: requires tls-listen"},
+		{args: []string{"-doh-listen", ":8053", "-doh-client-ca", "ca.pem"}, err: "invalid config key 'doh-client-ca' from flag -doh-client-ca: requires tls-cert"},
+		{args: []string{"-tls-cert", "cert.pem", "-tls-key", "key.pem", "-doh-client-ca", "ca.pem"}, err: "invalid config key 'doh-client-ca' from flag -doh-client-ca: requires doh-listen"},
+		{args: []string{"-doh-trusted-proxies", "10.0.0.0/8,proxy"}, err: "invalid trusted proxy 'proxy'"},
+		{args: []string{"-answer-order", "random"}, err: "invalid config key 'answer-order'"},
+		{args: []string{"-query-acl", "client=10.0.0.0/8 listener=quic"}, err: "invalid config key 'query-acl'"},
+		{environ: []string{"DCDNS_QUERY_ACL=recursion;listener=quic"}, err: "invalid config key 'query-acl' from environment variable DCDNS_QUERY_ACL"},
+		{args: []string{"-dnssec-algorithm", "rsasha256"}, err: "invalid config key 'dnssec-algorithm'"},
+		{args: []string{"-dnssec-zsk-lifetime", "36h"}, err: "invalid config key 'dnssec-zsk-lifetime'"},
+	} {
+		args := tc.args
+		if len(tc.content) != 0 {
+			args = append([]string{"-config", writeConfigFile(t, tc.content)}, args...)
+		}
+
+		_, err := Load("test", args, tc.environ)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error containing '%s' for %v %v: %v", tc.err, args, tc.environ, err)
+		}
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	if _, err := Load("test", []string{"-h"}, nil); err != flag.ErrHelp {
+		t.Errorf("expected help to return flag.ErrHelp: %v", err)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg, err := Load("test", []string{"-print-config", "-ttl", "10"}, []string{"DCDNS_DOMAIN=example.internal."})
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if !cfg.PrintConfig {
+		t.Errorf("expected print config to be set")
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("could not print config: %v", err)
+	}
+
+	for _, expected := range []string{
+		"# ttl: flag -ttl\n",
+		"# domain: environment variable DCDNS_DOMAIN\n",
+		"domain: example.internal.\n",
+		"ttl: 10\n",
+		"status-interval: 30s\n",
+		"upstream: []\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected '%s' in printed config:\n%s", strings.TrimSpace(expected), buf.String())
+		}
+	}
+
+	reloaded, err := Load("test", []string{"-config", writeConfigFile(t, buf.String())}, nil)
+	if err != nil || reloaded.TTL != 10 || reloaded.Domain != "example.internal." {
+		t.Errorf("could not load printed config: %+v %v", reloaded, err)
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg, err := Load("test", []string{
+		"-update-server", "192.0.2.1:53",
+		"-update-tsig-key", "hmac-sha512:update:c2VjcmV0MQ==",
+		"-tsig-keys", "xfr:c2VjcmV0Mg==,notify:c2VjcmV0Mw==",
+	}, nil)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("could not print config: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "c2VjcmV0") {
+		t.Errorf("expected secrets to be redacted:\n%s", buf.String())
+	}
+	for _, expected := range []string{
+		"update-tsig-key: hmac-sha512:update:REDACTED\n",
+		"- xfr:REDACTED,notify:REDACTED\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected '%s' in printed config:\n%s", strings.TrimSpace(expected), buf.String())
+		}
+	}
+	if cfg.UpdateTSIGKey != "hmac-sha512:update:c2VjcmV0MQ==" {
+		t.Errorf("expected config to keep the secret: %s", cfg.UpdateTSIGKey)
+	}
+}
+
+func TestUpdateZoneNames(t *testing.T) {
+	cfg, err := Load("test", []string{"-domain", "example.internal."}, nil)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if zones := cfg.UpdateZoneNames(); strings.Join(zones, " ") != "example.internal." {
+		t.Errorf("expected update zones to default to the domain: %v", zones)
+	}
+
+	cfg, err = Load("test", []string{"-update-zones", "docker.,20.172.in-addr.arpa."}, nil)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if zones := cfg.UpdateZoneNames(); strings.Join(zones, " ") != "docker. 20.172.in-addr.arpa." {
+		t.Errorf("unexpected update zones: %v", zones)
+	}
+}
@@ -0,0 +1,293 @@
+package dnssec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/atomicfile"
+)
+
+const (
+	AlgorithmECDSAP256 = "ecdsap256sha256"
+	AlgorithmED25519   = "ed25519"
+
+	// keyTTL is the ttl of the DNSKEY records in generated key files,
+	// which is replaced by the zone ttl when published.
+	keyTTL = 3600
+
+	// timeFormat is the format of the timing metadata in key files, as
+	// written by dnssec-keygen and dnssec-settime.
+	timeFormat = "20060102150405"
+)
+
+var algorithms = map[string]uint8{
+	AlgorithmECDSAP256: dns.ECDSAP256SHA256,
+	AlgorithmED25519:   dns.ED25519,
+}
+
+// ParseAlgorithm returns the DNSSEC algorithm number of a key algorithm
+// name.
+func ParseAlgorithm(value string) (uint8, error) {
+	algorithm, ok := algorithms[strings.ToLower(value)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported dnssec algorithm '%s', must be '%s' or '%s'", value, AlgorithmECDSAP256, AlgorithmED25519)
+	}
+
+	return algorithm, nil
+}
+
+// Key is a DNSSEC key pair, stored as a pair of '.key' and '.private'
+// files in the format used by BIND. The timing metadata schedules when
+// the key is published and used for signing, and may be changed with
+// dnssec-settime to roll keys manually.
+//
+// Zero times are unset, with an unset Publish meaning the key is
+// published as soon as it is loaded.
+type Key struct {
+	DNSKEY  *dns.DNSKEY
+	Private crypto.Signer
+
+	Created  time.Time
+	Publish  time.Time
+	Activate time.Time
+	Inactive time.Time
+	Delete   time.Time
+}
+
+// GenerateKey generates a zone or key signing key for zone, published and
+// active from now.
+func GenerateKey(zone string, algorithm uint8, ksk bool, now time.Time) (*Key, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: keyTTL},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+
+	if ksk {
+		dnskey.Flags |= dns.SEP
+	}
+
+	private, err := dnskey.Generate(256)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate dnssec key: %v", err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported dnssec private key")
+	}
+
+	now = now.UTC().Truncate(time.Second)
+
+	return &Key{
+		DNSKEY:   dnskey,
+		Private:  signer,
+		Created:  now,
+		Publish:  now,
+		Activate: now,
+	}, nil
+}
+
+// ReadKey reads the key from the '.key' file at path and the matching
+// '.private' file.
+func ReadKey(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read dnssec key: %v", err)
+	}
+
+	key := &Key{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, ";") {
+			if err := key.parseTiming(strings.TrimSpace(strings.TrimPrefix(line, ";"))); err != nil {
+				return nil, fmt.Errorf("invalid dnssec key %s: %v", path, err)
+			}
+			continue
+		}
+		if len(line) == 0 || key.DNSKEY != nil {
+			continue
+		}
+
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dnssec key %s: %v", path, err)
+		}
+
+		dnskey, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, fmt.Errorf("invalid dnssec key %s: not a DNSKEY record", path)
+		}
+
+		key.DNSKEY = dnskey
+	}
+
+	if key.DNSKEY == nil {
+		return nil, fmt.Errorf("invalid dnssec key %s: no DNSKEY record", path)
+	}
+
+	privatePath := strings.TrimSuffix(path, ".key") + ".private"
+
+	f, err := os.Open(privatePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read dnssec private key: %v", err)
+	}
+	defer f.Close()
+
+	private, err := key.DNSKEY.ReadPrivateKey(f, privatePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dnssec private key %s: %v", privatePath, err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported dnssec private key %s", privatePath)
+	}
+
+	key.Private = signer
+
+	return key, nil
+}
+
+// ReadKeys reads all keys in dir.
+func ReadKeys(dir string) ([]*Key, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "K*.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*Key
+
+	for _, path := range paths {
+		key, err := ReadKey(path)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// parseTiming parses a 'Name: YYYYMMDDHHMMSS (...)' metadata comment,
+// ignoring other comments.
+func (k *Key) parseTiming(comment string) error {
+	parts := strings.SplitN(comment, ":", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	var field *time.Time
+
+	switch parts[0] {
+	case "Created":
+		field = &k.Created
+	case "Publish":
+		field = &k.Publish
+	case "Activate":
+		field = &k.Activate
+	case "Inactive":
+		field = &k.Inactive
+	case "Delete":
+		field = &k.Delete
+	default:
+		return nil
+	}
+
+	values := strings.Fields(parts[1])
+	if len(values) == 0 {
+		return fmt.Errorf("missing %s time", strings.ToLower(parts[0]))
+	}
+
+	t, err := time.Parse(timeFormat, values[0])
+	if err != nil {
+		return fmt.Errorf("invalid %s time: %v", strings.ToLower(parts[0]), err)
+	}
+
+	*field = t
+	return nil
+}
+
+// Write writes the key to dir, using the file names of dnssec-keygen.
+func (k *Key) Write(dir string) error {
+	var buf bytes.Buffer
+
+	kind := "zone"
+	if k.IsKSK() {
+		kind = "key"
+	}
+
+	fmt.Fprintf(&buf, "; This is a %s-signing key, keyid %d, for %s\n", kind, k.KeyTag(), k.DNSKEY.Hdr.Name)
+
+	for _, timing := range []struct {
+		name string
+		t    time.Time
+	}{
+		{"Created", k.Created},
+		{"Publish", k.Publish},
+		{"Activate", k.Activate},
+		{"Inactive", k.Inactive},
+		{"Delete", k.Delete},
+	} {
+		if !timing.t.IsZero() {
+			fmt.Fprintf(&buf, "; %s: %s (%s)\n", timing.name, timing.t.UTC().Format(timeFormat), timing.t.UTC().Format(time.ANSIC))
+		}
+	}
+
+	buf.WriteString(k.DNSKEY.String() + "\n")
+
+	path := filepath.Join(dir, k.FileName())
+
+	if err := atomicfile.WriteFile(path+".private", []byte(k.DNSKEY.PrivateKeyString(k.Private)), 0600); err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path+".key", buf.Bytes(), 0644)
+}
+
+// FileName returns the file name of the key without extension, e.g.
+// 'Kdocker.+013+12345'.
+func (k *Key) FileName() string {
+	return fmt.Sprintf("K%s+%03d+%05d", k.DNSKEY.Hdr.Name, k.DNSKEY.Algorithm, k.KeyTag())
+}
+
+func (k *Key) KeyTag() uint16 {
+	return k.DNSKEY.KeyTag()
+}
+
+// IsKSK returns true for key signing keys, which have the SEP flag.
+func (k *Key) IsKSK() bool {
+	return k.DNSKEY.Flags&dns.SEP != 0
+}
+
+// Published returns true if the DNSKEY record is published at now.
+func (k *Key) Published(now time.Time) bool {
+	return !now.Before(k.Publish) && (k.Delete.IsZero() || now.Before(k.Delete))
+}
+
+// Active returns true if the key signs records at now.
+func (k *Key) Active(now time.Time) bool {
+	return !k.Activate.IsZero() && !now.Before(k.Activate) && (k.Inactive.IsZero() || now.Before(k.Inactive)) && k.Published(now)
+}
+
+func (k *Key) String() string {
+	kind := "zsk"
+	if k.IsKSK() {
+		kind = "ksk"
+	}
+
+	return fmt.Sprintf("%s %d", kind, k.KeyTag())
+}
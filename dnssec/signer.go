@@ -0,0 +1,390 @@
+package dnssec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DenialBlackLies = "black-lies"
+	DenialNSEC      = "nsec"
+
+	// refreshInterval is the delay between rereading the key files and
+	// evaluating their timing metadata.
+	refreshInterval = time.Minute
+
+	// inceptionOffset backdates signatures to allow for clock skew.
+	inceptionOffset = time.Hour
+
+	// maxCachedSignatures limits the size of the signature cache, which is
+	// cleared when full.
+	maxCachedSignatures = 100000
+)
+
+// ParseDenial validates a denial of existence mode.
+func ParseDenial(value string) (string, error) {
+	switch value {
+	case DenialBlackLies, DenialNSEC:
+		return value, nil
+	}
+
+	return "", fmt.Errorf("unsupported dnssec denial '%s', must be '%s' or '%s'", value, DenialBlackLies, DenialNSEC)
+}
+
+// Signer signs records on the fly with the keys in Dir, which are shared
+// by all authoritative zones. A key signing key and a zone signing key
+// are generated for Domain if Dir has no active keys.
+//
+// Signatures are cached until half their validity has passed or the cache
+// is invalidated, which should be done when the records change.
+//
+// Active keys are rolled over automatically after KSKLifetime and
+// ZSKLifetime if set, publishing the successor RolloverDelay before it
+// replaces the current key and removing the current key RolloverDelay
+// after. Rollovers can also be scheduled by editing the timing metadata
+// of the key files, which are reread every minute.
+type Signer struct {
+	Dir       string
+	Domain    string
+	Algorithm uint8
+	Denial    string
+	Validity  time.Duration
+
+	KSKLifetime   time.Duration
+	ZSKLifetime   time.Duration
+	RolloverDelay time.Duration
+
+	mu        sync.Mutex
+	published []*Key
+	submitted []*Key
+	ksks      []*Key
+	zsks      []*Key
+	cache     map[string]*cachedSignatures
+}
+
+type cachedSignatures struct {
+	rrs     []dns.RR
+	refresh time.Time
+}
+
+func NewSigner(dir, domain string, algorithm uint8, denial string, validity time.Duration) *Signer {
+	return &Signer{
+		Dir:       dir,
+		Domain:    dns.Fqdn(strings.ToLower(domain)),
+		Algorithm: algorithm,
+		Denial:    denial,
+		Validity:  validity,
+		cache:     make(map[string]*cachedSignatures),
+	}
+}
+
+// Run refreshes the keys every minute until ctx is done.
+func (s *Signer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(refreshInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		if err := s.Refresh(time.Now()); err != nil {
+			log.Printf("dnssec key refresh failed, keeping the current keys: %v", err)
+		}
+	}
+}
+
+// Refresh rereads the key files, generates missing keys, schedules due
+// rollovers and selects the keys published and used for signing at now.
+func (s *Signer) Refresh(now time.Time) error {
+	keys, err := ReadKeys(s.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, ksk := range []bool{true, false} {
+		if activeKeys(keys, now, ksk) != nil {
+			continue
+		}
+
+		key, err := GenerateKey(s.Domain, s.Algorithm, ksk, now)
+		if err != nil {
+			return err
+		}
+		if err := key.Write(s.Dir); err != nil {
+			return fmt.Errorf("could not write dnssec key: %v", err)
+		}
+
+		log.Printf("dnssec %s generated in %s", key, s.Dir)
+
+		keys = append(keys, key)
+	}
+
+	if keys, err = s.rollover(keys, now, true, s.KSKLifetime); err != nil {
+		return err
+	}
+	if keys, err = s.rollover(keys, now, false, s.ZSKLifetime); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := keyTags(s.published) + "/" + keyTags(append(append([]*Key{}, s.ksks...), s.zsks...))
+
+	s.published, s.submitted = nil, nil
+	s.ksks, s.zsks = activeKeys(keys, now, true), activeKeys(keys, now, false)
+
+	for _, key := range keys {
+		if !key.Published(now) {
+			continue
+		}
+
+		s.published = append(s.published, key)
+
+		if key.IsKSK() && (key.Inactive.IsZero() || now.Before(key.Inactive)) {
+			s.submitted = append(s.submitted, key)
+		}
+	}
+
+	signing := keyTags(append(append([]*Key{}, s.ksks...), s.zsks...))
+
+	if current := keyTags(s.published) + "/" + signing; current != previous {
+		log.Printf("dnssec keys published: %s, signing with: %s", keyTags(s.published), signing)
+
+		s.cache = make(map[string]*cachedSignatures)
+	}
+
+	return nil
+}
+
+// rollover schedules a successor of the newest active key of a kind once
+// it is within RolloverDelay of the end of its lifetime, returning the
+// keys including the successor.
+func (s *Signer) rollover(keys []*Key, now time.Time, ksk bool, lifetime time.Duration) ([]*Key, error) {
+	if lifetime == 0 {
+		return keys, nil
+	}
+
+	var current *Key
+
+	for _, key := range activeKeys(keys, now, ksk) {
+		if key.Inactive.IsZero() && (current == nil || key.Activate.After(current.Activate)) {
+			current = key
+		}
+	}
+
+	if current == nil || now.Before(current.Activate.Add(lifetime-s.RolloverDelay)) {
+		return keys, nil
+	}
+
+	successor, err := GenerateKey(s.Domain, s.Algorithm, ksk, now)
+	if err != nil {
+		return nil, err
+	}
+
+	successor.Activate = current.Activate.Add(lifetime)
+	if earliest := now.Add(s.RolloverDelay); successor.Activate.Before(earliest) {
+		successor.Activate = earliest
+	}
+	successor.Activate = successor.Activate.UTC().Truncate(time.Second)
+
+	current.Inactive = successor.Activate
+	current.Delete = current.Inactive.Add(s.RolloverDelay)
+
+	for _, key := range []*Key{successor, current} {
+		if err := key.Write(s.Dir); err != nil {
+			return nil, fmt.Errorf("could not write dnssec key: %v", err)
+		}
+	}
+
+	log.Printf("dnssec %s published, replacing %s at %s", successor, current, successor.Activate.Format(time.RFC3339))
+
+	return append(keys, successor), nil
+}
+
+// Invalidate clears the signature cache.
+func (s *Signer) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cache = make(map[string]*cachedSignatures)
+}
+
+// Sign returns the signatures of an rrset in zone. The DNSKEY rrset is
+// signed with the active key signing keys, and other rrsets with the
+// active zone signing keys.
+func (s *Signer) Sign(zone string, rrset []dns.RR) ([]dns.RR, error) {
+	if len(rrset) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	key := cacheKey(zone, rrset)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cached, ok := s.cache[key]; ok && now.Before(cached.refresh) {
+		return copyRRs(cached.rrs), nil
+	}
+
+	keys := s.zsks
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY || len(keys) == 0 {
+		keys = s.ksks
+	}
+
+	var sigs []dns.RR
+
+	for _, k := range keys {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.DNSKEY.Algorithm,
+			KeyTag:     k.KeyTag(),
+			SignerName: zone,
+			Inception:  uint32(now.Add(-inceptionOffset).Unix()),
+			Expiration: uint32(now.Add(s.Validity).Unix()),
+		}
+
+		if err := sig.Sign(k.Private, rrset); err != nil {
+			return nil, fmt.Errorf("could not sign %s/%s with %s: %v", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], k, err)
+		}
+
+		sigs = append(sigs, sig)
+	}
+
+	if len(s.cache) >= maxCachedSignatures {
+		s.cache = make(map[string]*cachedSignatures)
+	}
+
+	s.cache[key] = &cachedSignatures{rrs: sigs, refresh: now.Add(s.Validity / 2)}
+
+	return copyRRs(sigs), nil
+}
+
+// DNSKEY returns the published keys of zone.
+func (s *Signer) DNSKEY(zone string, ttl uint32) []dns.RR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rrs []dns.RR
+
+	for _, key := range s.published {
+		rrs = append(rrs, zoneDNSKEY(key, zone, ttl))
+	}
+
+	return rrs
+}
+
+// DS returns the DS records of zone's key signing keys that should be in
+// the parent zone, including successors being rolled in.
+func (s *Signer) DS(zone string, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+
+	for _, ds := range s.ds(zone, ttl) {
+		rrs = append(rrs, ds)
+	}
+
+	return rrs
+}
+
+// CDS returns the DS records as CDS records, as described in RFC 7344, so
+// the parent can update its DS records.
+func (s *Signer) CDS(zone string, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+
+	for _, ds := range s.ds(zone, ttl) {
+		rrs = append(rrs, ds.ToCDS())
+	}
+
+	return rrs
+}
+
+// CDNSKEY returns the keys of the DS records as CDNSKEY records.
+func (s *Signer) CDNSKEY(zone string, ttl uint32) []dns.RR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rrs []dns.RR
+
+	for _, key := range s.submitted {
+		rrs = append(rrs, zoneDNSKEY(key, zone, ttl).ToCDNSKEY())
+	}
+
+	return rrs
+}
+
+func (s *Signer) ds(zone string, ttl uint32) []*dns.DS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dss []*dns.DS
+
+	for _, key := range s.submitted {
+		if ds := zoneDNSKEY(key, zone, ttl).ToDS(dns.SHA256); ds != nil {
+			dss = append(dss, ds)
+		}
+	}
+
+	return dss
+}
+
+// activeKeys returns the keys of a kind that sign records at now.
+func activeKeys(keys []*Key, now time.Time, ksk bool) []*Key {
+	var active []*Key
+
+	for _, key := range keys {
+		if key.IsKSK() == ksk && key.Active(now) {
+			active = append(active, key)
+		}
+	}
+
+	return active
+}
+
+// zoneDNSKEY returns the DNSKEY record of key with zone as owner.
+func zoneDNSKEY(key *Key, zone string, ttl uint32) *dns.DNSKEY {
+	dnskey := *key.DNSKEY
+	dnskey.Hdr.Name = zone
+	dnskey.Hdr.Ttl = ttl
+
+	return &dnskey
+}
+
+func keyTags(keys []*Key) string {
+	var tags []string
+
+	for _, key := range keys {
+		tags = append(tags, key.String())
+	}
+
+	sort.Strings(tags)
+	return strings.Join(tags, ", ")
+}
+
+func cacheKey(zone string, rrset []dns.RR) string {
+	values := make([]string, 0, len(rrset))
+
+	for _, rr := range rrset {
+		values = append(values, rr.String())
+	}
+
+	sort.Strings(values)
+	return zone + "\n" + strings.Join(values, "\n")
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	copies := make([]dns.RR, 0, len(rrs))
+
+	for _, rr := range rrs {
+		copies = append(copies, dns.Copy(rr))
+	}
+
+	return copies
+}
@@ -0,0 +1,131 @@
+package dnssec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestKeyReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	for _, algorithm := range []uint8{dns.ECDSAP256SHA256, dns.ED25519} {
+		key, err := GenerateKey("docker.", algorithm, true, now)
+		if err != nil {
+			t.Fatalf("could not generate key: %v", err)
+		}
+
+		key.Inactive = now.Add(time.Hour)
+
+		if err := key.Write(dir); err != nil {
+			t.Fatalf("could not write key: %v", err)
+		}
+
+		read, err := ReadKey(dir + "/" + key.FileName() + ".key")
+		if err != nil {
+			t.Fatalf("could not read key: %v", err)
+		}
+
+		if read.KeyTag() != key.KeyTag() || !read.IsKSK() || !read.Activate.Equal(now) || !read.Inactive.Equal(key.Inactive) || !read.Delete.IsZero() {
+			t.Errorf("unexpected key read: %+v", read)
+		}
+		if !read.Active(now) || read.Active(key.Inactive) || !read.Published(key.Inactive) {
+			t.Errorf("unexpected key timing: %+v", read)
+		}
+	}
+
+	if keys, err := ReadKeys(dir); err != nil || len(keys) != 2 {
+		t.Errorf("unexpected keys in dir: %v %v", keys, err)
+	}
+}
+
+func TestSignerSign(t *testing.T) {
+	s := NewSigner(t.TempDir(), "docker", dns.ECDSAP256SHA256, DenialBlackLies, time.Hour)
+
+	if err := s.Refresh(time.Now()); err != nil {
+		t.Fatalf("could not refresh keys: %v", err)
+	}
+
+	keys := s.DNSKEY("backend.docker.", 30)
+	if len(keys) != 2 || keys[0].Header().Name != "backend.docker." {
+		t.Fatalf("expected generated ksk and zsk: %v", keys)
+	}
+
+	if cds := s.CDS("backend.docker.", 30); len(cds) != 1 || cds[0].(*dns.CDS).KeyTag != s.ksks[0].KeyTag() {
+		t.Errorf("expected cds of the ksk: %v", cds)
+	}
+
+	rr, _ := dns.NewRR("web.backend.docker. 30 IN A 10.0.0.2")
+
+	sigs, err := s.Sign("backend.docker.", []dns.RR{rr})
+	if err != nil || len(sigs) != 1 {
+		t.Fatalf("could not sign: %v %v", sigs, err)
+	}
+
+	sig := sigs[0].(*dns.RRSIG)
+	if sig.KeyTag != s.zsks[0].KeyTag() || sig.SignerName != "backend.docker." {
+		t.Errorf("expected signature by the zsk: %v", sig)
+	}
+	if err := sig.Verify(zoneDNSKEY(s.zsks[0], "backend.docker.", 30), []dns.RR{rr}); err != nil {
+		t.Errorf("could not verify signature: %v", err)
+	}
+
+	if cached, _ := s.Sign("backend.docker.", []dns.RR{rr}); cached[0].(*dns.RRSIG).Inception != sig.Inception || cached[0] == sigs[0] {
+		t.Errorf("expected a copy of the cached signature")
+	}
+
+	if sigs, _ := s.Sign("backend.docker.", keys); len(sigs) != 1 || sigs[0].(*dns.RRSIG).KeyTag != s.ksks[0].KeyTag() {
+		t.Errorf("expected DNSKEY rrset signed by the ksk: %v", sigs)
+	}
+}
+
+func TestSignerRollover(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	s := NewSigner(dir, "docker.", dns.ED25519, DenialNSEC, time.Hour)
+	s.ZSKLifetime = 30 * 24 * time.Hour
+	s.RolloverDelay = 24 * time.Hour
+
+	if err := s.Refresh(now); err != nil {
+		t.Fatalf("could not refresh keys: %v", err)
+	}
+
+	zsk := s.zsks[0]
+
+	rollover := now.Add(s.ZSKLifetime - s.RolloverDelay)
+	if err := s.Refresh(rollover); err != nil {
+		t.Fatalf("could not refresh keys: %v", err)
+	}
+
+	if len(s.published) != 3 || len(s.zsks) != 1 || s.zsks[0].KeyTag() != zsk.KeyTag() {
+		t.Fatalf("expected successor to be published before use: %v %v", s.published, s.zsks)
+	}
+
+	if err := s.Refresh(now.Add(s.ZSKLifetime)); err != nil {
+		t.Fatalf("could not refresh keys: %v", err)
+	}
+
+	if len(s.zsks) != 1 || s.zsks[0].KeyTag() == zsk.KeyTag() || len(s.published) != 3 {
+		t.Errorf("expected successor to replace the zsk: %v %v", s.published, s.zsks)
+	}
+
+	if err := s.Refresh(now.Add(s.ZSKLifetime + s.RolloverDelay)); err != nil {
+		t.Fatalf("could not refresh keys: %v", err)
+	}
+
+	if len(s.published) != 2 {
+		t.Errorf("expected previous zsk to be removed: %v", s.published)
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	if algorithm, err := ParseAlgorithm("ED25519"); err != nil || algorithm != dns.ED25519 {
+		t.Errorf("unexpected algorithm: %d %v", algorithm, err)
+	}
+	if _, err := ParseAlgorithm("rsasha256"); err == nil {
+		t.Errorf("expected error for unsupported algorithm")
+	}
+}
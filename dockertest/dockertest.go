@@ -0,0 +1,204 @@
+// Package dockertest provides a fake docker api for tests.
+package dockertest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+// Client serves networks and containers from memory, implementing
+// state.DockerClient. Fields may be changed between calls with the
+// methods of the client.
+type Client struct {
+	// EventsFunc is called for each event subscription, which blocks
+	// until the context is done if nil.
+	EventsFunc func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+
+	mu          sync.Mutex
+	networks    []types.NetworkResource
+	containers  []types.ContainerJSON
+	inspectErrs map[string]error
+}
+
+// Network returns a network with the given subnets.
+func Network(id, name string, subnets ...string) types.NetworkResource {
+	nw := types.NetworkResource{ID: id, Name: name}
+
+	for _, subnet := range subnets {
+		nw.IPAM.Config = append(nw.IPAM.Config, network.IPAMConfig{Subnet: subnet})
+	}
+
+	return nw
+}
+
+// Container returns a running container with the given labels, which is
+// not connected to any network.
+func Container(id, name string, labels map[string]string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    id,
+			Name:  "/" + name,
+			State: &types.ContainerState{Status: "running", Running: true},
+		},
+		Config:          &container.Config{Hostname: id[:12], Labels: labels},
+		NetworkSettings: &types.NetworkSettings{Networks: make(map[string]*network.EndpointSettings)},
+	}
+}
+
+// Connect connects a container to a network with the given address.
+func Connect(containerJSON types.ContainerJSON, nw types.NetworkResource, ipv4, ipv6 string) {
+	containerJSON.NetworkSettings.Networks[nw.Name] = &network.EndpointSettings{
+		NetworkID:         nw.ID,
+		IPAddress:         ipv4,
+		GlobalIPv6Address: ipv6,
+	}
+}
+
+// AddNetwork adds or replaces a network.
+func (c *Client) AddNetwork(nw types.NetworkResource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.networks {
+		if c.networks[i].ID == nw.ID {
+			c.networks[i] = nw
+			return
+		}
+	}
+
+	c.networks = append(c.networks, nw)
+}
+
+// AddContainer adds or replaces a container.
+func (c *Client) AddContainer(container types.ContainerJSON) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.containers {
+		if c.containers[i].ID == container.ID {
+			c.containers[i] = container
+			return
+		}
+	}
+
+	c.containers = append(c.containers, container)
+}
+
+// RemoveContainer removes a container, which is then reported as not
+// found.
+func (c *Client) RemoveContainer(containerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.containers {
+		if c.containers[i].ID == containerID {
+			c.containers = append(c.containers[:i], c.containers[i+1:]...)
+			return
+		}
+	}
+}
+
+// FailInspect makes inspecting the container fail with err, or succeed
+// again if err is nil.
+func (c *Client) FailInspect(containerID string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inspectErrs == nil {
+		c.inspectErrs = make(map[string]error)
+	}
+
+	c.inspectErrs[containerID] = err
+}
+
+func (c *Client) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	if c.EventsFunc != nil {
+		return c.EventsFunc(ctx, options)
+	}
+
+	errs := make(chan error, 1)
+
+	go func() {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}()
+
+	return make(chan events.Message), errs
+}
+
+func (c *Client) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var containers []types.Container
+
+	for _, container := range c.containers {
+		state := "created"
+		if container.State != nil {
+			state = container.State.Status
+		}
+
+		if !options.All && state != "running" && state != "paused" {
+			continue
+		}
+
+		var labels map[string]string
+		if container.Config != nil {
+			labels = container.Config.Labels
+		}
+
+		containers = append(containers, types.Container{
+			ID:     container.ID,
+			Names:  []string{"/" + strings.TrimPrefix(container.Name, "/")},
+			Labels: labels,
+			State:  state,
+		})
+	}
+
+	return containers, nil
+}
+
+func (c *Client) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.inspectErrs[containerID]; err != nil {
+		return types.ContainerJSON{}, err
+	}
+
+	for _, container := range c.containers {
+		if container.ID == containerID {
+			return container, nil
+		}
+	}
+
+	return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+}
+
+func (c *Client) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]types.NetworkResource(nil), c.networks...), nil
+}
+
+func (c *Client) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, nw := range c.networks {
+		if nw.ID == networkID {
+			return nw, nil
+		}
+	}
+
+	return types.NetworkResource{}, errdefs.NotFound(fmt.Errorf("no such network: %s", networkID))
+}
@@ -0,0 +1,170 @@
+package hosts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/atomicfile"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+const (
+	BeginMarker = "# BEGIN docker-container-dns"
+	EndMarker   = "# END docker-container-dns"
+)
+
+// Writer renders the address records of the current snapshot into a
+// managed block of a hosts file. Lines outside the block are preserved, so
+// the block can live inside an existing '/etc/hosts'.
+//
+// Writes are rate limited to one per Interval, with notifications during
+// the interval coalesced into a single write of the latest snapshot.
+type Writer struct {
+	Path     string
+	Interval time.Duration
+
+	notify chan struct{}
+}
+
+func NewWriter(path string, interval time.Duration) *Writer {
+	return &Writer{
+		Path:     path,
+		Interval: interval,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Notify schedules a write of the current snapshot without blocking.
+func (w *Writer) Notify() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes the hosts file on each notification until ctx is done.
+func (w *Writer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := w.Write(state.Current()); err != nil {
+			log.Printf("hosts file %s: %v", w.Path, err)
+		}
+
+		select {
+		case <-time.After(w.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Write renders the snapshot into the hosts file, replacing it atomically
+// if the file does not already contain the managed block, so blocks that
+// were removed or edited are restored.
+func (w *Writer) Write(snapshot *state.Snapshot) error {
+	current, err := ioutil.ReadFile(w.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read hosts file: %v", err)
+	}
+
+	merged := Merge(current, Render(snapshot.Records(0)))
+	if err == nil && bytes.Equal(merged, current) {
+		return nil
+	}
+
+	if err := atomicfile.WriteFile(w.Path, merged, 0644); err != nil {
+		return err
+	}
+
+	log.Printf("hosts file %s updated", w.Path)
+	return nil
+}
+
+// Render returns the managed block for the A and AAAA records, with one
+// line per address listing its names in order.
+func Render(records []*state.Record) []byte {
+	var addresses []string
+	names := make(map[string][]string)
+
+	for _, record := range records {
+		var address string
+
+		switch rr := record.RR.(type) {
+		case *dns.A:
+			address = rr.A.String()
+		case *dns.AAAA:
+			address = rr.AAAA.String()
+		default:
+			continue
+		}
+
+		name := strings.TrimSuffix(record.RR.Header().Name, ".")
+
+		if _, exists := names[address]; !exists {
+			addresses = append(addresses, address)
+		}
+
+		if !contains(names[address], name) {
+			names[address] = append(names[address], name)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(BeginMarker + "\n")
+
+	for _, address := range addresses {
+		buf.WriteString(address + "\t" + strings.Join(names[address], " ") + "\n")
+	}
+
+	buf.WriteString(EndMarker + "\n")
+
+	return buf.Bytes()
+}
+
+// Merge replaces the managed block in current with block, appending it if
+// current has no block.
+func Merge(current, block []byte) []byte {
+	content := string(current)
+
+	if begin := strings.Index(content, BeginMarker+"\n"); begin != -1 {
+		// The end marker is only searched for after the begin marker, and
+		// may be the last line without a trailing newline.
+		after := begin + len(BeginMarker) + 1
+
+		if end := strings.Index(content[after:], EndMarker+"\n"); end != -1 {
+			return []byte(content[:begin] + string(block) + content[after+end+len(EndMarker)+1:])
+		}
+		if strings.HasSuffix(content[after-1:], "\n"+EndMarker) {
+			return []byte(content[:begin] + string(block))
+		}
+	}
+
+	if len(content) != 0 && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	return []byte(content + string(block))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
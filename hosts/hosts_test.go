@@ -0,0 +1,121 @@
+package hosts
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func testRecord(name string, address string) *state.Record {
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET}
+
+	if ip := net.ParseIP(address); ip.To4() != nil {
+		hdr.Rrtype = dns.TypeA
+		return &state.Record{RR: &dns.A{Hdr: hdr, A: ip}}
+	}
+
+	hdr.Rrtype = dns.TypeAAAA
+	return &state.Record{RR: &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(address)}}
+}
+
+func TestRender(t *testing.T) {
+	block := Render([]*state.Record{
+		testRecord("web.backend.docker.", "172.20.0.2"),
+		testRecord("web.backend.docker.", "fd00::2"),
+		testRecord("web.docker.", "172.20.0.2"),
+		testRecord("db.docker.", "172.20.0.3"),
+		{RR: &dns.PTR{Hdr: dns.RR_Header{Name: "2.0.20.172.in-addr.arpa.", Rrtype: dns.TypePTR}, Ptr: "web.docker."}},
+	})
+
+	expected := BeginMarker + "\n" +
+		"172.20.0.2\tweb.backend.docker web.docker\n" +
+		"fd00::2\tweb.backend.docker\n" +
+		"172.20.0.3\tdb.docker\n" +
+		EndMarker + "\n"
+
+	if string(block) != expected {
+		t.Errorf("unexpected block:\n%s", block)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	block := []byte(BeginMarker + "\n172.20.0.2\tweb.docker\n" + EndMarker + "\n")
+
+	for current, expected := range map[string]string{
+		"": string(block),
+		"127.0.0.1\tlocalhost": "127.0.0.1\tlocalhost\n" + string(block),
+		"127.0.0.1\tlocalhost\n" + BeginMarker + "\n172.20.0.9\told.docker\n" + EndMarker + "\n::1\tlocalhost\n": "127.0.0.1\tlocalhost\n" + string(block) + "::1\tlocalhost\n",
+		EndMarker + "\n127.0.0.1\tlocalhost\n" + BeginMarker + "\n172.20.0.9\told.docker\n" + EndMarker + "\n": EndMarker + "\n127.0.0.1\tlocalhost\n" + string(block),
+		"127.0.0.1\tlocalhost\n" + BeginMarker + "\n172.20.0.9\told.docker\n" + EndMarker:                             "127.0.0.1\tlocalhost\n" + string(block),
+	} {
+		if merged := string(Merge([]byte(current), block)); merged != expected {
+			t.Errorf("unexpected merge of %q: %q", current, merged)
+		}
+	}
+}
+
+func TestWriterWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1\tlocalhost\n"), 0640); err != nil {
+		t.Fatalf("could not write hosts file: %v", err)
+	}
+
+	w := NewWriter(path, 0)
+
+	if err := w.Write(state.Current()); err != nil {
+		t.Fatalf("could not write hosts file: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read hosts file: %v", err)
+	}
+	if expected := "127.0.0.1\tlocalhost\n" + BeginMarker + "\n" + EndMarker + "\n"; string(data) != expected {
+		t.Errorf("unexpected hosts file: %q", data)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("expected hosts file mode to be kept: %v %v", info.Mode(), err)
+	}
+
+	// Files already containing the block are not written again.
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatalf("could not set hosts file times: %v", err)
+	}
+	if err := w.Write(state.Current()); err != nil {
+		t.Fatalf("could not write hosts file: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("expected unchanged hosts file to not be written: %v %v", info.ModTime(), err)
+	}
+
+	// Blocks removed by hand are restored, even though the records did not
+	// change.
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1\tlocalhost\n"), 0640); err != nil {
+		t.Fatalf("could not write hosts file: %v", err)
+	}
+	if err := w.Write(state.Current()); err != nil {
+		t.Fatalf("could not write hosts file: %v", err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || !strings.Contains(string(data), BeginMarker+"\n") {
+		t.Errorf("expected removed block to be restored: %q %v", data, err)
+	}
+
+	if entries, _ := ioutil.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left: %v", entries)
+	}
+}
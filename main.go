@@ -2,68 +2,463 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/client"
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/admin"
+	"github.com/rakshasa/docker-container-dns/config"
+	"github.com/rakshasa/docker-container-dns/dnssec"
+	"github.com/rakshasa/docker-container-dns/hosts"
+	"github.com/rakshasa/docker-container-dns/server"
 	"github.com/rakshasa/docker-container-dns/state"
+	"github.com/rakshasa/docker-container-dns/tsig"
+	"github.com/rakshasa/docker-container-dns/update"
+	"github.com/rakshasa/docker-container-dns/zonefile"
 )
 
 const (
-	DockerVersion = "1.40"
+	resyncRetryDelay = 5 * time.Second
+
+	// maxEventBatch limits how many queued events are handled before a new
+	// state snapshot is published.
+	maxEventBatch = 100
 )
 
-func init() {
+// externalPolicyMissing is set while the split horizon external policy
+// names a network that does not exist, so the warning is logged once.
+var externalPolicyMissing bool
+
+func newForwarder(cfg *config.Config) (*server.Forwarder, error) {
+	if len(cfg.Upstream) == 0 && len(cfg.Forward) == 0 {
+		return nil, nil
+	}
+
+	upstreams, err := cfg.Upstreams()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*server.ForwardRule
+
+	for _, value := range cfg.Forward {
+		rule, err := server.ParseForwardRule(value)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return server.NewForwarder(upstreams, rules), nil
+}
+
+// checkNameserverGlue warns if exported zones contain their nameserver
+// without an address, which servers refuse to load.
+func checkNameserverGlue(cfg *config.Config) {
+	domain := dns.Fqdn(strings.ToLower(cfg.Domain))
+
+	nameserver := state.Nameserver
+	if len(nameserver) == 0 {
+		nameserver = "ns." + domain
+	}
+
+	if dns.IsSubDomain(domain, nameserver) && len(state.NameserverAddresses) == 0 {
+		log.Printf("warning: nameserver '%s' is within the exported zones without glue, set nameserver-address or a nameserver outside '%s'", nameserver, domain)
+	}
+}
+
+// exportZones writes the zones of the current snapshot to the zone
+// directory if set, otherwise to stdout.
+func exportZones(cfg *config.Config) error {
+	snapshot := state.Current()
+
+	if len(cfg.ZoneDir) != 0 {
+		return zonefile.NewExporter(cfg.ZoneDir, cfg.TTL, cfg.ZoneInterval).Export(snapshot)
+	}
+
+	for i, zone := range snapshot.AuthoritativeZones() {
+		if i != 0 {
+			fmt.Fprintln(os.Stdout)
+		}
+		if err := zonefile.Write(os.Stdout, snapshot, zone, cfg.TTL); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func main() {
+	name, args := os.Args[0], os.Args[1:]
+
+	// The 'export-zones' subcommand synchronizes once and exports the zones
+	// instead of starting the server.
+	export := len(args) != 0 && args[0] == "export-zones"
+	if export {
+		name, args = name+" export-zones", args[1:]
+	}
+
+	cfg, err := config.Load(name, args, os.Environ())
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("failed to print configuration: %v", err)
+		}
+		return
+	}
+
 	log.Printf("starting docker-container-dns")
 
-	cli, err := client.NewClientWithOpts(client.WithVersion(DockerVersion))
+	cli, err := client.NewClientWithOpts(client.WithVersion(cfg.DockerVersion))
 	if err != nil {
-		log.Fatalf("failed to initialize new docker client with version '%s': %v", err)
+		log.Fatalf("failed to initialize new docker client with version '%s': %v", cfg.DockerVersion, err)
 	}
 
 	cancelCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	state.Containers = state.NewContainerList(cancelCtx, cli)
-	state.Networks = state.NewNetworkList(cancelCtx, cli)
+	state.Containers = state.NewContainerList(cancelCtx, cli, cfg.ContainerEvents)
+	state.Networks = state.NewNetworkList(cancelCtx, cli, cfg.NetworkEvents)
 
 	ctx := context.WithValue(cancelCtx, "client", cli)
 
+	state.Domain = cfg.Domain
+	state.DefaultTTL = cfg.TTL
+	state.SearchZones = cfg.SearchZones()
+
+	if state.HealthPolicy, err = state.ParseHealthPolicy(cfg.HealthPolicy); err != nil {
+		log.Fatalf("invalid health policy: %v", err)
+	}
+	if state.SerialScheme, err = state.ParseSerialScheme(cfg.SerialScheme); err != nil {
+		log.Fatalf("invalid serial scheme: %v", err)
+	}
+	if len(cfg.Nameserver) != 0 {
+		state.Nameserver = dns.Fqdn(strings.ToLower(cfg.Nameserver))
+	}
+	if state.NameserverAddresses, err = cfg.NameserverAddresses(); err != nil {
+		log.Fatalf("invalid nameserver addresses: %v", err)
+	}
+	if export || len(cfg.ZoneDir) != 0 {
+		checkNameserverGlue(cfg)
+	}
+
+	if err := state.Sync(ctx); err != nil {
+		log.Fatalf("failed initial synchronization with docker: %v", err)
+	}
+
+	// Serials of exported zone files continue from the previous run, as the
+	// date-counter scheme would otherwise restart at 'YYYYMMDD00'.
+	if len(cfg.ZoneDir) != 0 {
+		serials, err := zonefile.ReadSerials(cfg.ZoneDir)
+		if err != nil {
+			log.Fatalf("failed to read zone serials from %s: %v", cfg.ZoneDir, err)
+		}
+
+		state.SeedSerials(serials)
+	}
+
+	state.Publish()
+
+	if export {
+		if err := exportZones(cfg); err != nil {
+			log.Fatalf("failed to export zones: %v", err)
+		}
+		return
+	}
+
+	forwarder, err := newForwarder(cfg)
+	if err != nil {
+		log.Fatalf("invalid forwarding configuration: %v", err)
+	}
+
+	tsigKeys, err := cfg.TSIGKeyMap()
+	if err != nil {
+		log.Fatalf("invalid tsig keys: %v", err)
+	}
+
+	transferRules, err := cfg.TransferRules()
+	if err != nil {
+		log.Fatalf("invalid transfer acl: %v", err)
+	}
+
+	accessRules, err := cfg.AccessRules()
+	if err != nil {
+		log.Fatalf("invalid query acl: %v", err)
+	}
+
+	trustedProxies, err := cfg.TrustedProxies()
+	if err != nil {
+		log.Fatalf("invalid dns-over-https trusted proxies: %v", err)
+	}
+
+	dnsServer := server.NewServer(cfg.Listen, cfg.Domain, cfg.TTL)
+	dnsServer.Forwarder = forwarder
+	dnsServer.SplitHorizon = server.SplitHorizon{Mode: cfg.SplitHorizon, ExternalPolicy: cfg.ExternalPolicy}
+	checkExternalPolicy(dnsServer.SplitHorizon, state.Current())
+	dnsServer.Ordering = server.Ordering{Mode: cfg.AnswerOrder, MaxAnswers: int(cfg.MaxAnswers)}
+	dnsServer.TransferRules = transferRules
+	dnsServer.AccessRules = accessRules
+	dnsServer.TSIGKeys = tsigKeys
+
+	var certReloader *server.CertReloader
+	var hup chan os.Signal
+
+	if len(cfg.TLSCert) != 0 {
+		if certReloader, err = server.NewCertReloader(cfg.TLSCert, cfg.TLSKey); err != nil {
+			log.Fatalf("invalid tls certificate: %v", err)
+		}
+
+		if dnsServer.TLSConfig, err = server.NewTLSConfig(certReloader, cfg.TLSClientCA); err != nil {
+			log.Fatalf("invalid tls configuration: %v", err)
+		}
+		if dnsServer.HTTPTLSConfig, err = server.NewTLSConfig(certReloader, cfg.DoHClientCA); err != nil {
+			log.Fatalf("invalid dns-over-https tls configuration: %v", err)
+		}
+
+		go certReloader.Watch(cancelCtx, cfg.TLSReload)
+
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+
+	if len(cfg.TLSListen) != 0 {
+		dnsServer.TLSAddr = cfg.TLSListen
+		dnsServer.TLSIdleTimeout = cfg.TLSIdleTimeout
+		dnsServer.TLSMaxQueries = int(cfg.TLSMaxQueries)
+	}
+
+	dnsServer.HTTPAddr = cfg.DoHListen
+	dnsServer.HTTPTrustedProxies = trustedProxies
+
+	if len(cfg.DNSSECDir) != 0 {
+		algorithm, err := dnssec.ParseAlgorithm(cfg.DNSSECAlgorithm)
+		if err != nil {
+			log.Fatalf("invalid dnssec algorithm: %v", err)
+		}
+
+		signer := dnssec.NewSigner(cfg.DNSSECDir, cfg.Domain, algorithm, cfg.DNSSECDenial, cfg.DNSSECValidity)
+		signer.KSKLifetime = cfg.KSKLifetime
+		signer.ZSKLifetime = cfg.ZSKLifetime
+		signer.RolloverDelay = cfg.RolloverDelay
+
+		if err := signer.Refresh(time.Now()); err != nil {
+			log.Fatalf("failed to load dnssec keys: %v", err)
+		}
+
+		go signer.Run(cancelCtx)
+
+		dnsServer.DNSSEC = signer
+	}
+
+	dnsServer.Start()
+	defer dnsServer.Shutdown()
+
+	var adminErrs <-chan error
+
+	if len(cfg.AdminListen) != 0 {
+		adminServer := admin.NewServer(cfg.AdminListen, cfg.TTL)
+		if err := adminServer.Start(); err != nil {
+			log.Fatalf("failed to start admin api: %v", err)
+		}
+		defer adminServer.Shutdown()
+
+		adminErrs = adminServer.Errs
+	}
+
+	var hostsWriter *hosts.Writer
+
+	if len(cfg.HostsFile) != 0 {
+		hostsWriter = hosts.NewWriter(cfg.HostsFile, cfg.HostsInterval)
+		hostsWriter.Notify()
+
+		go hostsWriter.Run(cancelCtx)
+	}
+
+	var zoneExporter *zonefile.Exporter
+
+	if len(cfg.ZoneDir) != 0 {
+		zoneExporter = zonefile.NewExporter(cfg.ZoneDir, cfg.TTL, cfg.ZoneInterval)
+		zoneExporter.Notify()
+
+		go zoneExporter.Run(cancelCtx)
+	}
+
+	var updater *update.Updater
+
+	if len(cfg.UpdateServer) != 0 {
+		var key *tsig.Key
+
+		if len(cfg.UpdateTSIGKey) != 0 {
+			if key, err = tsig.ParseKey(cfg.UpdateTSIGKey); err != nil {
+				log.Fatalf("invalid update tsig key: %v", err)
+			}
+		}
+
+		updater = update.NewUpdater(cfg.UpdateServer, cfg.UpdateZoneNames(), cfg.UpdateOwner, cfg.TTL, cfg.UpdateInterval, key)
+		updater.Notify()
+
+		go updater.Run(cancelCtx)
+	}
+
+	var notifier *server.Notifier
+
+	if len(cfg.Notify) != 0 {
+		targets, err := cfg.NotifyTargets()
+		if err != nil {
+			log.Fatalf("invalid notify targets: %v", err)
+		}
+
+		notifier = server.NewNotifier(targets, cfg.TTL, cfg.NotifyInterval)
+		notifier.Notify()
+
+		go notifier.Run(cancelCtx)
+	}
+
 	var timeout chan int
+	var resyncRetry <-chan time.Time
 
 	for {
 		var printStatus bool
+		var publish bool
+		var resync bool
 
 		select {
 		case err := <-state.Containers.Errs:
-			log.Fatalf("container error: %v", err)
+			log.Printf("container error: %v", err)
 		case err := <-state.Networks.Errs:
-			log.Fatalf("network error: %v", err)
-		// case msg := <-state.Containers.Msgs:
-		// 	state.Containers.HandleEvent(ctx, msg)
-		// 	printStatus = true
+			log.Printf("network error: %v", err)
+		case <-state.Containers.Resyncs:
+			resync = true
+		case <-state.Networks.Resyncs:
+			resync = true
+		case <-resyncRetry:
+			resyncRetry = nil
+			resync = true
+		case err := <-dnsServer.Errs:
+			log.Fatalf("dns server error: %v", err)
+		case err := <-adminErrs:
+			log.Fatalf("admin api error: %v", err)
+		case msg := <-state.Containers.Msgs:
+			handleContainerEvent(ctx, msg)
+			handlePendingEvents(ctx)
+
+			printStatus = true
+			publish = true
 		case msg := <-state.Networks.Msgs:
-			if err := state.Networks.HandleEvent(ctx, msg); err != nil {
-				log.Printf("unhandled network message error: %v", err)
-			}
+			handleNetworkEvent(ctx, msg)
+			handlePendingEvents(ctx)
 
 			printStatus = true
+			publish = true
+		case <-hup:
+			log.Printf("received SIGHUP, reloading tls certificate")
+
+			if err := certReloader.Reload(); err != nil {
+				log.Printf("tls certificate reload failed, keeping the previous certificate: %v", err)
+			}
 		case <-timeout:
 			state.Networks.PrintStatus()
-			// state.Containers.PrintStatus()
+			state.Containers.PrintStatus()
 			timeout = nil
 		}
 
-		if printStatus && timeout == nil {
+		if resync {
+			if err := state.Sync(ctx); err != nil {
+				log.Printf("failed to resynchronize with docker, retrying in %v: %v", resyncRetryDelay, err)
+				resyncRetry = time.After(resyncRetryDelay)
+			} else {
+				resyncRetry = nil
+			}
+
+			printStatus = true
+			publish = true
+		}
+
+		if publish {
+			checkExternalPolicy(dnsServer.SplitHorizon, state.Publish())
+
+			if hostsWriter != nil {
+				hostsWriter.Notify()
+			}
+			if zoneExporter != nil {
+				zoneExporter.Notify()
+			}
+			if updater != nil {
+				updater.Notify()
+			}
+			if notifier != nil {
+				notifier.Notify()
+			}
+			if dnsServer.DNSSEC != nil {
+				dnsServer.DNSSEC.Invalidate()
+			}
+		}
+
+		if printStatus && timeout == nil && cfg.StatusInterval != 0 {
 			timeout = make(chan int, 1)
 
 			go func() {
-				time.Sleep(30 * time.Second)
+				time.Sleep(cfg.StatusInterval)
 				timeout <- 0
 			}()
 		}
 	}
 }
+
+// checkExternalPolicy warns when the network named by the split horizon
+// external policy does not exist, and when it appears.
+func checkExternalPolicy(h server.SplitHorizon, snapshot *state.Snapshot) {
+	exists := h.ExternalNetworkExists(snapshot)
+
+	switch {
+	case !exists && !externalPolicyMissing:
+		log.Printf("warning: split horizon external policy network '%s' does not exist, clients not on a network are answered with no endpoints", h.ExternalPolicy)
+	case exists && externalPolicyMissing:
+		log.Printf("split horizon external policy network '%s' now exists", h.ExternalPolicy)
+	}
+
+	externalPolicyMissing = !exists
+}
+
+func handleContainerEvent(ctx context.Context, msg events.Message) {
+	if err := state.Containers.HandleEvent(ctx, msg); err != nil {
+		log.Printf("unhandled container message error: %v", err)
+	}
+}
+
+func handleNetworkEvent(ctx context.Context, msg events.Message) {
+	if err := state.Networks.HandleEvent(ctx, msg); err != nil {
+		log.Printf("unhandled network message error: %v", err)
+	}
+}
+
+// handlePendingEvents handles already queued container and network events
+// without blocking, so that a burst of events is published as a single
+// snapshot.
+func handlePendingEvents(ctx context.Context) {
+	for i := 0; i < maxEventBatch; i++ {
+		select {
+		case msg := <-state.Containers.Msgs:
+			handleContainerEvent(ctx, msg)
+		case msg := <-state.Networks.Msgs:
+			handleNetworkEvent(ctx, msg)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+const (
+	ListenerUDP   = "udp"
+	ListenerTCP   = "tcp"
+	ListenerTLS   = "tls"
+	ListenerHTTPS = "https"
+)
+
+// AccessRule controls what clients matching it may query. Clients,
+// Listeners and Networks match anything if empty, and Networks are the
+// names of the docker networks with a subnet containing the client.
+//
+// Zones are the zones that may be queried, including their subzones,
+// with nil allowing all zones. Recursion allows queries outside of the
+// zones to be forwarded, and Transfer allows zone transfers of the zones,
+// which must also be allowed by the transfer rules.
+type AccessRule struct {
+	Clients   []*net.IPNet
+	Listeners []string
+	Networks  []string
+
+	Zones     []string
+	Recursion bool
+	Transfer  bool
+}
+
+var (
+	// allowAll applies if there are no access rules.
+	allowAll = &AccessRule{Recursion: true, Transfer: true}
+
+	// denyAll applies to clients not matching any access rule.
+	denyAll = &AccessRule{Zones: []string{}}
+)
+
+// ParseAccessRule parses a rule of space separated fields, e.g.
+// 'client=10.0.0.0/8 listener=udp,tcp network=frontend zones=docker.
+// recursion'. The client, listener, network and zones fields take comma
+// separated values, and zones may be '*' for all zones or 'none'. The
+// 'recursion' and 'transfer' fields allow forwarding and zone transfers,
+// and 'deny' refuses all queries.
+func ParseAccessRule(value string) (*AccessRule, error) {
+	rule := &AccessRule{}
+
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty access rule")
+	}
+
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+
+		if len(parts) == 1 {
+			switch field {
+			case "recursion":
+				rule.Recursion = true
+			case "transfer":
+				rule.Transfer = true
+			case "deny":
+				rule.Zones = []string{}
+			default:
+				return nil, fmt.Errorf("invalid access rule field, must be client, listener, network, zones, recursion, transfer or deny: %s", field)
+			}
+			continue
+		}
+
+		values := strings.Split(parts[1], ",")
+
+		switch parts[0] {
+		case "client":
+			for _, v := range values {
+				network, err := parseNetwork(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid access rule client: %v", err)
+				}
+
+				rule.Clients = append(rule.Clients, network)
+			}
+
+		case "listener":
+			for _, v := range values {
+				switch v {
+				case ListenerUDP, ListenerTCP, ListenerTLS, ListenerHTTPS:
+					rule.Listeners = append(rule.Listeners, v)
+				default:
+					return nil, fmt.Errorf("invalid access rule listener, must be udp, tcp, tls or https: %s", v)
+				}
+			}
+
+		case "network":
+			for _, v := range values {
+				if len(v) == 0 {
+					return nil, fmt.Errorf("empty access rule network: %s", field)
+				}
+
+				rule.Networks = append(rule.Networks, v)
+			}
+
+		case "zones":
+			switch parts[1] {
+			case "*":
+				rule.Zones = nil
+				continue
+			case "none":
+				rule.Zones = []string{}
+				continue
+			}
+
+			for _, v := range values {
+				if _, ok := dns.IsDomainName(v); !ok || len(v) == 0 {
+					return nil, fmt.Errorf("invalid access rule zone: %s", v)
+				}
+
+				rule.Zones = append(rule.Zones, dns.Fqdn(strings.ToLower(v)))
+			}
+
+		default:
+			return nil, fmt.Errorf("invalid access rule field, must be client, listener, network, zones, recursion, transfer or deny: %s", parts[0])
+		}
+	}
+
+	return rule, nil
+}
+
+// Matches returns true if the rule applies to a client on a listener,
+// which is on the named networks.
+func (r *AccessRule) Matches(client net.IP, listener string, networks []string) bool {
+	if len(r.Clients) != 0 {
+		matched := false
+
+		for _, network := range r.Clients {
+			if client != nil && network.Contains(client) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Listeners) != 0 && !containsFold(r.Listeners, listener) {
+		return false
+	}
+
+	if len(r.Networks) != 0 {
+		matched := false
+
+		for _, name := range networks {
+			if containsFold(r.Networks, name) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AllowsZone returns true if the zone or one of its parents may be
+// queried.
+func (r *AccessRule) AllowsZone(zone string) bool {
+	if r.Zones == nil {
+		return true
+	}
+
+	for _, allowed := range r.Zones {
+		if dns.IsSubDomain(allowed, zone) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessRule returns the first access rule matching the client of a
+// request. All queries are allowed if there are no rules, and refused if
+// none match.
+func (s *Server) accessRule(w dns.ResponseWriter, snapshot *state.Snapshot) *AccessRule {
+	if len(s.AccessRules) == 0 {
+		return allowAll
+	}
+
+	client := clientIP(w.RemoteAddr())
+	listener := listenerName(w)
+
+	var networks []string
+
+	if client != nil {
+		for _, nw := range snapshot.ClientNetworks(client) {
+			networks = append(networks, nw.Name)
+		}
+	}
+
+	for _, rule := range s.AccessRules {
+		if rule.Matches(client, listener, networks) {
+			return rule
+		}
+	}
+
+	return denyAll
+}
+
+// listenerName returns the listener a request was received on.
+func listenerName(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohResponseWriter); ok {
+		return ListenerHTTPS
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return ListenerUDP
+	}
+	if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return ListenerTLS
+	}
+
+	return ListenerTCP
+}
+
+// refuse returns a REFUSED reply to a request denied by the access rules,
+// where reason is 'zone', 'recursion' or 'transfer'.
+func refuse(w dns.ResponseWriter, r *dns.Msg, reason string) *dns.Msg {
+	listener := listenerName(w)
+
+	log.Printf("query for %s %s from %v on %s refused by access rules: %s", r.Question[0].Name, queryType(r), w.RemoteAddr(), listener, reason)
+	observeDenial(listener, reason)
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+
+	return m
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseAccessRule(t *testing.T) {
+	rule, err := ParseAccessRule("client=10.0.0.0/8,fd00::1 listener=udp,tls network=frontend zones=Backend.docker recursion")
+	if err != nil {
+		t.Fatalf("could not parse rule: %v", err)
+	}
+
+	if len(rule.Clients) != 2 || len(rule.Listeners) != 2 || rule.Zones[0] != "backend.docker." || !rule.Recursion || rule.Transfer {
+		t.Errorf("unexpected rule: %+v", rule)
+	}
+
+	if !rule.Matches(net.ParseIP("10.0.0.2"), ListenerTLS, []string{"default", "Frontend"}) {
+		t.Errorf("expected rule to match")
+	}
+	if rule.Matches(net.ParseIP("10.0.0.2"), ListenerTCP, []string{"frontend"}) || rule.Matches(net.ParseIP("10.0.0.2"), ListenerUDP, nil) {
+		t.Errorf("expected listener and network to be matched")
+	}
+
+	if !rule.AllowsZone("web.backend.docker.") || rule.AllowsZone("docker.") {
+		t.Errorf("expected only subzones of backend.docker. to be allowed")
+	}
+
+	if rule, _ := ParseAccessRule("deny"); rule.AllowsZone("docker.") || !rule.Matches(nil, ListenerTCP, nil) {
+		t.Errorf("expected rule to deny any client: %+v", rule)
+	}
+
+	for _, value := range []string{"", "listener=quic", "client=10.0.0.0/33", "zones=a..b", "allow"} {
+		if _, err := ParseAccessRule(value); err == nil {
+			t.Errorf("expected error for rule '%s'", value)
+		}
+	}
+}
+
+func TestServerAccessRules(t *testing.T) {
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+	s.Forwarder = NewForwarder(nil, nil)
+	s.TransferRules = []*TransferRule{{}}
+
+	for _, value := range []string{"listener=udp recursion transfer", "client=127.0.0.0/8 zones=docker.", "deny"} {
+		rule, err := ParseAccessRule(value)
+		if err != nil {
+			t.Fatalf("could not parse rule: %v", err)
+		}
+
+		s.AccessRules = append(s.AccessRules, rule)
+	}
+
+	addr := startTCPServer(t, s)
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{"docker.", dns.TypeSOA, dns.RcodeSuccess},
+		{"example.com.", dns.TypeA, dns.RcodeRefused},
+		{"docker.", dns.TypeAXFR, dns.RcodeRefused},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+
+		r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("query for %s failed: %v", tc.name, err)
+		}
+
+		if r.Rcode != tc.rcode || r.RecursionAvailable {
+			t.Errorf("unexpected reply for %s %s: %v", tc.name, dns.TypeToString[tc.qtype], r)
+		}
+	}
+
+	s = NewServer("127.0.0.1:0", "docker.", 30)
+	s.AccessRules = []*AccessRule{{Zones: []string{"backend.docker."}}}
+
+	addr = startTCPServer(t, s)
+
+	m := new(dns.Msg)
+	m.SetQuestion("docker.", dns.TypeSOA)
+
+	if r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr); err != nil || r.Rcode != dns.RcodeRefused || len(r.Answer) != 0 {
+		t.Errorf("expected query of a zone not allowed to be refused: %v %v", r, err)
+	}
+
+	// Without a forwarder queries outside the zones are refused, whether
+	// or not there are access rules.
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(ioutil.Discard)
+
+	for _, addr := range []string{addr, startTCPServer(t, NewServer("127.0.0.1:0", "docker.", 30))} {
+		if r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr); err != nil || r.Rcode != dns.RcodeRefused || r.RecursionAvailable {
+			t.Errorf("expected query without a forwarder to be refused: %v %v", r, err)
+		}
+	}
+
+	if strings.Contains(buf.String(), "refused by access rules") {
+		t.Errorf("expected query without a forwarder to not be logged as an access denial:\n%s", buf.String())
+	}
+}
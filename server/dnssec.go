@@ -0,0 +1,316 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/dnssec"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+const (
+	// ednsUDPSize is the udp payload size advertised in replies.
+	ednsUDPSize = 1232
+
+	// typeNXNAME marks non-existent names in compact denial of existence,
+	// as described in RFC 9824.
+	typeNXNAME = 128
+
+	maxLabelLength = 63
+	maxNameLength  = 255
+)
+
+// setEdns adds an OPT record to replies of requests with one, setting the
+// DO bit if the reply is signed.
+func (s *Server) setEdns(m, r *dns.Msg) {
+	if opt := r.IsEdns0(); opt != nil && m.IsEdns0() == nil {
+		m.SetEdns0(ednsUDPSize, s.wantsDNSSEC(r))
+	}
+}
+
+// wantsDNSSEC returns true if signing is enabled and the request has the
+// DO bit set.
+func (s *Server) wantsDNSSEC(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return s.DNSSEC != nil && opt != nil && opt.Do()
+}
+
+// answerApexKeys answers DNSKEY, CDS and CDNSKEY questions for the apex of
+// a signed zone.
+func (s *Server) answerApexKeys(m *dns.Msg, q dns.Question, zone string) {
+	if s.DNSSEC == nil {
+		return
+	}
+
+	if q.Qtype == dns.TypeDNSKEY || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, s.DNSSEC.DNSKEY(zone, s.TTL)...)
+	}
+	if q.Qtype == dns.TypeCDS || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, s.DNSSEC.CDS(zone, s.TTL)...)
+	}
+	if q.Qtype == dns.TypeCDNSKEY || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, s.DNSSEC.CDNSKEY(zone, s.TTL)...)
+	}
+}
+
+// parentZone returns the authoritative zone a DS question for the apex of
+// a child zone is answered from, as DS records belong to the parent side
+// of a zone cut.
+func (s *Server) parentZone(q dns.Question, snapshot *state.Snapshot, zone string) (string, bool) {
+	if s.DNSSEC == nil || q.Qtype != dns.TypeDS || !strings.EqualFold(q.Name, zone) {
+		return "", false
+	}
+
+	idx, end := dns.NextLabel(zone, 0)
+	if end {
+		return "", false
+	}
+
+	return snapshot.Zone(zone[idx:])
+}
+
+// answerDS answers a DS question for the apex of a child zone from its
+// parent zone.
+func (s *Server) answerDS(m *dns.Msg, snapshot *state.Snapshot, parent, zone string) {
+	m.Authoritative = true
+	m.Answer = append(m.Answer, s.DNSSEC.DS(zone, s.TTL)...)
+
+	if len(m.Answer) == 0 {
+		s.noData(m, snapshot, parent)
+	}
+}
+
+// signReply adds the proof of non-existence to negative replies and signs
+// every rrset of an authoritative reply.
+func (s *Server) signReply(m *dns.Msg, q dns.Question, snapshot *state.Snapshot, zone string, client net.IP) {
+	if m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0) {
+		s.denyExistence(m, q, snapshot, zone, client)
+	}
+
+	m.Answer = s.signRecords(m.Answer, snapshot, zone, false)
+	m.Ns = s.signRecords(m.Ns, snapshot, zone, false)
+	m.Extra = s.signRecords(m.Extra, snapshot, zone, true)
+}
+
+// signRecords returns the records followed by the signatures of each
+// rrset. Additional records may be in other zones, so their signer is
+// the most specific zone of the owner name.
+func (s *Server) signRecords(rrs []dns.RR, snapshot *state.Snapshot, zone string, additional bool) []dns.RR {
+	var keys []string
+	rrsets := make(map[string][]dns.RR)
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+
+		key := strings.ToLower(rr.Header().Name) + "/" + strconv.Itoa(int(rr.Header().Rrtype))
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	for _, key := range keys {
+		rrset := rrsets[key]
+
+		signer := zone
+		if additional {
+			if z, ok := snapshot.Zone(rrset[0].Header().Name); ok {
+				signer = z
+			} else if z, ok := snapshot.ReverseZone(rrset[0].Header().Name); ok {
+				signer = z.Name
+			}
+		}
+
+		sigs, err := s.DNSSEC.Sign(signer, rrset)
+		if err != nil {
+			log.Printf("dnssec signing failed: %v", err)
+			continue
+		}
+
+		rrs = append(rrs, sigs...)
+	}
+
+	return rrs
+}
+
+// denyExistence adds NSEC records proving that the name or type does not
+// exist. Compact denial answers NXDOMAIN as NODATA with a single NSEC
+// record at the name, while NSEC denial uses minimally covering records
+// as described in RFC 4470.
+func (s *Server) denyExistence(m *dns.Msg, q dns.Question, snapshot *state.Snapshot, zone string, client net.IP) {
+	name := strings.ToLower(q.Name)
+
+	switch {
+	case m.Rcode == dns.RcodeSuccess:
+		types := append(s.nameTypes(snapshot, name, client), dns.TypeRRSIG, dns.TypeNSEC)
+		m.Ns = append(m.Ns, s.nsec(name, "\\000."+name, types))
+
+	case s.DNSSEC.Denial == dnssec.DenialBlackLies:
+		m.Rcode = dns.RcodeSuccess
+		m.Ns = append(m.Ns, s.nsec(name, "\\000."+name, []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}))
+
+	default:
+		encloser := s.closestEncloser(snapshot, zone, name)
+		wildcard := "*." + encloser
+
+		encloserTypes := append(s.nameTypes(snapshot, encloser, client), dns.TypeRRSIG, dns.TypeNSEC)
+
+		m.Ns = append(m.Ns, s.coveringNSEC(name, encloser, encloserTypes))
+		if wildcard != name {
+			m.Ns = append(m.Ns, s.coveringNSEC(wildcard, encloser, encloserTypes))
+		}
+	}
+}
+
+// nameTypes returns the types of the records at an existing name, as seen
+// by the client.
+func (s *Server) nameTypes(snapshot *state.Snapshot, name string, client net.IP) []uint16 {
+	probe := new(dns.Msg)
+	s.answer(probe, dns.Question{Name: name, Qtype: dns.TypeANY, Qclass: dns.ClassINET}, snapshot, client)
+
+	seen := make(map[uint16]bool)
+
+	var types []uint16
+
+	for _, rr := range probe.Answer {
+		if rrtype := rr.Header().Rrtype; strings.EqualFold(rr.Header().Name, name) && !seen[rrtype] {
+			seen[rrtype] = true
+			types = append(types, rrtype)
+		}
+	}
+
+	return types
+}
+
+// closestEncloser returns the closest existing ancestor of a name that
+// does not exist.
+func (s *Server) closestEncloser(snapshot *state.Snapshot, zone, name string) string {
+	for {
+		idx, end := dns.NextLabel(name, 0)
+		if end || len(name[idx:]) <= len(zone) {
+			return zone
+		}
+
+		if name = name[idx:]; s.nameExists(snapshot, name) {
+			return name
+		}
+	}
+}
+
+func (s *Server) nameExists(snapshot *state.Snapshot, name string) bool {
+	if _, ok := snapshot.Zone(name); ok {
+		_, exists := snapshot.LookupName(name)
+		return exists
+	}
+
+	_, exists := snapshot.LookupReverse(name)
+	return exists
+}
+
+// coveringNSEC returns an NSEC record covering only name and its
+// descendants, which is below encloser and does not exist. The record
+// has the types of the encloser if it is the owner.
+func (s *Server) coveringNSEC(name, encloser string, encloserTypes []uint16) *dns.NSEC {
+	owner, next := predecessor(name), successor(name)
+	if owner == encloser {
+		return s.nsec(owner, next, append([]uint16(nil), encloserTypes...))
+	}
+
+	return s.nsec(owner, next, []uint16{dns.TypeRRSIG, dns.TypeNSEC})
+}
+
+func (s *Server) nsec(name, next string, types []uint16) *dns.NSEC {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: s.TTL},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// predecessor returns a name sorting just before name in canonical order,
+// by decrementing the last octet of its first label and filling it with
+// the highest octet as described in RFC 4471. A label ending with a zero
+// octet has the label without it as predecessor, and a label of a single
+// zero octet the parent.
+func predecessor(name string) string {
+	label, parent, ok := splitFirstLabel(name)
+	if !ok {
+		return name
+	}
+
+	last := len(label) - 1
+
+	switch {
+	case label[last] == 0 && last == 0:
+		return parent
+	case label[last] == 0:
+		return escapeLabel(label[:last]) + "." + strings.TrimPrefix(parent, ".")
+	default:
+		label[last]--
+
+		// Upper case letters sort as lower case.
+		if label[last] >= 'A' && label[last] <= 'Z' {
+			label[last] = 'A' - 1
+		}
+	}
+
+	for len(label) < maxLabelLength && len(name)+len(label)*4 < maxNameLength {
+		label = append(label, 0xff)
+	}
+
+	return escapeLabel(label) + "." + strings.TrimPrefix(parent, ".")
+}
+
+// successor returns a name sorting after name and all its descendants,
+// by appending a zero octet to its first label.
+func successor(name string) string {
+	label, parent, ok := splitFirstLabel(name)
+	if !ok || len(label) >= maxLabelLength {
+		return "\\000." + name
+	}
+
+	return escapeLabel(append(label, 0)) + "." + strings.TrimPrefix(parent, ".")
+}
+
+// splitFirstLabel returns the octets of the first label of name and the
+// rest of the name.
+func splitFirstLabel(name string) ([]byte, string, bool) {
+	buf := make([]byte, maxNameLength+1)
+
+	n, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil || n < 2 || buf[0] == 0 {
+		return nil, "", false
+	}
+
+	idx, end := dns.NextLabel(name, 0)
+	if end {
+		return nil, "", false
+	}
+
+	return append([]byte(nil), buf[1:1+int(buf[0])]...), name[idx:], true
+}
+
+func escapeLabel(label []byte) string {
+	var b strings.Builder
+
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '*':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03d", c)
+		}
+	}
+
+	return b.String()
+}
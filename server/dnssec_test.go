@@ -0,0 +1,218 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/dnssec"
+)
+
+func newSignedServer(t *testing.T, denial string) (*Server, string) {
+	signer := dnssec.NewSigner(t.TempDir(), "docker.", dns.ECDSAP256SHA256, denial, time.Hour)
+	if err := signer.Refresh(time.Now()); err != nil {
+		t.Fatalf("could not load dnssec keys: %v", err)
+	}
+
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+	s.DNSSEC = signer
+
+	return s, startTCPServer(t, s)
+}
+
+func exchangeDO(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+
+	r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("query for %s failed: %v", name, err)
+	}
+
+	return r
+}
+
+// verifyRRsets verifies the signatures of every rrset in the records
+// with the keys of the zone.
+func verifyRRsets(t *testing.T, rrs []dns.RR, keys []dns.RR) {
+	rrsets := make(map[string][]dns.RR)
+	var sigs []*dns.RRSIG
+
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+
+		key := rr.Header().Name + dns.TypeToString[rr.Header().Rrtype]
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	for key, rrset := range rrsets {
+		verified := false
+
+		for _, sig := range sigs {
+			if sig.Header().Name+dns.TypeToString[sig.TypeCovered] != key {
+				continue
+			}
+
+			for _, k := range keys {
+				if dnskey := k.(*dns.DNSKEY); dnskey.KeyTag() == sig.KeyTag && sig.Verify(dnskey, rrset) == nil {
+					verified = true
+				}
+			}
+		}
+
+		if !verified {
+			t.Errorf("rrset %s has no valid signature", key)
+		}
+	}
+}
+
+func TestServerDNSSEC(t *testing.T) {
+	s, addr := newSignedServer(t, dnssec.DenialBlackLies)
+
+	keys := exchangeDO(t, addr, "docker.", dns.TypeDNSKEY)
+	if opt := keys.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("expected reply with the DO bit: %v", keys)
+	}
+
+	var dnskeys []dns.RR
+	for _, rr := range keys.Answer {
+		if rr.Header().Rrtype == dns.TypeDNSKEY {
+			dnskeys = append(dnskeys, rr)
+		}
+	}
+
+	if len(dnskeys) != 2 {
+		t.Fatalf("expected ksk and zsk: %v", keys)
+	}
+
+	verifyRRsets(t, keys.Answer, dnskeys)
+
+	soa := exchangeDO(t, addr, "docker.", dns.TypeSOA)
+	if len(soa.Answer) != 2 {
+		t.Errorf("expected signed soa: %v", soa)
+	}
+	verifyRRsets(t, soa.Answer, dnskeys)
+
+	missing := exchangeDO(t, addr, "missing.docker.", dns.TypeA)
+	if missing.Rcode != dns.RcodeSuccess || len(missing.Answer) != 0 || len(missing.Ns) != 4 {
+		t.Fatalf("expected compact denial of existence: %v", missing)
+	}
+	verifyRRsets(t, missing.Ns, dnskeys)
+
+	for _, rr := range missing.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok && (nsec.Hdr.Name != "missing.docker." || nsec.NextDomain != "\\000.missing.docker.") {
+			t.Errorf("unexpected black lie: %v", nsec)
+		}
+	}
+
+	cds := exchangeDO(t, addr, "docker.", dns.TypeCDS)
+	if len(cds.Answer) != 2 || cds.Answer[0].(*dns.CDS).DigestType != dns.SHA256 {
+		t.Errorf("expected signed cds: %v", cds)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("docker.", dns.TypeSOA)
+
+	if r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr); err != nil || len(r.Answer) != 1 || r.IsEdns0() != nil {
+		t.Errorf("expected unsigned reply without edns: %v %v", r, err)
+	}
+
+	if s.DNSSEC.Denial != dnssec.DenialBlackLies {
+		t.Errorf("unexpected denial: %s", s.DNSSEC.Denial)
+	}
+}
+
+func TestServerDNSSECNSEC(t *testing.T) {
+	_, addr := newSignedServer(t, dnssec.DenialNSEC)
+
+	missing := exchangeDO(t, addr, "missing.docker.", dns.TypeA)
+	if missing.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN: %v", missing)
+	}
+
+	var covered []string
+
+	for _, rr := range missing.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			covered = append(covered, nsec.Hdr.Name+" "+nsec.NextDomain)
+		}
+	}
+
+	if len(covered) != 2 {
+		t.Fatalf("expected nsec records covering the name and the wildcard: %v", missing)
+	}
+
+	for _, name := range []string{"missing.docker.", "*.docker."} {
+		found := false
+
+		for _, rr := range missing.Ns {
+			if nsec, ok := rr.(*dns.NSEC); ok && nsecCovers(nsec, name) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("no nsec record covers %s: %v", name, covered)
+		}
+	}
+
+	nodata := exchangeDO(t, addr, "docker.", dns.TypeA)
+	if nodata.Rcode != dns.RcodeSuccess || len(nodata.Ns) != 4 {
+		t.Fatalf("expected signed NODATA: %v", nodata)
+	}
+
+	for _, rr := range nodata.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok && len(nsec.TypeBitMap) != 7 {
+			t.Errorf("expected SOA NS RRSIG NSEC DNSKEY CDS CDNSKEY at the apex: %v", nsec)
+		}
+	}
+}
+
+// nsecCovers returns true if name is strictly between the owner and next
+// name of the record in canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	return canonicalLess(nsec.Hdr.Name, name) && canonicalLess(name, nsec.NextDomain)
+}
+
+func canonicalLess(a, b string) bool {
+	la, lb := wireLabels(a), wireLabels(b)
+
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+
+	return len(la) < len(lb)
+}
+
+func wireLabels(name string) []string {
+	buf := make([]byte, 256)
+	n, _ := dns.PackDomainName(name, buf, 0, nil, false)
+
+	var labels []string
+
+	for i := 0; i < n && buf[i] != 0; i += int(buf[i]) + 1 {
+		labels = append(labels, string(buf[i+1:i+1+int(buf[i])]))
+	}
+
+	return labels
+}
+
+func TestPredecessorSuccessor(t *testing.T) {
+	for _, name := range []string{"missing.docker.", "*.docker.", "a.docker.", "a\\000.docker.", "\\[.docker."} {
+		pred, succ := predecessor(name), successor(name)
+
+		if !canonicalLess(pred, name) || !canonicalLess(name, succ) || !canonicalLess("x."+name, succ) {
+			t.Errorf("unexpected neighbours of %s: %s %s", name, pred, succ)
+		}
+		if _, ok := dns.IsDomainName(pred); !ok {
+			t.Errorf("invalid predecessor of %s: %s", name, pred)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DoHPath is the path of the DNS-over-HTTPS endpoint.
+	DoHPath = "/dns-query"
+
+	dohMessageType = "application/dns-message"
+	dohJSONType    = "application/dns-json"
+)
+
+var errDoHTsig = fmt.Errorf("tsig is not supported over https")
+
+// newHTTPServer returns the http server of the DNS-over-HTTPS endpoint.
+func (s *Server) newHTTPServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DoHPath, s.serveDoH)
+
+	return &http.Server{
+		Addr:      s.HTTPAddr,
+		Handler:   mux,
+		TLSConfig: s.HTTPTLSConfig,
+	}
+}
+
+// serveDoH answers queries as described in RFC 8484, with the message
+// either base64url encoded in the 'dns' parameter of a GET or as the body
+// of a POST. GET requests with a 'name' parameter, or accepting
+// 'application/dns-json', are answered with json.
+func (s *Server) serveDoH(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && (len(r.URL.Query().Get("name")) != 0 || strings.Contains(r.Header.Get("Accept"), dohJSONType)) {
+		s.serveDoHJSON(w, r)
+		return
+	}
+
+	req, status, err := parseDoHRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	m := s.exchangeHTTP(r, req)
+
+	data, err := m.Pack()
+	if err != nil {
+		log.Printf("dns-over-https failed to pack reply to %s: %v", r.RemoteAddr, err)
+		http.Error(w, "could not pack reply", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMessageType)
+	setCacheControl(w, m)
+	w.Write(data)
+}
+
+// parseDoHRequest returns the message of a GET or POST request, or the
+// http status and error to reply with.
+func parseDoHRequest(r *http.Request) (*dns.Msg, int, error) {
+	var data []byte
+
+	switch r.Method {
+	case http.MethodGet:
+		value := r.URL.Query().Get("dns")
+		if len(value) == 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("missing 'dns' or 'name' parameter")
+		}
+
+		var err error
+		if data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "=")); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid 'dns' parameter: %v", err)
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMessageType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be '%s'", dohMessageType)
+		}
+
+		var err error
+		if data, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, dns.MaxMsgSize)); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("could not read request: %v", err)
+		}
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("method must be GET or POST")
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid dns message: %v", err)
+	}
+
+	return m, 0, nil
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// dohJSONReply follows the json format of the public DNS-over-HTTPS
+// resolvers.
+type dohJSONReply struct {
+	Status    int               `json:"Status"`
+	TC        bool              `json:"TC"`
+	RD        bool              `json:"RD"`
+	RA        bool              `json:"RA"`
+	AD        bool              `json:"AD"`
+	CD        bool              `json:"CD"`
+	Question  []dohJSONQuestion `json:"Question"`
+	Answer    []dohJSONRecord   `json:"Answer,omitempty"`
+	Authority []dohJSONRecord   `json:"Authority,omitempty"`
+}
+
+// serveDoHJSON answers a query for the 'name' and 'type' parameters, with
+// the type defaulting to A.
+func (s *Server) serveDoHJSON(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 {
+		http.Error(w, "missing or invalid 'name' parameter", http.StatusBadRequest)
+		return
+	}
+
+	qtype, err := parseQueryType(r.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+
+	m := s.exchangeHTTP(r, req)
+
+	reply := &dohJSONReply{
+		Status: m.Rcode,
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+
+	for _, q := range m.Question {
+		reply.Question = append(reply.Question, dohJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+
+	reply.Answer = jsonRecords(m.Answer)
+	reply.Authority = jsonRecords(m.Ns)
+
+	w.Header().Set("Content-Type", dohJSONType)
+	setCacheControl(w, m)
+
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Printf("dns-over-https failed to write reply to %s: %v", r.RemoteAddr, err)
+	}
+}
+
+// parseQueryType parses a type name or number, defaulting to A if empty.
+func parseQueryType(value string) (uint16, error) {
+	if len(value) == 0 {
+		return dns.TypeA, nil
+	}
+	if qtype, ok := dns.StringToType[strings.ToUpper(value)]; ok {
+		return qtype, nil
+	}
+	if qtype, err := strconv.ParseUint(value, 10, 16); err == nil {
+		return uint16(qtype), nil
+	}
+
+	return 0, fmt.Errorf("invalid 'type' parameter: %s", value)
+}
+
+func jsonRecords(rrs []dns.RR) []dohJSONRecord {
+	var records []dohJSONRecord
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+
+		records = append(records, dohJSONRecord{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+
+	return records
+}
+
+// exchangeHTTP answers a query the same way as over udp and tcp, with
+// the http client's address used for query acls, split horizon and
+// metrics. Zone transfers are refused, as the reply must be a single
+// message.
+func (s *Server) exchangeHTTP(r *http.Request, req *dns.Msg) *dns.Msg {
+	w := &dohResponseWriter{remote: s.httpRemoteAddr(r)}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = addr
+	}
+
+	if len(req.Question) == 1 && isTransfer(req.Question[0].Qtype) {
+		started := time.Now()
+
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+
+		observeQuery(req, m, ".", started)
+		return m
+	}
+
+	s.ServeDNS(w, req)
+
+	if w.msg == nil {
+		m := new(dns.Msg)
+		return m.SetRcode(req, dns.RcodeServerFailure)
+	}
+
+	return w.msg
+}
+
+// setCacheControl sets the freshness lifetime of the reply to its lowest
+// ttl, as recommended by RFC 8484.
+func setCacheControl(w http.ResponseWriter, m *dns.Msg) {
+	var ttl uint32
+
+	rrs := append(append([]dns.RR{}, m.Answer...), m.Ns...)
+
+	for i, rr := range rrs {
+		if t := rr.Header().Ttl; i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+
+	if len(rrs) != 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+}
+
+// ParseTrustedProxies parses the networks of trusted proxies, each a CIDR
+// or a single address.
+func ParseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+
+	for _, value := range values {
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", value)
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+// httpRemoteAddr returns the address of the http client. Requests from
+// trusted proxies use the forwarded addresses, skipping trusted proxies
+// from the nearest hop until the first untrusted address.
+func (s *Server) httpRemoteAddr(r *http.Request) net.Addr {
+	addr := parseHostPort(r.RemoteAddr)
+
+	if !s.trustedProxy(addr.IP) {
+		return addr
+	}
+
+	hops := forwardedFor(r.Header)
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHostPort(hops[i])
+		if hop.IP == nil {
+			break
+		}
+
+		addr = hop
+
+		if !s.trustedProxy(hop.IP) {
+			break
+		}
+	}
+
+	return addr
+}
+
+func (s *Server) trustedProxy(ip net.IP) bool {
+	for _, network := range s.HTTPTrustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedFor returns the client addresses of the 'Forwarded' header as
+// described in RFC 7239, or of 'X-Forwarded-For' if not set, with the
+// original client first.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+
+	if values := header.Values("Forwarded"); len(values) != 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				var hop string
+
+				for _, pair := range strings.Split(element, ";") {
+					if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						hop = strings.Trim(kv[1], `"`)
+					}
+				}
+
+				hops = append(hops, hop)
+			}
+		}
+
+		return hops
+	}
+
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	return hops
+}
+
+// parseHostPort parses an address with an optional port, and ipv6
+// addresses optionally in brackets. The IP is nil if invalid.
+func parseHostPort(value string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"), ""
+	}
+
+	p, _ := strconv.Atoi(port)
+
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// dohResponseWriter captures the reply of ServeDNS for an http request.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(data []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return 0, err
+	}
+
+	w.msg = m
+	return len(data), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return errDoHTsig
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
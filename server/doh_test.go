@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServerDoH(t *testing.T) {
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+
+	ts := httptest.NewServer(s.newHTTPServer().Handler)
+	defer ts.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("docker.", dns.TypeSOA)
+
+	data, err := query.Pack()
+	if err != nil {
+		t.Fatalf("could not pack query: %v", err)
+	}
+
+	get, _ := http.NewRequest(http.MethodGet, ts.URL+DoHPath+"?dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+	post, _ := http.NewRequest(http.MethodPost, ts.URL+DoHPath, bytes.NewReader(data))
+	post.Header.Set("Content-Type", dohMessageType)
+
+	for _, req := range []*http.Request{get, post} {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %v", req.Method, err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != dohMessageType || resp.Header.Get("Cache-Control") != "max-age=30" {
+			t.Errorf("unexpected %s response: %d %v", req.Method, resp.StatusCode, resp.Header)
+			continue
+		}
+
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("unexpected %s reply: %v %v", req.Method, m, err)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + DoHPath + "?name=docker&type=ns")
+	if err != nil {
+		t.Fatalf("json request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var reply dohJSONReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("could not decode json reply: %v", err)
+	}
+
+	if resp.Header.Get("Content-Type") != dohJSONType || reply.Status != dns.RcodeSuccess || len(reply.Answer) != 1 || reply.Answer[0].Type != dns.TypeNS {
+		t.Errorf("unexpected json reply: %+v", reply)
+	}
+
+	for _, tc := range []struct {
+		method      string
+		query       string
+		contentType string
+		status      int
+	}{
+		{http.MethodGet, "", "", http.StatusBadRequest},
+		{http.MethodGet, "?dns=invalid", "", http.StatusBadRequest},
+		{http.MethodGet, "?name=docker&type=invalid", "", http.StatusBadRequest},
+		{http.MethodPost, "", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPut, "", dohMessageType, http.StatusMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(tc.method, ts.URL+DoHPath+tc.query, bytes.NewReader(data))
+		req.Header.Set("Content-Type", tc.contentType)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("unexpected status for %s '%s': %d", tc.method, tc.query, resp.StatusCode)
+		}
+	}
+}
+
+func TestServerDoHTransfer(t *testing.T) {
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+	s.TransferRules = []*TransferRule{{}}
+
+	req := new(dns.Msg)
+	req.SetAxfr("docker.")
+
+	if m := s.exchangeHTTP(httptest.NewRequest(http.MethodPost, DoHPath, nil), req); m.Rcode != dns.RcodeRefused {
+		t.Errorf("expected transfer over https to be refused: %v", m)
+	}
+}
+
+func TestServerDoHRemoteAddr(t *testing.T) {
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+
+	for _, tc := range []struct {
+		remote    string
+		header    string
+		value     string
+		expected  string
+		untrusted string
+	}{
+		{"192.0.2.10:4000", "X-Forwarded-For", "198.51.100.1", "198.51.100.1", "192.0.2.10"},
+		{"192.0.2.10:4000", "X-Forwarded-For", "198.51.100.1, 203.0.113.5, 192.0.2.11", "203.0.113.5", "192.0.2.10"},
+		{"192.0.2.10:4000", "X-Forwarded-For", "garbage", "192.0.2.10", "192.0.2.10"},
+		{"192.0.2.10:4000", "Forwarded", `for="[2001:db8::1]:4711";proto=https, for=192.0.2.11`, "2001:db8::1", "192.0.2.10"},
+		{"192.0.2.10:4000", "Forwarded", "for=unknown", "192.0.2.10", "192.0.2.10"},
+		{"198.51.100.9:4000", "X-Forwarded-For", "203.0.113.5", "198.51.100.9", "198.51.100.9"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, DoHPath, nil)
+		r.RemoteAddr = tc.remote
+		r.Header.Set(tc.header, tc.value)
+
+		s.HTTPTrustedProxies = nil
+
+		if addr := s.httpRemoteAddr(r).(*net.TCPAddr); addr.IP.String() != tc.untrusted {
+			t.Errorf("expected %s header to be ignored without trusted proxies: %v", tc.header, addr)
+		}
+
+		s.HTTPTrustedProxies, _ = ParseTrustedProxies([]string{"192.0.2.0/24"})
+
+		if addr := s.httpRemoteAddr(r).(*net.TCPAddr); addr.IP.String() != tc.expected {
+			t.Errorf("unexpected client address from %s '%s' via %s: %v", tc.header, tc.value, tc.remote, addr)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultForwardTimeout = 2 * time.Second
+
+	// An upstream is marked as down after upstreamMaxFailures consecutive
+	// failures, and is not used again until the backoff has passed unless
+	// all upstreams are down.
+	upstreamMaxFailures = 3
+	upstreamMinBackoff  = 5 * time.Second
+	upstreamMaxBackoff  = 5 * time.Minute
+)
+
+// Upstream is a resolver that queries outside of the authoritative zones
+// are forwarded to.
+type Upstream struct {
+	Addr string
+	Net  string
+
+	mutex     sync.Mutex
+	failures  int
+	backoff   time.Duration
+	downUntil time.Time
+}
+
+// ParseUpstream parses an upstream address in the '[udp://|tcp://]host[:port]'
+// format, defaulting to udp on port 53.
+func ParseUpstream(value string) (*Upstream, error) {
+	upstream := &Upstream{Net: "udp"}
+
+	if idx := strings.Index(value, "://"); idx != -1 {
+		upstream.Net, value = value[:idx], value[idx+3:]
+
+		if upstream.Net != "udp" && upstream.Net != "tcp" {
+			return nil, fmt.Errorf("invalid upstream protocol, must be udp or tcp: %s", upstream.Net)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		value = net.JoinHostPort(strings.Trim(value, "[]"), "53")
+	}
+
+	host, port, err := net.SplitHostPort(value)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid upstream address, must be an ip address: %s", value)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid upstream port: %s", value)
+	}
+
+	upstream.Addr = value
+	return upstream, nil
+}
+
+func (u *Upstream) String() string {
+	return u.Net + "://" + u.Addr
+}
+
+// Healthy returns false if the upstream has been marked as down.
+func (u *Upstream) Healthy() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return time.Now().After(u.downUntil)
+}
+
+func (u *Upstream) markSuccess() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.failures >= upstreamMaxFailures {
+		log.Printf("upstream %v is up", u)
+	}
+
+	u.failures = 0
+	u.backoff = 0
+	u.downUntil = time.Time{}
+}
+
+func (u *Upstream) markFailure(err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.failures++; u.failures < upstreamMaxFailures {
+		return
+	}
+
+	if u.backoff *= 2; u.backoff < upstreamMinBackoff {
+		u.backoff = upstreamMinBackoff
+	} else if u.backoff > upstreamMaxBackoff {
+		u.backoff = upstreamMaxBackoff
+	}
+
+	u.downUntil = time.Now().Add(u.backoff)
+
+	log.Printf("upstream %v is down for %v after %d failures: %v", u, u.backoff, u.failures, err)
+}
+
+// ForwardRule forwards queries within Zone to its own upstreams.
+type ForwardRule struct {
+	Zone      string
+	Upstreams []*Upstream
+}
+
+// ParseForwardRule parses a conditional forwarding rule in the
+// 'zone=upstream[,upstream...]' format.
+func ParseForwardRule(value string) (*ForwardRule, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid forward rule, must be 'zone=upstream[,upstream...]': %s", value)
+	}
+
+	zone := strings.TrimSpace(parts[0])
+	if _, ok := dns.IsDomainName(zone); !ok || len(zone) == 0 {
+		return nil, fmt.Errorf("invalid forward rule zone: %s", zone)
+	}
+
+	rule := &ForwardRule{
+		Zone: dns.Fqdn(strings.ToLower(zone)),
+	}
+
+	for _, addr := range strings.Split(parts[1], ",") {
+		upstream, err := ParseUpstream(strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward rule for zone '%s': %v", zone, err)
+		}
+
+		rule.Upstreams = append(rule.Upstreams, upstream)
+	}
+
+	return rule, nil
+}
+
+// Forwarder forwards queries to the upstreams of the most specific
+// matching rule, or the default upstreams. Upstreams are tried in order,
+// skipping those that are down.
+type Forwarder struct {
+	Upstreams []*Upstream
+	Rules     []*ForwardRule
+	Timeout   time.Duration
+}
+
+func NewForwarder(upstreams []*Upstream, rules []*ForwardRule) *Forwarder {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return dns.CountLabel(rules[i].Zone) > dns.CountLabel(rules[j].Zone)
+	})
+
+	return &Forwarder{
+		Upstreams: upstreams,
+		Rules:     rules,
+		Timeout:   defaultForwardTimeout,
+	}
+}
+
+// UpstreamsFor returns the upstreams used for queries of name.
+func (f *Forwarder) UpstreamsFor(name string) []*Upstream {
+	name = strings.ToLower(name)
+
+	for _, rule := range f.Rules {
+		if dns.IsSubDomain(rule.Zone, name) {
+			return rule.Upstreams
+		}
+	}
+
+	return f.Upstreams
+}
+
+// Forward sends the query to the upstreams, returning the first reply.
+func (f *Forwarder) Forward(r *dns.Msg) (*dns.Msg, error) {
+	if len(r.Question) == 0 {
+		return nil, fmt.Errorf("no question to forward")
+	}
+
+	upstreams := f.UpstreamsFor(r.Question[0].Name)
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams for: %s", r.Question[0].Name)
+	}
+
+	var healthy []*Upstream
+
+	for _, upstream := range upstreams {
+		if upstream.Healthy() {
+			healthy = append(healthy, upstream)
+		}
+	}
+
+	if len(healthy) == 0 {
+		healthy = upstreams
+	}
+
+	var err error
+
+	for _, upstream := range healthy {
+		var reply *dns.Msg
+
+		if reply, err = f.exchange(upstream, r); err == nil {
+			upstream.markSuccess()
+			return reply, nil
+		}
+
+		upstream.markFailure(err)
+	}
+
+	return nil, fmt.Errorf("all upstreams failed, last error: %v", err)
+}
+
+// exchange sends the query to a single upstream, retrying over tcp if a
+// udp reply is truncated.
+func (f *Forwarder) exchange(upstream *Upstream, r *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{
+		Net:     upstream.Net,
+		Timeout: f.Timeout,
+	}
+
+	reply, _, err := client.Exchange(r, upstream.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %v: %v", upstream, err)
+	}
+
+	if reply.Truncated && upstream.Net == "udp" {
+		client.Net = "tcp"
+
+		if reply, _, err = client.Exchange(r, upstream.Addr); err != nil {
+			return nil, fmt.Errorf("upstream %v: %v", upstream, err)
+		}
+	}
+
+	return reply, nil
+}
+
+// forward returns the upstream reply to a query outside the authoritative
+// zones. Queries are refused if there is no forwarder or recursion was not
+// desired.
+func (s *Server) forward(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+
+	if s.Forwarder == nil || !r.RecursionDesired {
+		return m.SetRcode(r, dns.RcodeRefused)
+	}
+
+	reply, err := s.Forwarder.Forward(r)
+	if err != nil {
+		log.Printf("dns server failed to forward query for %s: %v", r.Question[0].Name, err)
+
+		m.SetRcode(r, dns.RcodeServerFailure)
+		m.RecursionAvailable = true
+		return m
+	}
+
+	reply.Id = r.Id
+	return reply
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// startStubUpstream starts a udp dns server answering all A queries with
+// address, returning the address it listens on.
+func startStubUpstream(t *testing.T, address string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen for stub upstream: %v", err)
+	}
+
+	started := make(chan struct{})
+
+	srv := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.RecursionAvailable = true
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(address),
+			})
+
+			w.WriteMsg(m)
+		}),
+	}
+
+	go srv.ActivateAndServe()
+	<-started
+
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+// closedUpstream returns the address of a udp port nothing listens on.
+func closedUpstream(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen for closed upstream: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
+
+func mustParseUpstream(t *testing.T, value string) *Upstream {
+	upstream, err := ParseUpstream(value)
+	if err != nil {
+		t.Fatalf("could not parse upstream '%s': %v", value, err)
+	}
+
+	return upstream
+}
+
+func testQuery(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+
+	return m
+}
+
+func TestParseUpstream(t *testing.T) {
+	for value, expected := range map[string]string{
+		"10.0.0.53":            "udp://10.0.0.53:53",
+		"10.0.0.53:5353":       "udp://10.0.0.53:5353",
+		"tcp://10.0.0.53":      "tcp://10.0.0.53:53",
+		"udp://[fd00::53]:553": "udp://[fd00::53]:553",
+		"fd00::53":             "udp://[fd00::53]:53",
+	} {
+		if upstream := mustParseUpstream(t, value); upstream.String() != expected {
+			t.Errorf("unexpected upstream for '%s': %v", value, upstream)
+		}
+	}
+
+	for _, value := range []string{"dns.example.com", "tls://10.0.0.53", "10.0.0.53:abc"} {
+		if _, err := ParseUpstream(value); err == nil {
+			t.Errorf("expected error for upstream '%s'", value)
+		}
+	}
+}
+
+func TestForwarderFailover(t *testing.T) {
+	dead := mustParseUpstream(t, closedUpstream(t))
+	alive := mustParseUpstream(t, startStubUpstream(t, "192.0.2.1"))
+
+	forwarder := NewForwarder([]*Upstream{dead, alive}, nil)
+
+	for i := 0; i < upstreamMaxFailures; i++ {
+		reply, err := forwarder.Forward(testQuery("example.com."))
+		if err != nil {
+			t.Fatalf("forward failed: %v", err)
+		}
+		if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Fatalf("unexpected reply: %v", reply)
+		}
+	}
+
+	if dead.Healthy() {
+		t.Errorf("expected failing upstream to be marked as down")
+	}
+	if !alive.Healthy() {
+		t.Errorf("expected answering upstream to be healthy")
+	}
+}
+
+func TestForwarderRules(t *testing.T) {
+	rule, err := ParseForwardRule("corp.example=" + startStubUpstream(t, "192.0.2.2"))
+	if err != nil {
+		t.Fatalf("could not parse forward rule: %v", err)
+	}
+
+	forwarder := NewForwarder([]*Upstream{mustParseUpstream(t, startStubUpstream(t, "192.0.2.1"))}, []*ForwardRule{rule})
+
+	for name, expected := range map[string]string{
+		"host.corp.example.": "192.0.2.2",
+		"corp.example.":      "192.0.2.2",
+		"example.com.":       "192.0.2.1",
+	} {
+		reply, err := forwarder.Forward(testQuery(name))
+		if err != nil {
+			t.Fatalf("forward of %s failed: %v", name, err)
+		}
+		if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != expected {
+			t.Errorf("unexpected reply for %s: %v", name, reply.Answer)
+		}
+	}
+}
+
+func TestServerForward(t *testing.T) {
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+
+	if reply := s.forward(testQuery("example.com.")); reply.Rcode != dns.RcodeRefused {
+		t.Errorf("expected query to be refused without a forwarder: %v", reply)
+	}
+
+	s.Forwarder = NewForwarder([]*Upstream{mustParseUpstream(t, startStubUpstream(t, "192.0.2.1"))}, nil)
+
+	query := testQuery("example.com.")
+	query.RecursionDesired = false
+
+	if reply := s.forward(query); reply.Rcode != dns.RcodeRefused {
+		t.Errorf("expected query without recursion desired to be refused: %v", reply)
+	}
+
+	query.RecursionDesired = true
+
+	if reply := s.forward(query); reply.Rcode != dns.RcodeSuccess || reply.Id != query.Id || len(reply.Answer) != 1 {
+		t.Errorf("unexpected forwarded reply: %v", reply)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+const (
+	SplitHorizonOff      = "off"
+	SplitHorizonPrefer   = "prefer"
+	SplitHorizonRestrict = "restrict"
+
+	ExternalPolicyAll  = "all"
+	ExternalPolicyNone = "none"
+)
+
+// SplitHorizon decides which endpoints are answered for names that are
+// not scoped to a network, based on the networks of the client.
+//
+// With the prefer mode only endpoints on the client's networks are
+// answered if there are any, otherwise all endpoints. The restrict mode
+// never answers endpoints on other networks.
+//
+// Clients not on any tracked network, such as the host, are answered
+// according to ExternalPolicy; all endpoints, none, or as if the client
+// was on the network with that name.
+type SplitHorizon struct {
+	Mode           string
+	ExternalPolicy string
+}
+
+func (h SplitHorizon) Validate() error {
+	switch h.Mode {
+	case SplitHorizonOff, SplitHorizonPrefer, SplitHorizonRestrict:
+	default:
+		return fmt.Errorf("invalid split horizon mode, must be off, prefer or restrict: %s", h.Mode)
+	}
+
+	if len(h.ExternalPolicy) == 0 {
+		return fmt.Errorf("empty split horizon external policy, must be all, none or a network name")
+	}
+
+	return nil
+}
+
+// ExternalNetworkExists returns false if the external policy names a
+// network that does not exist, in which case clients not on any network
+// are answered as with 'none'.
+func (h SplitHorizon) ExternalNetworkExists(snapshot *state.Snapshot) bool {
+	if h.Mode == SplitHorizonOff || len(h.Mode) == 0 {
+		return true
+	}
+
+	switch h.ExternalPolicy {
+	case ExternalPolicyAll, ExternalPolicyNone, "":
+		return true
+	}
+
+	_, exists := snapshot.NetworkByName(h.ExternalPolicy)
+	return exists
+}
+
+// filterEndpoints returns the endpoints the client should be answered
+// with for a name not scoped to a network.
+func (h SplitHorizon) filterEndpoints(snapshot *state.Snapshot, client net.IP, endpoints []*state.ContainerEndpoint) []*state.ContainerEndpoint {
+	if h.Mode == SplitHorizonOff || len(h.Mode) == 0 || len(endpoints) == 0 {
+		return endpoints
+	}
+
+	var networks []*state.Network
+
+	if client != nil {
+		networks = snapshot.ClientNetworks(client)
+	}
+
+	if len(networks) == 0 {
+		switch h.ExternalPolicy {
+		case ExternalPolicyAll, "":
+			return endpoints
+		case ExternalPolicyNone:
+			return nil
+		}
+
+		nw, exists := snapshot.NetworkByName(h.ExternalPolicy)
+		if !exists {
+			return nil
+		}
+
+		networks = []*state.Network{nw}
+	}
+
+	var filtered []*state.ContainerEndpoint
+
+	for _, endpoint := range endpoints {
+		for _, nw := range networks {
+			if endpoint.NetworkID == nw.ID {
+				filtered = append(filtered, endpoint)
+				break
+			}
+		}
+	}
+
+	if len(filtered) == 0 && h.Mode == SplitHorizonPrefer {
+		return endpoints
+	}
+
+	return filtered
+}
+
+// filterServices returns the service records the client should be answered
+// with, based on the networks of their endpoints.
+func (h SplitHorizon) filterServices(snapshot *state.Snapshot, client net.IP, services []*state.ServiceRecord) []*state.ServiceRecord {
+	if h.Mode == SplitHorizonOff || len(h.Mode) == 0 || len(services) == 0 {
+		return services
+	}
+
+	var endpoints []*state.ContainerEndpoint
+
+	for _, service := range services {
+		endpoints = append(endpoints, service.Endpoint)
+	}
+
+	allowed := make(map[*state.ContainerEndpoint]bool)
+
+	for _, endpoint := range h.filterEndpoints(snapshot, client, endpoints) {
+		allowed[endpoint] = true
+	}
+
+	var filtered []*state.ServiceRecord
+
+	for _, service := range services {
+		if allowed[service.Endpoint] {
+			filtered = append(filtered, service)
+		}
+	}
+
+	return filtered
+}
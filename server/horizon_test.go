@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rakshasa/docker-container-dns/dockertest"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+func endpointNetworks(snapshot *state.Snapshot, endpoints []*state.ContainerEndpoint) string {
+	var names []string
+
+	for _, endpoint := range endpoints {
+		names = append(names, snapshot.Networks[endpoint.NetworkID].Name)
+	}
+
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestSplitHorizon(t *testing.T) {
+	cli := &dockertest.Client{}
+
+	backend := dockertest.Network("a000000000000000000000000000000000000000000000000000000000000001", "backend", "172.20.0.0/16")
+	frontend := dockertest.Network("a000000000000000000000000000000000000000000000000000000000000002", "frontend", "172.21.0.0/16")
+	empty := dockertest.Network("a000000000000000000000000000000000000000000000000000000000000003", "empty", "172.22.0.0/16")
+
+	cli.AddNetwork(backend)
+	cli.AddNetwork(frontend)
+	cli.AddNetwork(empty)
+
+	web := dockertest.Container("c000000000000000000000000000000000000000000000000000000000000001", "web", nil)
+	dockertest.Connect(web, backend, "172.20.0.2", "")
+	dockertest.Connect(web, frontend, "172.21.0.2", "")
+	cli.AddContainer(web)
+
+	snapshot := publishTestState(t, cli)
+
+	endpoints, _ := snapshot.LookupName("web.docker.")
+	if len(endpoints) != 2 {
+		t.Fatalf("expected endpoints on both networks: %v", endpoints)
+	}
+
+	var services []*state.ServiceRecord
+	for _, endpoint := range endpoints {
+		services = append(services, &state.ServiceRecord{Endpoint: endpoint})
+	}
+
+	const (
+		onBackend = "172.20.0.100"
+		onEmpty   = "172.22.0.100"
+		external  = "192.0.2.1"
+	)
+
+	for _, tc := range []struct {
+		mode     string
+		policy   string
+		client   string
+		networks string
+	}{
+		{SplitHorizonOff, ExternalPolicyNone, onBackend, "backend,frontend"},
+		{SplitHorizonOff, ExternalPolicyNone, external, "backend,frontend"},
+		{SplitHorizonPrefer, ExternalPolicyAll, onBackend, "backend"},
+		{SplitHorizonPrefer, ExternalPolicyAll, onEmpty, "backend,frontend"},
+		{SplitHorizonPrefer, ExternalPolicyAll, external, "backend,frontend"},
+		{SplitHorizonPrefer, ExternalPolicyNone, external, ""},
+		{SplitHorizonPrefer, "frontend", external, "frontend"},
+		{SplitHorizonPrefer, "missing", external, ""},
+		{SplitHorizonRestrict, ExternalPolicyAll, onBackend, "backend"},
+		{SplitHorizonRestrict, ExternalPolicyAll, onEmpty, ""},
+		{SplitHorizonRestrict, ExternalPolicyAll, external, "backend,frontend"},
+		{SplitHorizonRestrict, ExternalPolicyNone, external, ""},
+		{SplitHorizonRestrict, "Frontend", external, "frontend"},
+		{SplitHorizonRestrict, "missing", external, ""},
+	} {
+		h := SplitHorizon{Mode: tc.mode, ExternalPolicy: tc.policy}
+		client := net.ParseIP(tc.client)
+
+		if networks := endpointNetworks(snapshot, h.filterEndpoints(snapshot, client, endpoints)); networks != tc.networks {
+			t.Errorf("unexpected endpoints for %s with policy %s and client %s: %s", tc.mode, tc.policy, tc.client, networks)
+		}
+
+		var serviceEndpoints []*state.ContainerEndpoint
+		for _, service := range h.filterServices(snapshot, client, services) {
+			serviceEndpoints = append(serviceEndpoints, service.Endpoint)
+		}
+
+		if networks := endpointNetworks(snapshot, serviceEndpoints); networks != tc.networks {
+			t.Errorf("unexpected services for %s with policy %s and client %s: %s", tc.mode, tc.policy, tc.client, networks)
+		}
+
+		if exists := h.ExternalNetworkExists(snapshot); exists != (tc.policy != "missing" || tc.mode == SplitHorizonOff) {
+			t.Errorf("unexpected external network check for %s with policy %s: %v", tc.mode, tc.policy, exists)
+		}
+	}
+}
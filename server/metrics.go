@@ -0,0 +1,68 @@
+package server
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "docker_container_dns"
+
+var (
+	queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dns_queries_total",
+		Help:      "DNS queries answered, by query type, response code and zone. Queries outside the authoritative zones have the zone '.'.",
+	}, []string{"type", "rcode", "zone"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "dns_query_duration_seconds",
+		Help:      "Latency of answering DNS queries, including forwarding.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 2.5},
+	}, []string{"type"})
+
+	accessDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dns_access_denials_total",
+		Help:      "DNS queries refused by the access rules, by listener and reason, which is 'zone', 'recursion' or 'transfer'.",
+	}, []string{"listener", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(queries, queryDuration, accessDenials)
+}
+
+// queryType returns the name of the query type, grouping unknown types to
+// keep the label bounded.
+func queryType(r *dns.Msg) string {
+	if len(r.Question) == 0 {
+		return "none"
+	}
+	if name, ok := dns.TypeToString[r.Question[0].Qtype]; ok {
+		return name
+	}
+
+	return "other"
+}
+
+func observeQuery(r, m *dns.Msg, zone string, started time.Time) {
+	qtype := queryType(r)
+
+	queries.WithLabelValues(qtype, dns.RcodeToString[m.Rcode], zone).Inc()
+	queryDuration.WithLabelValues(qtype).Observe(time.Since(started).Seconds())
+}
+
+// observeTransfer counts a zone transfer that was written directly to the
+// client as a successful query.
+func observeTransfer(r *dns.Msg, zone string, started time.Time) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	observeQuery(r, m, zone, started)
+}
+
+func observeDenial(listener, reason string) {
+	accessDenials.WithLabelValues(listener, reason).Inc()
+}
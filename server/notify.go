@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/state"
+	"github.com/rakshasa/docker-container-dns/tsig"
+)
+
+// NotifyTarget is a secondary server sent NOTIFY messages, signed with Key
+// if not nil.
+type NotifyTarget struct {
+	Addr string
+	Key  *tsig.Key
+}
+
+// ParseNotifyTarget parses a target in the 'ip[:port][@key]' format, with
+// the key looked up by name in keys.
+func ParseNotifyTarget(value string, keys map[string]*tsig.Key) (*NotifyTarget, error) {
+	target := &NotifyTarget{}
+
+	addr := value
+	if idx := strings.LastIndex(value, "@"); idx != -1 {
+		name := dns.Fqdn(strings.ToLower(value[idx+1:]))
+
+		if target.Key = keys[name]; target.Key == nil {
+			return nil, fmt.Errorf("unknown tsig key '%s' for notify target %s", strings.TrimSuffix(name, "."), value)
+		}
+
+		addr = value[:idx]
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.Trim(addr, "[]"), "53"
+	}
+
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("notify target must be 'ip[:port][@key]': %s", value)
+	}
+
+	target.Addr = net.JoinHostPort(host, port)
+
+	return target, nil
+}
+
+// Notifier sends NOTIFY messages to the targets for each zone whose serial
+// changed since the last message the target acknowledged, as described in
+// RFC 1996. The targets are expected to respond with a zone transfer.
+//
+// Notifications are rate limited to one per Interval, and failed targets
+// are retried after Interval.
+type Notifier struct {
+	Targets  []*NotifyTarget
+	TTL      uint32
+	Interval time.Duration
+
+	client   *dns.Client
+	notify   chan struct{}
+	notified map[string]map[string]uint32
+}
+
+func NewNotifier(targets []*NotifyTarget, ttl uint32, interval time.Duration) *Notifier {
+	n := &Notifier{
+		Targets:  targets,
+		TTL:      ttl,
+		Interval: interval,
+		client:   &dns.Client{TsigSecret: make(map[string]string)},
+		notify:   make(chan struct{}, 1),
+		notified: make(map[string]map[string]uint32),
+	}
+
+	for _, target := range targets {
+		if target.Key != nil {
+			n.client.TsigSecret[target.Key.Name] = target.Key.Secret
+		}
+	}
+
+	return n
+}
+
+// Notify schedules notifications for the current snapshot without
+// blocking.
+func (n *Notifier) Notify() {
+	select {
+	case n.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends notifications on each notification until ctx is done.
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-n.notify:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := n.Send(state.Current()); err != nil {
+			log.Printf("notify failed, retrying in %v: %v", n.Interval, err)
+			n.Notify()
+		}
+
+		select {
+		case <-time.After(n.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Send notifies each target of the zones with a changed serial, returning
+// the first error.
+func (n *Notifier) Send(snapshot *state.Snapshot) error {
+	var firstErr error
+
+	for _, target := range n.Targets {
+		notified := n.notified[target.Addr]
+		if notified == nil {
+			notified = make(map[string]uint32)
+			n.notified[target.Addr] = notified
+		}
+
+		for _, zone := range snapshot.AuthoritativeZones() {
+			serial := snapshot.Serial(zone)
+			if previous, exists := notified[zone]; exists && previous == serial {
+				continue
+			}
+
+			if err := n.send(target, snapshot.SOA(zone, n.TTL)); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("could not notify %s of zone %s: %v", target.Addr, zone, err)
+				}
+				continue
+			}
+
+			notified[zone] = serial
+
+			log.Printf("notified %s of zone %s serial %d", target.Addr, zone, serial)
+		}
+	}
+
+	return firstErr
+}
+
+func (n *Notifier) send(target *NotifyTarget, soa *dns.SOA) error {
+	m := new(dns.Msg)
+	m.SetNotify(soa.Hdr.Name)
+	m.Answer = []dns.RR{soa}
+
+	target.Key.Sign(m)
+
+	r, _, err := n.client.Exchange(m, target.Addr)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("notify refused: %s", dns.RcodeToString[r.Rcode])
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	OrderNone    = "none"
+	OrderShuffle = "shuffle"
+	OrderRotate  = "rotate"
+	OrderSubnet  = "subnet"
+	OrderHash    = "hash"
+)
+
+// Ordering decides the order of the A and AAAA records of an answer, so
+// clients of names with many addresses do not all use the first one.
+//
+// The shuffle mode orders records randomly, and rotate moves the first
+// record to the end on each answer. The subnet mode sorts records sharing
+// the longest prefix with the client first, using the EDNS client subnet
+// if present. The hash mode orders records by a hash of the client
+// address, so each client keeps getting the same order.
+//
+// MaxAnswers limits the records of each type in an answer after ordering,
+// unlimited if zero.
+type Ordering struct {
+	Mode       string
+	MaxAnswers int
+
+	rotation uint32
+}
+
+func (o Ordering) Validate() error {
+	switch o.Mode {
+	case OrderNone, OrderShuffle, OrderRotate, OrderSubnet, OrderHash:
+	default:
+		return fmt.Errorf("invalid answer order, must be none, shuffle, rotate, subnet or hash: %s", o.Mode)
+	}
+
+	if o.MaxAnswers < 0 {
+		return fmt.Errorf("max answers must not be negative: %d", o.MaxAnswers)
+	}
+
+	return nil
+}
+
+// orderAnswers orders and limits each A and AAAA rrset of the answer
+// section, keeping the position of the rrsets.
+func (o *Ordering) orderAnswers(m *dns.Msg, client net.IP) {
+	if (o.Mode == OrderNone || len(o.Mode) == 0) && o.MaxAnswers == 0 {
+		return
+	}
+
+	var keys []string
+	rrsets := make(map[string][]dns.RR)
+
+	for _, rr := range m.Answer {
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	rotation := int(atomic.AddUint32(&o.rotation, 1))
+	answer := make([]dns.RR, 0, len(m.Answer))
+
+	for _, key := range keys {
+		rrset := rrsets[key]
+
+		if rrtype := rrset[0].Header().Rrtype; rrtype == dns.TypeA || rrtype == dns.TypeAAAA {
+			o.order(rrset, client, rotation)
+
+			if o.MaxAnswers != 0 && len(rrset) > o.MaxAnswers {
+				rrset = rrset[:o.MaxAnswers]
+			}
+		}
+
+		answer = append(answer, rrset...)
+	}
+
+	m.Answer = answer
+}
+
+func (o *Ordering) order(rrs []dns.RR, client net.IP, rotation int) {
+	if len(rrs) < 2 {
+		return
+	}
+
+	switch o.Mode {
+	case OrderShuffle:
+		rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+
+	case OrderRotate:
+		n := rotation % len(rrs)
+		rotated := append(append([]dns.RR{}, rrs[n:]...), rrs[:n]...)
+		copy(rrs, rotated)
+
+	case OrderSubnet:
+		if client == nil {
+			return
+		}
+
+		sort.SliceStable(rrs, func(i, j int) bool {
+			return commonPrefixLength(client, addressOf(rrs[i])) > commonPrefixLength(client, addressOf(rrs[j]))
+		})
+
+	case OrderHash:
+		hashes := make(map[dns.RR]uint64, len(rrs))
+		for _, rr := range rrs {
+			h := fnv.New64a()
+			h.Write(client)
+			h.Write(addressOf(rr))
+			hashes[rr] = h.Sum64()
+		}
+
+		sort.Slice(rrs, func(i, j int) bool { return hashes[rrs[i]] < hashes[rrs[j]] })
+	}
+}
+
+func addressOf(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+
+	return nil
+}
+
+// commonPrefixLength returns the number of leading bits a and b share, or
+// zero if they are of different families.
+func commonPrefixLength(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		if a4 == nil || b4 == nil {
+			return 0
+		}
+		a, b = a4, b4
+	} else {
+		a, b = a.To16(), b.To16()
+	}
+
+	if len(a) != len(b) {
+		return 0
+	}
+
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := 0
+			for ; x&0x80 == 0; x <<= 1 {
+				n++
+			}
+			return i*8 + n
+		}
+	}
+
+	return len(a) * 8
+}
+
+// orderingClient returns the address answers are ordered for, which is the
+// EDNS client subnet of the request if present.
+func orderingClient(r *dns.Msg, client net.IP) net.IP {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && subnet.Address != nil {
+				return subnet.Address
+			}
+		}
+	}
+
+	return client
+}
+
+// udpSize returns the largest reply a client accepts over udp, which is
+// the EDNS buffer size of the request capped at our own.
+func udpSize(r *dns.Msg) int {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+
+	if size := int(opt.UDPSize()); size < ednsUDPSize {
+		return size
+	}
+
+	return ednsUDPSize
+}
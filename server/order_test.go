@@ -0,0 +1,199 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/dnssec"
+	"github.com/rakshasa/docker-container-dns/tsig"
+)
+
+func addressAnswer(t *testing.T, values ...string) *dns.Msg {
+	m := new(dns.Msg)
+
+	for _, value := range values {
+		rr, err := dns.NewRR(value)
+		if err != nil {
+			t.Fatalf("invalid record '%s': %v", value, err)
+		}
+
+		m.Answer = append(m.Answer, rr)
+	}
+
+	return m
+}
+
+func answerAddresses(m *dns.Msg) []string {
+	var addresses []string
+
+	for _, rr := range m.Answer {
+		addresses = append(addresses, addressOf(rr).String())
+	}
+
+	return addresses
+}
+
+var orderingRecords = []string{
+	"web.docker. 30 IN A 10.0.0.2",
+	"web.docker. 30 IN A 10.0.1.2",
+	"web.docker. 30 IN A 192.168.0.2",
+	"web.docker. 30 IN AAAA fd00::2",
+	"web.docker. 30 IN AAAA fd01::2",
+}
+
+func TestOrderingOrderAnswers(t *testing.T) {
+	client := net.ParseIP("10.0.1.100")
+
+	o := &Ordering{Mode: OrderRotate}
+
+	ordered := func() []string {
+		m := addressAnswer(t, orderingRecords...)
+		o.orderAnswers(m, client)
+		return answerAddresses(m)
+	}
+
+	first, second := ordered(), ordered()
+
+	if first[0] == second[0] || first[1] != second[0] || first[3] != second[4] {
+		t.Errorf("expected rotated answers: %v %v", first, second)
+	}
+
+	o = &Ordering{Mode: OrderSubnet}
+
+	m := addressAnswer(t, orderingRecords...)
+	o.orderAnswers(m, client)
+
+	if addresses := answerAddresses(m); addresses[0] != "10.0.1.2" || addresses[1] != "10.0.0.2" || addresses[2] != "192.168.0.2" {
+		t.Errorf("expected addresses sorted by prefix: %v", addresses)
+	}
+
+	o = &Ordering{Mode: OrderHash, MaxAnswers: 2}
+
+	hashed := ordered()
+	if len(hashed) != 4 || net.ParseIP(hashed[1]).To4() == nil || net.ParseIP(hashed[2]).To4() != nil {
+		t.Fatalf("expected two records of each type: %v", hashed)
+	}
+
+	for i := 0; i < 5; i++ {
+		if addresses := ordered(); addresses[0] != hashed[0] || addresses[1] != hashed[1] {
+			t.Errorf("expected a stable order per client: %v %v", hashed, addresses)
+		}
+	}
+
+	m = addressAnswer(t, orderingRecords...)
+	(&Ordering{Mode: OrderShuffle}).orderAnswers(m, client)
+
+	if len(m.Answer) != len(orderingRecords) || m.Answer[3].Header().Rrtype != dns.TypeAAAA {
+		t.Errorf("expected shuffle to keep the rrsets: %v", m.Answer)
+	}
+}
+
+func TestOrderingClient(t *testing.T) {
+	client := net.ParseIP("10.0.0.1")
+
+	r := new(dns.Msg)
+	r.SetQuestion("web.docker.", dns.TypeA)
+
+	if ip := orderingClient(r, client); !ip.Equal(client) {
+		t.Errorf("expected client address without edns: %v", ip)
+	}
+
+	r.SetEdns0(4096, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")})
+
+	if ip := orderingClient(r, client); !ip.Equal(net.ParseIP("192.0.2.0")) {
+		t.Errorf("expected client subnet address: %v", ip)
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	signer := dnssec.NewSigner(t.TempDir(), "docker.", dns.ECDSAP256SHA256, dnssec.DenialBlackLies, time.Hour)
+	if err := signer.Refresh(time.Now()); err != nil {
+		t.Fatalf("could not load dnssec keys: %v", err)
+	}
+
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+	s.DNSSEC = signer
+
+	for _, tc := range []struct {
+		size      uint16
+		udp       bool
+		truncated bool
+	}{
+		{512, true, true},
+		{4096, true, false},
+		{512, false, false},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion("docker.", dns.TypeANY)
+		r.SetEdns0(tc.size, true)
+
+		w := &dohResponseWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+		if tc.udp {
+			w.remote = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		}
+
+		s.ServeDNS(w, r)
+
+		if w.msg == nil || w.msg.Truncated != tc.truncated || w.msg.IsEdns0() == nil {
+			t.Errorf("unexpected reply for buffer size %d over udp %v: %v", tc.size, tc.udp, w.msg)
+			continue
+		}
+
+		if data, err := w.msg.Pack(); err != nil || (tc.udp && len(data) > udpSize(r)) {
+			t.Errorf("reply of %d bytes exceeds buffer size %d: %v", len(data), tc.size, err)
+		}
+	}
+}
+
+func TestServerTruncateSigned(t *testing.T) {
+	signer := dnssec.NewSigner(t.TempDir(), "docker.", dns.ECDSAP256SHA256, dnssec.DenialBlackLies, time.Hour)
+	if err := signer.Refresh(time.Now()); err != nil {
+		t.Fatalf("could not load dnssec keys: %v", err)
+	}
+
+	key := mustParseKey(t, "xfr:"+testSecret)
+
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+	s.DNSSEC = signer
+	s.TSIGKeys = map[string]*tsig.Key{key.Name: key}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	started := make(chan struct{})
+
+	srv := &dns.Server{
+		PacketConn:        conn,
+		Handler:           s,
+		TsigSecret:        tsig.Secrets(s.TSIGKeys),
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go srv.ActivateAndServe()
+	<-started
+
+	t.Cleanup(func() { srv.Shutdown() })
+
+	// The reply must fit the buffer of the client with the TSIG record
+	// added, or the client fails to read or verify it.
+	m := new(dns.Msg)
+	m.SetQuestion("docker.", dns.TypeANY)
+	m.SetEdns0(512, true)
+	key.Sign(m)
+
+	c := &dns.Client{Net: "udp", UDPSize: 512, TsigSecret: tsig.Secrets(s.TSIGKeys)}
+
+	r, _, err := c.Exchange(m, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("signed query failed: %v", err)
+	}
+
+	if !r.Truncated || r.IsTsig() == nil {
+		t.Errorf("expected a truncated and signed reply: %v", r)
+	}
+}
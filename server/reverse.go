@@ -0,0 +1,48 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+// answerReverse answers PTR questions for addresses within the subnets of
+// the tracked networks, pointing at both the container name and the
+// network qualified container name.
+func (s *Server) answerReverse(m *dns.Msg, q dns.Question, snapshot *state.Snapshot, zone string) {
+	m.Authoritative = true
+
+	if s.answerZoneApex(m, q, snapshot, zone) {
+		return
+	}
+
+	endpoints, exists := snapshot.LookupReverse(q.Name)
+	if !exists {
+		s.nameError(m, snapshot, zone)
+		return
+	}
+
+	if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+		seen := make(map[string]bool)
+
+		for _, endpoint := range endpoints {
+			for _, target := range snapshot.CanonicalNames(endpoint) {
+				if seen[target] {
+					continue
+				}
+				seen[target] = true
+
+				m.Answer = append(m.Answer, &dns.PTR{
+					Hdr: s.header(q.Name, dns.TypePTR),
+					Ptr: target,
+				})
+			}
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		s.noData(m, snapshot, zone)
+		return
+	}
+
+	s.setAnswerTTL(m, endpoints)
+}
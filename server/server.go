@@ -0,0 +1,484 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/dnssec"
+	"github.com/rakshasa/docker-container-dns/state"
+	"github.com/rakshasa/docker-container-dns/tsig"
+)
+
+type Server struct {
+	Addr   string
+	Domain string
+	TTL    uint32
+	Errs   <-chan error
+
+	// Forwarder handles queries outside of the authoritative zones, which
+	// are refused if nil.
+	Forwarder *Forwarder
+
+	SplitHorizon SplitHorizon
+	Ordering     Ordering
+
+	// TransferRules allow AXFR and IXFR of the authoritative zones, which
+	// are refused if empty.
+	TransferRules []*TransferRule
+
+	// AccessRules control which zones clients may query and whether they
+	// may use recursion and zone transfers, with the first matching rule
+	// applying. All queries are allowed if empty, and refused if no rule
+	// matches.
+	AccessRules []*AccessRule
+
+	// TSIGKeys are the keys accepted for signed requests, by name.
+	TSIGKeys map[string]*tsig.Key
+
+	// DNSSEC signs authoritative answers to requests with the DO bit set,
+	// and publishes the keys at the apex of each zone.
+	DNSSEC *dnssec.Signer
+
+	// TLSAddr enables a DNS-over-TLS listener as described in RFC 7858,
+	// serving the same zones with TLSConfig.
+	TLSAddr   string
+	TLSConfig *tls.Config
+
+	// TLSIdleTimeout closes idle TLS connections, using the library
+	// default if zero. TLSMaxQueries limits the pipelined queries answered
+	// on a TLS connection before it is closed, unlimited if zero.
+	TLSIdleTimeout time.Duration
+	TLSMaxQueries  int
+
+	// HTTPAddr enables a DNS-over-HTTPS endpoint on DoHPath as described
+	// in RFC 8484, served over TLS with HTTPTLSConfig if set and as plain
+	// http for use behind a terminating proxy otherwise. HTTPTLSConfig is
+	// separate from TLSConfig so client certificates can be required by
+	// only one of the listeners.
+	HTTPAddr      string
+	HTTPTLSConfig *tls.Config
+
+	// HTTPTrustedProxies are the proxies whose 'Forwarded' and
+	// 'X-Forwarded-For' headers are used as the client address of DoH
+	// requests, for query acls, split horizon and metrics. The headers are
+	// ignored if empty.
+	HTTPTrustedProxies []*net.IPNet
+
+	errs       chan error
+	servers    []*dns.Server
+	httpServer *http.Server
+}
+
+func NewServer(addr, domain string, ttl uint32) *Server {
+	errs := make(chan error, 4)
+
+	return &Server{
+		Addr:   addr,
+		Domain: dns.Fqdn(strings.ToLower(domain)),
+		TTL:    ttl,
+		Errs:   errs,
+		errs:   errs,
+	}
+}
+
+// Start begins serving on both UDP and TCP, and TLS and HTTPS if enabled.
+// Listener failures are reported on Errs.
+func (s *Server) Start() {
+	for _, proto := range []string{"udp", "tcp"} {
+		s.servers = append(s.servers, &dns.Server{
+			Addr:       s.Addr,
+			Net:        proto,
+			Handler:    s,
+			TsigSecret: tsig.Secrets(s.TSIGKeys),
+		})
+	}
+
+	if len(s.TLSAddr) != 0 {
+		s.servers = append(s.servers, s.newTLSServer())
+	}
+
+	for _, srv := range s.servers {
+		go func(srv *dns.Server) {
+			log.Printf("dns server listening on %s/%s for zone '%s'", srv.Addr, srv.Net, s.Domain)
+
+			if err := srv.ListenAndServe(); err != nil {
+				s.errs <- fmt.Errorf("dns server on %s/%s failed: %v", srv.Addr, srv.Net, err)
+			}
+		}(srv)
+	}
+
+	if len(s.HTTPAddr) != 0 {
+		s.httpServer = s.newHTTPServer()
+		go s.serveHTTP()
+	}
+}
+
+func (s *Server) serveHTTP() {
+	var err error
+
+	if s.HTTPTLSConfig != nil {
+		log.Printf("dns-over-https listening on https://%s%s for zone '%s'", s.HTTPAddr, DoHPath, s.Domain)
+		err = s.httpServer.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("dns-over-https listening on http://%s%s for zone '%s'", s.HTTPAddr, DoHPath, s.Domain)
+		err = s.httpServer.ListenAndServe()
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		s.errs <- fmt.Errorf("dns-over-https on %s failed: %v", s.HTTPAddr, err)
+	}
+}
+
+func (s *Server) newTLSServer() *dns.Server {
+	maxQueries := s.TLSMaxQueries
+	if maxQueries == 0 {
+		maxQueries = -1
+	}
+
+	srv := &dns.Server{
+		Addr:          s.TLSAddr,
+		Net:           "tcp-tls",
+		Handler:       s,
+		TLSConfig:     s.TLSConfig,
+		TsigSecret:    tsig.Secrets(s.TSIGKeys),
+		MaxTCPQueries: maxQueries,
+	}
+
+	if s.TLSIdleTimeout != 0 {
+		srv.IdleTimeout = func() time.Duration { return s.TLSIdleTimeout }
+	}
+
+	return srv
+}
+
+func (s *Server) Shutdown() {
+	for _, srv := range s.servers {
+		if err := srv.Shutdown(); err != nil {
+			log.Printf("dns server on %s/%s shutdown error: %v", srv.Addr, srv.Net, err)
+		}
+	}
+
+	if s.httpServer != nil {
+		if err := s.httpServer.Close(); err != nil {
+			log.Printf("dns-over-https on %s shutdown error: %v", s.HTTPAddr, err)
+		}
+	}
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	started := time.Now()
+	m := new(dns.Msg)
+	zone := "."
+
+	switch {
+	case r.Opcode != dns.OpcodeQuery:
+		m.SetRcode(r, dns.RcodeNotImplemented)
+	case len(r.Question) != 1:
+		m.SetRcode(r, dns.RcodeFormatError)
+	case r.Question[0].Qclass != dns.ClassINET:
+		m.SetRcode(r, dns.RcodeRefused)
+	case isTransfer(r.Question[0].Qtype):
+		if m, zone = s.transfer(w, r); m == nil {
+			observeTransfer(r, zone, started)
+			return
+		}
+	default:
+		snapshot := state.Current()
+		client := clientIP(w.RemoteAddr())
+		access := s.accessRule(w, snapshot)
+
+		m.SetReply(r)
+		m.RecursionAvailable = s.Forwarder != nil && access.Recursion
+
+		var authoritative bool
+
+		if zone, authoritative = s.queryZone(r.Question[0], snapshot); !authoritative {
+			zone = "."
+
+			// Without a forwarder there is no recursion to deny, so the
+			// query is refused without counting it as an access denial.
+			if s.Forwarder == nil {
+				m = new(dns.Msg)
+				m.SetRcode(r, dns.RcodeRefused)
+				break
+			}
+			if !access.Recursion {
+				m = refuse(w, r, "recursion")
+				break
+			}
+
+			m = s.forward(r)
+			break
+		}
+
+		if !access.AllowsZone(zone) {
+			m = refuse(w, r, "zone")
+			break
+		}
+
+		s.answer(m, r.Question[0], snapshot, client)
+		s.Ordering.orderAnswers(m, orderingClient(r, client))
+
+		if s.wantsDNSSEC(r) {
+			s.signReply(m, r.Question[0], snapshot, zone, client)
+		}
+
+		s.setEdns(m, r)
+	}
+
+	// Replies to signed requests are signed with the same key, as required
+	// by RFC 8945.
+	t := r.IsTsig()
+	signed := t != nil && w.TsigStatus() == nil && m.IsTsig() == nil
+
+	// Replies too large for the client's buffer are truncated with the TC
+	// bit set, so the client retries over TCP. The TSIG record is added
+	// when the reply is written, and has the size of the request's.
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := udpSize(r)
+		if !signed {
+			m.Truncate(size)
+		} else if m.Truncate(size - dns.Len(t)); m.Len()+dns.Len(t) > size {
+			// Truncation keeps at least 512 bytes, so replies that still
+			// leave no room for the TSIG record only keep the question, as
+			// described in RFC 8945 section 5.3.
+			m.Answer, m.Ns, m.Extra = nil, nil, nil
+			m.Truncated = true
+			s.setEdns(m, r)
+		}
+	}
+
+	if signed {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("dns server failed to write reply to %v: %v", w.RemoteAddr(), err)
+	}
+
+	observeQuery(r, m, zone, started)
+}
+
+// queryZone returns the zone or reverse zone a question is answered from,
+// or false if we are not authoritative.
+func (s *Server) queryZone(q dns.Question, snapshot *state.Snapshot) (string, bool) {
+	qname := strings.ToLower(q.Name)
+
+	if zone, ok := snapshot.Zone(qname); ok {
+		if parent, ok := s.parentZone(q, snapshot, zone); ok {
+			return parent, true
+		}
+
+		return zone, true
+	}
+
+	if zone, ok := snapshot.ReverseZone(qname); ok {
+		return zone.Name, true
+	}
+
+	return "", false
+}
+
+// answer fills in the reply for a question within one of the zones or
+// reverse zones returned by queryZone.
+func (s *Server) answer(m *dns.Msg, q dns.Question, snapshot *state.Snapshot, client net.IP) {
+	qname := strings.ToLower(q.Name)
+
+	if zone, ok := snapshot.Zone(qname); ok {
+		if parent, ok := s.parentZone(q, snapshot, zone); ok {
+			s.answerDS(m, snapshot, parent, zone)
+			return
+		}
+
+		s.answerZone(m, q, snapshot, zone, client)
+		return
+	}
+
+	if zone, ok := snapshot.ReverseZone(qname); ok {
+		s.answerReverse(m, q, snapshot, zone.Name)
+	}
+}
+
+// answerZoneApex answers questions for the apex of an authoritative zone,
+// returning false if qname is not the apex.
+func (s *Server) answerZoneApex(m *dns.Msg, q dns.Question, snapshot *state.Snapshot, zone string) bool {
+	if !strings.EqualFold(q.Name, zone) {
+		return false
+	}
+
+	if q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, snapshot.SOA(zone, s.TTL))
+	}
+	if q.Qtype == dns.TypeNS || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, snapshot.NS(zone, s.TTL))
+	}
+
+	s.answerApexKeys(m, q, zone)
+
+	if len(m.Answer) != 0 {
+		return true
+	}
+
+	s.noData(m, snapshot, zone)
+	return true
+}
+
+func (s *Server) answerZone(m *dns.Msg, q dns.Question, snapshot *state.Snapshot, zone string, client net.IP) {
+	m.Authoritative = true
+
+	if s.answerZoneApex(m, q, snapshot, zone) {
+		return
+	}
+
+	if rrs := snapshot.NameserverRecords(q.Name, s.TTL); len(rrs) != 0 {
+		for _, rr := range rrs {
+			if q.Qtype == dns.TypeANY || q.Qtype == rr.Header().Rrtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+
+		if len(m.Answer) == 0 {
+			s.noData(m, snapshot, zone)
+		}
+		return
+	}
+
+	endpoints, exists := snapshot.LookupName(q.Name)
+	if !exists {
+		s.nameError(m, snapshot, zone)
+		return
+	}
+
+	services := snapshot.LookupServices(q.Name)
+
+	if !snapshot.IsNetworkZone(zone) {
+		endpoints = s.SplitHorizon.filterEndpoints(snapshot, client, endpoints)
+		services = s.SplitHorizon.filterServices(snapshot, client, services)
+	}
+
+	seen := make(map[string]bool)
+
+	for _, endpoint := range endpoints {
+		for _, rr := range s.addressRecords(q.Name, q.Qtype, endpoint) {
+			if address := rr.String(); !seen[address] {
+				seen[address] = true
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+
+	if q.Qtype == dns.TypeSRV || q.Qtype == dns.TypeANY {
+		for _, service := range services {
+			m.Answer = append(m.Answer, &dns.SRV{
+				Hdr:      s.header(q.Name, dns.TypeSRV),
+				Priority: 0,
+				Weight:   0,
+				Port:     service.Port.Number,
+				Target:   service.Target,
+			})
+
+			endpoints = append(endpoints, service.Endpoint)
+
+			// The target's addresses are included as additional records so
+			// clients do not need another round trip.
+			for _, rr := range s.addressRecords(service.Target, dns.TypeANY, service.Endpoint) {
+				rr.Header().Ttl = s.endpointTTL(service.Endpoint)
+
+				if key := rr.String(); !seen[key] {
+					seen[key] = true
+					m.Extra = append(m.Extra, rr)
+				}
+			}
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		s.noData(m, snapshot, zone)
+		return
+	}
+
+	s.setAnswerTTL(m, endpoints)
+}
+
+// addressRecords returns the A and AAAA records of the endpoint matching
+// qtype.
+func (s *Server) addressRecords(name string, qtype uint16, endpoint *state.ContainerEndpoint) []dns.RR {
+	var rrs []dns.RR
+
+	if (qtype == dns.TypeA || qtype == dns.TypeANY) && len(endpoint.IPv4Address) != 0 {
+		rrs = append(rrs, &dns.A{
+			Hdr: s.header(name, dns.TypeA),
+			A:   net.ParseIP(endpoint.IPv4Address),
+		})
+	}
+	if (qtype == dns.TypeAAAA || qtype == dns.TypeANY) && len(endpoint.IPv6Address) != 0 {
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  s.header(name, dns.TypeAAAA),
+			AAAA: net.ParseIP(endpoint.IPv6Address),
+		})
+	}
+
+	return rrs
+}
+
+// setAnswerTTL sets the ttl of all answers to the lowest ttl of the
+// endpoints, as records of the same rrset must share a ttl.
+func (s *Server) setAnswerTTL(m *dns.Msg, endpoints []*state.ContainerEndpoint) {
+	var ttl uint32
+
+	for i, endpoint := range endpoints {
+		if t := s.endpointTTL(endpoint); i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+
+	for _, rr := range m.Answer {
+		rr.Header().Ttl = ttl
+	}
+}
+
+func (s *Server) endpointTTL(endpoint *state.ContainerEndpoint) uint32 {
+	if endpoint.DNS.TTL != 0 {
+		return endpoint.DNS.TTL
+	}
+
+	return s.TTL
+}
+
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	return nil
+}
+
+func (s *Server) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    s.TTL,
+	}
+}
+
+// noData sets a NOERROR reply without answers, with the SOA in the
+// authority section for negative caching as described in RFC 2308.
+func (s *Server) noData(m *dns.Msg, snapshot *state.Snapshot, zone string) {
+	m.Rcode = dns.RcodeSuccess
+	m.Ns = append(m.Ns, snapshot.SOA(zone, s.TTL))
+}
+
+func (s *Server) nameError(m *dns.Msg, snapshot *state.Snapshot, zone string) {
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, snapshot.SOA(zone, s.TTL))
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/dockertest"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+// publishTestState publishes a snapshot of the networks and containers of
+// the fake docker api, and an empty snapshot when the test is done.
+func publishTestState(t *testing.T, cli *dockertest.Client) *state.Snapshot {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "client", cli))
+
+	state.Networks = state.NewNetworkList(ctx, cli, state.NetworkEventActions)
+	state.Containers = state.NewContainerList(ctx, cli, state.ContainerEventActions)
+
+	t.Cleanup(func() {
+		cancel()
+
+		state.Networks, state.Containers = nil, nil
+		state.Publish()
+	})
+
+	if err := state.Sync(ctx); err != nil {
+		t.Fatalf("could not sync test state: %v", err)
+	}
+
+	return state.Publish()
+}
+
+func testDockerClient() *dockertest.Client {
+	cli := &dockertest.Client{}
+
+	backend := dockertest.Network("a000000000000000000000000000000000000000000000000000000000000001", "backend", "172.20.0.0/16")
+	cli.AddNetwork(backend)
+
+	web := dockertest.Container("c000000000000000000000000000000000000000000000000000000000000001", "web", nil)
+	dockertest.Connect(web, backend, "172.20.0.2", "")
+	cli.AddContainer(web)
+
+	return cli
+}
+
+func TestServeDNS(t *testing.T) {
+	publishTestState(t, testDockerClient())
+
+	addr := startTCPServer(t, NewServer("127.0.0.1:0", "docker.", 30))
+
+	for _, tc := range []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"web.docker.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"WEB.backend.docker.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"web.docker.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"backend.docker.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"missing.docker.", dns.TypeA, dns.RcodeNameError, 0},
+		{"missing.backend.docker.", dns.TypeAAAA, dns.RcodeNameError, 0},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+
+		r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("query for %s failed: %v", tc.name, err)
+		}
+
+		qtype := dns.TypeToString[tc.qtype]
+
+		if r.Rcode != tc.rcode || len(r.Answer) != tc.answers || !r.Authoritative {
+			t.Errorf("unexpected reply for %s %s: %v", tc.name, qtype, r)
+			continue
+		}
+
+		if tc.answers != 0 {
+			if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != "172.20.0.2" || a.Hdr.Ttl != 30 {
+				t.Errorf("unexpected answer for %s %s: %v", tc.name, qtype, r.Answer)
+			}
+			continue
+		}
+
+		// Negative replies have the SOA of the zone in the authority
+		// section, with the negative caching ttl as described in RFC 2308.
+		if len(r.Ns) != 1 {
+			t.Errorf("expected the SOA in the authority section for %s %s: %v", tc.name, qtype, r)
+			continue
+		}
+
+		soa, ok := r.Ns[0].(*dns.SOA)
+		if zone, _ := state.Current().Zone(tc.name); !ok || soa.Hdr.Name != zone || soa.Minttl != 30 {
+			t.Errorf("unexpected SOA for %s %s: %v", tc.name, qtype, r.Ns[0])
+		}
+	}
+}
+
+func TestServeDNSNameserver(t *testing.T) {
+	state.NameserverAddresses = []net.IP{net.ParseIP("192.0.2.53")}
+	defer func() { state.NameserverAddresses = nil }()
+
+	publishTestState(t, testDockerClient())
+
+	addr := startTCPServer(t, NewServer("127.0.0.1:0", "docker.", 30))
+
+	for qtype, answers := range map[uint16]int{dns.TypeA: 1, dns.TypeAAAA: 0} {
+		m := new(dns.Msg)
+		m.SetQuestion("ns.docker.", qtype)
+
+		r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("query for the nameserver failed: %v", err)
+		}
+
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != answers || !r.Authoritative {
+			t.Errorf("unexpected reply for the nameserver %s: %v", dns.TypeToString[qtype], r)
+		}
+	}
+}
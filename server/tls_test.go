@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCert writes a certificate for name and its key to dir, signed by
+// parent or self-signed if nil.
+func writeTestCert(t *testing.T, dir, name string, parent *tls.Certificate) (string, string, *tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("could not write certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+
+	leaf, _ := x509.ParseCertificate(der)
+
+	return certFile, keyFile, &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// startTLSServer serves s over tls on a tcp port, returning its address.
+func startTLSServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	started := make(chan struct{})
+
+	srv := s.newTLSServer()
+	srv.Listener = tls.NewListener(l, s.TLSConfig)
+	srv.NotifyStartedFunc = func() { close(started) }
+
+	go srv.ActivateAndServe()
+	<-started
+
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return l.Addr().String()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+
+	certFile, keyFile, first := writeTestCert(t, dir, "first", nil)
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("could not load certificate: %v", err)
+	}
+
+	if cert, _ := r.GetCertificate(nil); string(cert.Certificate[0]) != string(first.Certificate[0]) {
+		t.Errorf("unexpected initial certificate")
+	}
+	if r.changed() {
+		t.Errorf("expected unchanged files after loading")
+	}
+
+	secondCert, secondKey, second := writeTestCert(t, dir, "second", nil)
+
+	for _, rename := range [][2]string{{secondCert, certFile}, {secondKey, keyFile}} {
+		if err := os.Rename(rename[0], rename[1]); err != nil {
+			t.Fatalf("could not replace file: %v", err)
+		}
+	}
+
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	if !r.changed() {
+		t.Errorf("expected replaced files to be detected")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("could not reload certificate: %v", err)
+	}
+	if cert, _ := r.GetCertificate(nil); string(cert.Certificate[0]) != string(second.Certificate[0]) {
+		t.Errorf("expected reloaded certificate")
+	}
+
+	if err := ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+
+	if err := r.Reload(); err == nil {
+		t.Errorf("expected error reloading invalid key")
+	}
+	if cert, _ := r.GetCertificate(nil); string(cert.Certificate[0]) != string(second.Certificate[0]) {
+		t.Errorf("expected previous certificate to be kept after failed reload")
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	caFile, _, ca := writeTestCert(t, dir, "ca", nil)
+	certFile, keyFile, _ := writeTestCert(t, dir, "server", ca)
+	_, _, client := writeTestCert(t, dir, "client", ca)
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("could not load certificate: %v", err)
+	}
+
+	config, err := NewTLSConfig(r, caFile)
+	if err != nil {
+		t.Fatalf("could not create tls config: %v", err)
+	}
+
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+	s.TLSConfig = config
+	s.TLSIdleTimeout = time.Second
+
+	addr := startTLSServer(t, s)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	m := new(dns.Msg)
+	m.SetQuestion("docker.", dns.TypeSOA)
+
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{*client}}}
+
+	if reply, _, err := c.Exchange(m, addr); err != nil || reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Errorf("unexpected reply over tls: %v %v", reply, err)
+	}
+
+	c = &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: roots}}
+
+	if reply, _, err := c.Exchange(m, addr); err == nil {
+		t.Errorf("expected query without client certificate to fail: %v", reply)
+	}
+}
+
+func TestServerDoHTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	caFile, _, ca := writeTestCert(t, dir, "ca", nil)
+	certFile, keyFile, _ := writeTestCert(t, dir, "server", ca)
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("could not load certificate: %v", err)
+	}
+
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+
+	if s.TLSConfig, err = NewTLSConfig(r, caFile); err != nil {
+		t.Fatalf("could not create tls config: %v", err)
+	}
+	if s.HTTPTLSConfig, err = NewTLSConfig(r, ""); err != nil {
+		t.Fatalf("could not create https tls config: %v", err)
+	}
+
+	// Requiring client certificates on the tls listener leaves https alone.
+	if config := s.newHTTPServer().TLSConfig; config != s.HTTPTLSConfig || config.ClientAuth != tls.NoClientCert {
+		t.Errorf("expected https to not require client certificates: %+v", config)
+	}
+	if s.newTLSServer().TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("expected tls to require client certificates")
+	}
+}
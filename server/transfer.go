@@ -0,0 +1,249 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+// transferChunkSize is the number of records sent in each message of a
+// zone transfer.
+const transferChunkSize = 100
+
+// TransferRule allows zone transfers signed with Key from clients within
+// Network. An empty Key allows unsigned transfers, and a nil Network
+// allows any client.
+type TransferRule struct {
+	Key     string
+	Network *net.IPNet
+}
+
+// ParseTransferRule parses a rule in the 'key@network' format, where
+// either side may be '*' to match anything, e.g. 'xfr-key@10.0.0.0/8'.
+func ParseTransferRule(value string) (*TransferRule, error) {
+	parts := strings.SplitN(value, "@", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("transfer rule must be 'key@network', with '*' matching anything: %s", value)
+	}
+
+	rule := &TransferRule{}
+
+	if parts[0] != "*" {
+		if _, ok := dns.IsDomainName(parts[0]); !ok || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("invalid transfer rule key: %s", parts[0])
+		}
+
+		rule.Key = dns.Fqdn(strings.ToLower(parts[0]))
+	}
+
+	if parts[1] != "*" {
+		network, err := parseNetwork(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid transfer rule network: %v", err)
+		}
+
+		rule.Network = network
+	}
+
+	return rule, nil
+}
+
+// Allows returns true if the rule matches a client and the key name its
+// request was signed with, which is empty for unsigned requests.
+func (r *TransferRule) Allows(client net.IP, key string) bool {
+	if len(r.Key) != 0 && !strings.EqualFold(r.Key, key) {
+		return false
+	}
+
+	return r.Network == nil || (client != nil && r.Network.Contains(client))
+}
+
+func (r *TransferRule) String() string {
+	key, network := "*", "*"
+
+	if len(r.Key) != 0 {
+		key = strings.TrimSuffix(r.Key, ".")
+	}
+	if r.Network != nil {
+		network = r.Network.String()
+	}
+
+	return key + "@" + network
+}
+
+// parseNetwork parses a CIDR or a single address.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+func isTransfer(qtype uint16) bool {
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
+
+// transfer answers an AXFR or IXFR request, returning the reply to send
+// and the zone, or a nil reply if the transfer was written to w.
+func (s *Server) transfer(w dns.ResponseWriter, r *dns.Msg) (*dns.Msg, string) {
+	q := r.Question[0]
+	zone := strings.ToLower(q.Name)
+	snapshot := state.Current()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	// Transfers of other zones are refused, as NOTAUTH signals a signature
+	// failure to clients using TSIG.
+	if !isAuthoritativeZone(snapshot, zone) {
+		m.Rcode = dns.RcodeRefused
+		return m, "."
+	}
+
+	if access := s.accessRule(w, snapshot); !access.Transfer || !access.AllowsZone(zone) {
+		return refuse(w, r, "transfer"), zone
+	}
+
+	var key string
+
+	if t := r.IsTsig(); t != nil {
+		if err := w.TsigStatus(); err != nil {
+			log.Printf("zone transfer of %s from %v has invalid signature: %v", zone, w.RemoteAddr(), err)
+			m.Rcode = dns.RcodeNotAuth
+			return m, zone
+		}
+
+		key = t.Hdr.Name
+	}
+
+	if !s.allowTransfer(clientIP(w.RemoteAddr()), key) {
+		log.Printf("zone transfer of %s refused for %v with key '%s'", zone, w.RemoteAddr(), key)
+		m.Rcode = dns.RcodeRefused
+		return m, zone
+	}
+
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		// An IXFR over UDP is answered with the current SOA, telling the
+		// client to retry over TCP if it is behind. AXFR requires TCP.
+		if q.Qtype == dns.TypeAXFR {
+			m.Rcode = dns.RcodeRefused
+			return m, zone
+		}
+
+		m.Authoritative = true
+		m.Answer = []dns.RR{snapshot.SOA(zone, s.TTL)}
+		return m, zone
+	}
+
+	rrs, ok := s.transferRecords(snapshot, zone, r)
+	if !ok {
+		m.Rcode = dns.RcodeFormatError
+		return m, zone
+	}
+
+	ch := make(chan *dns.Envelope)
+
+	go func() {
+		defer close(ch)
+
+		for len(rrs) != 0 {
+			n := transferChunkSize
+			if n > len(rrs) {
+				n = len(rrs)
+			}
+
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+	}()
+
+	if err := new(dns.Transfer).Out(w, r, ch); err != nil {
+		log.Printf("zone transfer of %s to %v failed: %v", zone, w.RemoteAddr(), err)
+
+		for range ch {
+		}
+	}
+
+	return nil, zone
+}
+
+func (s *Server) allowTransfer(client net.IP, key string) bool {
+	for _, rule := range s.TransferRules {
+		if rule.Allows(client, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transferRecords returns the records of a transfer. An IXFR is answered
+// with the changes since the client's serial if they are in the history,
+// as described in RFC 1995, and otherwise with the full zone like an AXFR.
+// Returns false if an IXFR has no SOA.
+func (s *Server) transferRecords(snapshot *state.Snapshot, zone string, r *dns.Msg) ([]dns.RR, bool) {
+	soa := snapshot.SOA(zone, s.TTL)
+
+	if r.Question[0].Qtype == dns.TypeIXFR {
+		if len(r.Ns) == 0 {
+			return nil, false
+		}
+
+		client, ok := r.Ns[0].(*dns.SOA)
+		if !ok {
+			return nil, false
+		}
+
+		if client.Serial == soa.Serial {
+			return []dns.RR{soa}, true
+		}
+
+		if changes, ok := snapshot.ZoneChanges(zone, client.Serial); ok {
+			rrs := []dns.RR{soa}
+
+			for _, change := range changes {
+				rrs = append(rrs, serialSOA(soa, change.From))
+				rrs = append(rrs, change.Removed...)
+				rrs = append(rrs, serialSOA(soa, change.To))
+				rrs = append(rrs, change.Added...)
+			}
+
+			return append(rrs, soa), true
+		}
+	}
+
+	rrs := []dns.RR{soa, snapshot.NS(zone, s.TTL)}
+
+	for _, record := range snapshot.ZoneRecords(zone, s.TTL) {
+		rrs = append(rrs, record.RR)
+	}
+
+	return append(rrs, soa), true
+}
+
+func serialSOA(soa *dns.SOA, serial uint32) *dns.SOA {
+	c := *soa
+	c.Serial = serial
+	return &c
+}
+
+func isAuthoritativeZone(snapshot *state.Snapshot, zone string) bool {
+	for _, z := range snapshot.AuthoritativeZones() {
+		if z == zone {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/dockertest"
+	"github.com/rakshasa/docker-container-dns/state"
+	"github.com/rakshasa/docker-container-dns/tsig"
+)
+
+const testSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+// startTCPServer serves s on a tcp port, returning its address.
+func startTCPServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	started := make(chan struct{})
+
+	srv := &dns.Server{
+		Listener:          l,
+		Handler:           s,
+		TsigSecret:        tsig.Secrets(s.TSIGKeys),
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go srv.ActivateAndServe()
+	<-started
+
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return l.Addr().String()
+}
+
+func mustParseKey(t *testing.T, value string) *tsig.Key {
+	key, err := tsig.ParseKey(value)
+	if err != nil {
+		t.Fatalf("could not parse tsig key '%s': %v", value, err)
+	}
+
+	return key
+}
+
+func TestParseTransferRule(t *testing.T) {
+	for value, expected := range map[string]string{
+		"xfr@10.0.0.0/8":  "xfr@10.0.0.0/8",
+		"XFR.@*":          "xfr@*",
+		"*@192.0.2.1":     "*@192.0.2.1/32",
+		"*@fd00::/64":     "*@fd00::/64",
+		"*@*":             "*@*",
+		"xfr@10.1.2.3/16": "xfr@10.1.0.0/16",
+	} {
+		rule, err := ParseTransferRule(value)
+		if err != nil {
+			t.Errorf("could not parse transfer rule '%s': %v", value, err)
+			continue
+		}
+		if rule.String() != expected {
+			t.Errorf("unexpected transfer rule for '%s': %s", value, rule)
+		}
+	}
+
+	for _, value := range []string{"xfr", "@10.0.0.0/8", "xfr@10.0.0.0/33", "xfr@example.com"} {
+		if _, err := ParseTransferRule(value); err == nil {
+			t.Errorf("expected error for transfer rule '%s'", value)
+		}
+	}
+}
+
+func TestServerTransfer(t *testing.T) {
+	key := mustParseKey(t, "xfr:"+testSecret)
+
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+	s.TSIGKeys = map[string]*tsig.Key{key.Name: key}
+	s.TransferRules = []*TransferRule{{Key: key.Name, Network: &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}}
+
+	addr := startTCPServer(t, s)
+	soa := state.Current().SOA("docker.", 30)
+
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("docker.")
+	key.Sign(axfr)
+
+	tr := &dns.Transfer{TsigSecret: tsig.Secrets(s.TSIGKeys)}
+
+	envelopes, err := tr.In(axfr, addr)
+	if err != nil {
+		t.Fatalf("could not start transfer: %v", err)
+	}
+
+	var types []uint16
+
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			t.Fatalf("transfer failed: %v", envelope.Error)
+		}
+		for _, rr := range envelope.RR {
+			types = append(types, rr.Header().Rrtype)
+		}
+	}
+
+	if len(types) != 3 || types[0] != dns.TypeSOA || types[1] != dns.TypeNS || types[2] != dns.TypeSOA {
+		t.Errorf("unexpected transfer record types: %v", types)
+	}
+
+	c := &dns.Client{Net: "tcp", TsigSecret: tsig.Secrets(s.TSIGKeys)}
+
+	ixfr := new(dns.Msg)
+	ixfr.SetIxfr("docker.", soa.Serial, soa.Ns, soa.Mbox)
+	key.Sign(ixfr)
+
+	if r, _, err := c.Exchange(ixfr, addr); err != nil || len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Serial != soa.Serial {
+		t.Errorf("expected up to date ixfr to be answered with the soa: %v %v", r, err)
+	}
+
+	for _, tc := range []struct {
+		zone   string
+		signed bool
+		rcode  int
+	}{
+		{"docker.", false, dns.RcodeRefused},
+		{"example.com.", true, dns.RcodeRefused},
+	} {
+		m := new(dns.Msg)
+		m.SetAxfr(tc.zone)
+		if tc.signed {
+			key.Sign(m)
+		}
+
+		if r, _, err := c.Exchange(m, addr); err != nil || r.Rcode != tc.rcode {
+			t.Errorf("unexpected reply to transfer of %s: %v %v", tc.zone, r, err)
+		}
+	}
+}
+
+func TestServerTransferMixedTTL(t *testing.T) {
+	cli := &dockertest.Client{}
+
+	backend := dockertest.Network("a000000000000000000000000000000000000000000000000000000000000001", "backend", "172.20.0.0/16")
+	cli.AddNetwork(backend)
+
+	first := publishTestState(t, cli)
+
+	// Replicas of a service share a name, with the lowest ttl of the
+	// replicas applying to the rrset.
+	for i, labels := range []map[string]string{
+		{state.ComposeProjectLabel: "shop", state.ComposeServiceLabel: "web"},
+		{state.ComposeProjectLabel: "shop", state.ComposeServiceLabel: "web", state.DNSTTLLabel: "10"},
+	} {
+		web := dockertest.Container(fmt.Sprintf("c%063x", i+1), fmt.Sprintf("shop_web_%d", i+1), labels)
+		dockertest.Connect(web, backend, fmt.Sprintf("172.20.0.%d", i+2), "")
+		cli.AddContainer(web)
+	}
+
+	snapshot := publishTestState(t, cli)
+	s := NewServer("127.0.0.1:0", "docker.", 30)
+
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("docker.")
+
+	ixfr := new(dns.Msg)
+	ixfr.SetIxfr("docker.", first.Serial("docker."), "ns.docker.", "hostmaster.docker.")
+
+	records := func(r *dns.Msg) []string {
+		rrs, ok := s.transferRecords(snapshot, "docker.", r)
+		if !ok {
+			t.Fatalf("could not get transfer records")
+		}
+
+		var names []string
+		for _, rr := range rrs {
+			if rr.Header().Name == "web.shop.docker." {
+				names = append(names, rr.String())
+			}
+		}
+
+		sort.Strings(names)
+		return names
+	}
+
+	full, incremental := records(axfr), records(ixfr)
+
+	if len(full) != 2 || strings.Join(full, "\n") != strings.Join(incremental, "\n") {
+		t.Errorf("expected ixfr and axfr to have the same records:\n%s\n\n%s", strings.Join(full, "\n"), strings.Join(incremental, "\n"))
+	}
+	if !strings.Contains(full[0], "\t10\tIN\t") {
+		t.Errorf("expected the lowest ttl of the replicas: %v", full)
+	}
+}
+
+func TestParseNotifyTarget(t *testing.T) {
+	keys := map[string]*tsig.Key{"xfr.": mustParseKey(t, "xfr:"+testSecret)}
+
+	for value, expected := range map[string]string{
+		"192.0.2.53":          "192.0.2.53:53",
+		"192.0.2.53:5353@xfr": "192.0.2.53:5353",
+		"fd00::53":            "[fd00::53]:53",
+		"[fd00::53]:5353":     "[fd00::53]:5353",
+	} {
+		target, err := ParseNotifyTarget(value, keys)
+		if err != nil || target.Addr != expected {
+			t.Errorf("unexpected notify target for '%s': %v %v", value, target, err)
+		}
+	}
+
+	for _, value := range []string{"ns.example.com", "192.0.2.53@unknown"} {
+		if _, err := ParseNotifyTarget(value, keys); err == nil {
+			t.Errorf("expected error for notify target '%s'", value)
+		}
+	}
+}
+
+func TestNotifierSend(t *testing.T) {
+	key := mustParseKey(t, "xfr:"+testSecret)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen for secondary: %v", err)
+	}
+
+	var mu sync.Mutex
+	var zones []string
+
+	started := make(chan struct{})
+
+	srv := &dns.Server{
+		PacketConn:        conn,
+		TsigSecret:        tsig.Secrets(map[string]*tsig.Key{key.Name: key}),
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+
+			if r.Opcode != dns.OpcodeNotify || r.IsTsig() == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeRefused
+			} else {
+				mu.Lock()
+				zones = append(zones, r.Question[0].Name)
+				mu.Unlock()
+
+				m.SetTsig(key.Name, key.Algorithm, tsig.Fudge, int64(r.IsTsig().TimeSigned))
+			}
+
+			w.WriteMsg(m)
+		}),
+	}
+
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	n := NewNotifier([]*NotifyTarget{{Addr: conn.LocalAddr().String(), Key: key}}, 30, 0)
+
+	for i := 0; i < 2; i++ {
+		if err := n.Send(state.Current()); err != nil {
+			t.Fatalf("could not send notify: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(zones) != 1 || zones[0] != "docker." {
+		t.Errorf("expected a single notify for unchanged serials: %v", zones)
+	}
+}
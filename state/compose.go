@@ -0,0 +1,26 @@
+package state
+
+const (
+	ComposeProjectLabel         = "com.docker.compose.project"
+	ComposeServiceLabel         = "com.docker.compose.service"
+	ComposeContainerNumberLabel = "com.docker.compose.container-number"
+)
+
+// ComposeNames returns the names of a container started by docker
+// compose, relative to the domain. The service name '<service>.<project>'
+// is shared by all replicas, while '<number>.<service>.<project>' only
+// refers to a single replica.
+func (e *ContainerEndpoint) ComposeNames() []string {
+	project, service := e.Labels[ComposeProjectLabel], e.Labels[ComposeServiceLabel]
+	if len(project) == 0 || len(service) == 0 {
+		return nil
+	}
+
+	names := []string{service + "." + project}
+
+	if number := e.Labels[ComposeContainerNumberLabel]; len(number) != 0 {
+		names = append(names, number+"."+service+"."+project)
+	}
+
+	return names
+}
@@ -4,42 +4,109 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
 )
 
 type Container struct {
 	Name        string
 	IPv4Address string
 	IPv6Address string
+
+	Labels map[string]string
+
+	// Running, Paused and Health are the last known state of the
+	// container. Health is empty if the container has no health check.
+	Running bool
+	Paused  bool
+	Health  string
+
+	// HealthPolicy is set with the 'dns.health' label, and overrides the
+	// default policy if not empty.
+	HealthPolicy string
+}
+
+func newContainer(name string, labels map[string]string) *Container {
+	container := &Container{
+		Name:   strings.TrimPrefix(name, "/"),
+		Labels: labels,
+	}
+
+	if value, ok := labels[DNSHealthLabel]; ok {
+		policy, err := ParseHealthPolicy(value)
+		if err != nil {
+			log.Printf("container %s has invalid dns labels: %s: %v", container.Name, DNSHealthLabel, err)
+		}
+
+		container.HealthPolicy = policy
+	}
+
+	return container
+}
+
+func newContainerFromInspect(containerInspect types.ContainerJSON) *Container {
+	var labels map[string]string
+	if containerInspect.Config != nil {
+		labels = containerInspect.Config.Labels
+	}
+
+	container := newContainer(containerInspect.Name, labels)
+	container.setState(containerInspect.State)
+
+	return container
+}
+
+func (c *Container) String() string {
+	v := c.Name
+
+	switch {
+	case c.Paused:
+		v += " paused"
+	case c.Running:
+		v += " running"
+	default:
+		v += " stopped"
+	}
+
+	if len(c.Health) != 0 {
+		v += " health:" + c.Health
+	}
+	if len(c.HealthPolicy) != 0 {
+		v += " policy:" + c.HealthPolicy
+	}
+
+	return v
 }
 
 type containerList struct {
+	*eventStream
+
 	Containers map[string]*Container
-	Msgs       <-chan events.Message
-	Errs       <-chan error
 }
 
-func NewContainerList(ctx context.Context, cli *client.Client) *containerList {
+// ContainerEventActions are the container events handled by the list,
+// and subscribed to by default.
+var ContainerEventActions = []string{
+	"create", "destroy", "start", "stop", "die", "kill", "oom", "pause", "unpause", "health_status",
+}
+
+// NewContainerList subscribes to the container events with the given
+// actions, which must be a subset of ContainerEventActions.
+func NewContainerList(ctx context.Context, cli DockerClient, actions []string) *containerList {
 	filter := filters.NewArgs()
 	filter.Add("type", events.ContainerEventType)
-	filter.Add("event", "create")
-	filter.Add("event", "destroy")
-	filter.Add("event", "start")
-	filter.Add("event", "stop")
 
-	msgs, errs := cli.Events(ctx, types.EventsOptions{
-		Filters: filter,
-	})
+	for _, action := range actions {
+		filter.Add("event", action)
+	}
 
 	return &containerList{
-		Containers: make(map[string]*Container),
-		Msgs:       msgs,
-		Errs:       errs,
+		eventStream: newEventStream(ctx, cli, "container", filter),
+		Containers:  make(map[string]*Container),
 	}
 }
 
@@ -47,11 +114,65 @@ func (m *containerList) PrintStatus() {
 	log.Printf("Containers:")
 
 	for id, container := range m.Containers {
-		log.Printf(" - %s: %s ipv4:%s ipv6:%s",
-			id, container.Name, container.IPv4Address, container.IPv6Address)
+		log.Printf(" - %s: %v: %v", id[:12], container, container.RecordStatus(HealthPolicy))
 	}
 }
 
+// Sync reconciles the list with the containers currently known by the
+// docker daemon. Running and paused containers are inspected to get their
+// health status.
+func (m *containerList) Sync(ctx context.Context) error {
+	cli, err := dockerClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("could not list containers: %v", err)
+	}
+
+	known := make(map[string]bool)
+
+	for _, container := range containers {
+		known[container.ID] = true
+
+		if len(container.Names) == 0 {
+			continue
+		}
+
+		if container.State != "running" && container.State != "paused" {
+			m.Containers[container.ID] = newContainer(container.Names[0], container.Labels)
+			continue
+		}
+
+		containerInspect, err := dockerContainerInspect(ctx, container.ID)
+		if err == errContainerNotFound {
+			delete(known, container.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("container sync could not inspect container %s, assuming it is running: %v", container.ID[:12], err)
+
+			c := newContainer(container.Names[0], container.Labels)
+			c.Running, c.Paused = true, container.State == "paused"
+			m.Containers[container.ID] = c
+			continue
+		}
+
+		m.Containers[container.ID] = newContainerFromInspect(containerInspect)
+	}
+
+	for id, container := range m.Containers {
+		if !known[id] {
+			delete(m.Containers, id)
+			log.Printf("removed stale container: %s", container.Name)
+		}
+	}
+
+	return nil
+}
+
 func (m *containerList) InsertWithMessage(containerId string, networkSettings *network.EndpointSettings) {
 	log.Printf("Inserting with message: %v", networkSettings)
 }
@@ -66,26 +187,35 @@ func (m *containerList) HandleEvent(ctx context.Context, msg events.Message) err
 		return fmt.Errorf("error, not a container event: %v", msg)
 	}
 
-	switch msg.Action {
+	// Health status events have the status appended to the action, e.g.
+	// 'health_status: healthy'.
+	action := eventAction(msg)
+
+	var err error
+
+	switch action {
 	case "create":
-		log.Printf("container->create: ID:%s %v", msg.Actor.ID, msg.Actor.Attributes)
-		return m.handleCreate(msg)
+		err = m.handleCreate(ctx, msg)
 	case "destroy":
-		log.Printf("container->destroy: ID:%s %v", msg.Actor.ID, msg.Actor.Attributes)
-		return m.handleDestroy(msg)
-	case "start":
-		log.Printf("container->start: ID:%s %v", msg.Actor.ID, msg.Actor.Attributes)
-		return nil
-	case "stop":
-		log.Printf("container->stop: ID:%s %v", msg.Actor.ID, msg.Actor.Attributes)
-		return nil
+		err = m.handleDestroy(msg)
+	case "start", "stop", "die", "kill", "oom", "pause", "unpause", "health_status":
+		err = m.handleStateChange(ctx, action, msg)
 	default:
-		log.Printf("unknown container message: %s", msg)
+		log.Printf("unknown container message: %v", msg)
+		observeEventHandled(msg, fmt.Errorf("unhandled container event"))
 		return fmt.Errorf("unhandled container event: %v", msg)
 	}
+
+	observeEventHandled(msg, err)
+
+	if err != nil {
+		log.Printf("container %s handler error: %v", action, err)
+	}
+
+	return nil
 }
 
-func (m *containerList) handleCreate(msg events.Message) error{
+func (m *containerList) handleCreate(ctx context.Context, msg events.Message) error {
 	id, name := msg.Actor.ID, msg.Actor.Attributes["name"]
 	if len(id) == 0 {
 		return fmt.Errorf("container create event message is missing id: %s", name)
@@ -101,14 +231,19 @@ func (m *containerList) handleCreate(msg events.Message) error{
 
 	log.Printf("container->create: adding container: %s", name)
 
-	m.Containers[id] = &Container{
-		Name: name,
+	containerInspect, err := dockerContainerInspect(ctx, id)
+	if err != nil {
+		log.Printf("could not inspect created container, adding without labels: %s: %v", name, err)
+
+		m.Containers[id] = newContainer(name, nil)
+		return nil
 	}
 
+	m.Containers[id] = newContainerFromInspect(containerInspect)
 	return nil
 }
 
-func (m *containerList) handleDestroy(msg events.Message) error{
+func (m *containerList) handleDestroy(msg events.Message) error {
 	id, name := msg.Actor.ID, msg.Actor.Attributes["name"]
 	if len(id) == 0 {
 		return fmt.Errorf("container destroy event message is missing id: %s", name)
@@ -128,3 +263,60 @@ func (m *containerList) handleDestroy(msg events.Message) error{
 
 	return nil
 }
+
+// handleStateChange updates the running, paused and health state of a
+// container. Unknown containers are inspected and added, as they may have
+// been created while the event stream was reconnecting.
+func (m *containerList) handleStateChange(ctx context.Context, action string, msg events.Message) error {
+	id := msg.Actor.ID
+	if len(id) == 0 {
+		return fmt.Errorf("container %s event message is missing id", action)
+	}
+
+	container, exists := m.Containers[id]
+	if !exists {
+		containerInspect, err := dockerContainerInspect(ctx, id)
+		if err != nil {
+			return fmt.Errorf("could not inspect unknown container %s: %v", id[:12], err)
+		}
+
+		container = newContainerFromInspect(containerInspect)
+		m.Containers[id] = container
+
+		log.Printf("container->%s: added unknown container: %v", action, container)
+		return nil
+	}
+
+	previous := container.RecordStatus(HealthPolicy)
+
+	switch action {
+	case "start":
+		container.Running, container.Paused = true, false
+
+		// Docker restarts the health check of a restarted container.
+		if len(container.Health) != 0 {
+			container.Health = types.Starting
+		}
+	case "stop", "die":
+		container.Running, container.Paused = false, false
+	case "pause":
+		container.Paused = true
+	case "unpause":
+		container.Paused = false
+	case "health_status":
+		parts := strings.SplitN(msg.Action, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[1])) == 0 {
+			return fmt.Errorf("container health_status event message is missing status: %s", container.Name)
+		}
+
+		container.Health = strings.TrimSpace(parts[1])
+	case "kill", "oom":
+		// The container only stopped if followed by a die event.
+	}
+
+	if status := container.RecordStatus(HealthPolicy); status != previous {
+		log.Printf("container->%s: records of %s are now %v", action, container.Name, status)
+	}
+
+	return nil
+}
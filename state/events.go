@@ -0,0 +1,127 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	eventStreamMinBackoff = 500 * time.Millisecond
+	eventStreamMaxBackoff = 30 * time.Second
+)
+
+// eventStream is a docker event subscription that reconnects with
+// exponential backoff when the stream breaks, resuming from the time of
+// the last received event.
+//
+// Errors are not fatal and are only reported for logging. After a
+// reconnect a value is sent on Resyncs, as events may have been lost and
+// the state needs to be reconciled with the docker api.
+type eventStream struct {
+	Msgs    <-chan events.Message
+	Errs    <-chan error
+	Resyncs <-chan struct{}
+
+	name    string
+	filter  filters.Args
+	msgs    chan events.Message
+	errs    chan error
+	resyncs chan struct{}
+}
+
+func newEventStream(ctx context.Context, cli DockerClient, name string, filter filters.Args) *eventStream {
+	msgs := make(chan events.Message)
+	errs := make(chan error, 1)
+	resyncs := make(chan struct{}, 1)
+
+	s := &eventStream{
+		Msgs:    msgs,
+		Errs:    errs,
+		Resyncs: resyncs,
+		name:    name,
+		filter:  filter,
+		msgs:    msgs,
+		errs:    errs,
+		resyncs: resyncs,
+	}
+
+	go s.run(ctx, cli)
+
+	return s
+}
+
+func (s *eventStream) run(ctx context.Context, cli DockerClient) {
+	since := time.Now().UnixNano()
+	backoff := eventStreamMinBackoff
+
+	for {
+		connected := time.Now()
+
+		msgs, errs := cli.Events(ctx, types.EventsOptions{
+			Since:   fmt.Sprintf("%d.%09d", since/int64(time.Second), since%int64(time.Second)),
+			Filters: s.filter,
+		})
+
+		err := s.forward(ctx, msgs, errs, &since)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(connected) > eventStreamMaxBackoff {
+			backoff = eventStreamMinBackoff
+		}
+
+		s.reportError(fmt.Errorf("%s event stream broken, reconnecting in %v: %v", s.name, backoff, err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff *= 2; backoff > eventStreamMaxBackoff {
+			backoff = eventStreamMaxBackoff
+		}
+
+		eventStreamReconnects.WithLabelValues(s.name).Inc()
+
+		select {
+		case s.resyncs <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// forward passes messages on until the stream returns an error, updating
+// since with the timestamp of each message.
+func (s *eventStream) forward(ctx context.Context, msgs <-chan events.Message, errs <-chan error, since *int64) error {
+	for {
+		select {
+		case msg := <-msgs:
+			observeEventReceived(msg)
+
+			select {
+			case s.msgs <- msg:
+				*since = msg.TimeNano
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (s *eventStream) reportError(err error) {
+	select {
+	case s.errs <- err:
+	default:
+		log.Printf("dropped %s event stream error: %v", s.name, err)
+	}
+}
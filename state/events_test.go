@@ -0,0 +1,97 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/rakshasa/docker-container-dns/dockertest"
+)
+
+func TestEventStreamReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var calls []time.Time
+	var options []types.EventsOptions
+
+	received := time.Now().Add(-time.Minute).UnixNano()
+
+	// The first stream delivers an event and breaks, the second breaks
+	// immediately and the third stays connected.
+	cli := &dockertest.Client{
+		EventsFunc: func(ctx context.Context, opts types.EventsOptions) (<-chan events.Message, <-chan error) {
+			mu.Lock()
+			calls = append(calls, time.Now())
+			options = append(options, opts)
+			n := len(calls)
+			mu.Unlock()
+
+			msgs, errs := make(chan events.Message), make(chan error, 1)
+
+			go func() {
+				switch n {
+				case 1:
+					msgs <- events.Message{Type: events.NetworkEventType, Action: "create", TimeNano: received}
+					errs <- errors.New("unexpected EOF")
+				case 2:
+					errs <- errors.New("connection refused")
+				default:
+					<-ctx.Done()
+					errs <- ctx.Err()
+				}
+			}()
+
+			return msgs, errs
+		},
+	}
+
+	s := newEventStream(ctx, cli, "network", filters.NewArgs())
+
+	select {
+	case msg := <-s.Msgs:
+		if msg.TimeNano != received {
+			t.Errorf("unexpected event: %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-s.Resyncs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no resync signalled after reconnect %d", i+1)
+		}
+	}
+
+	if err := <-s.Errs; err == nil {
+		t.Errorf("expected broken stream to be reported")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(calls) != 3 {
+		t.Fatalf("expected three connections: %d", len(calls))
+	}
+
+	if first, second := calls[1].Sub(calls[0]), calls[2].Sub(calls[1]); first < eventStreamMinBackoff || second < 2*eventStreamMinBackoff {
+		t.Errorf("expected exponential backoff between reconnects: %v %v", first, second)
+	}
+
+	since := fmt.Sprintf("%d.%09d", received/int64(time.Second), received%int64(time.Second))
+
+	for _, opts := range options[1:] {
+		if opts.Since != since {
+			t.Errorf("expected reconnect to resume from the last event %s: %s", since, opts.Since)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	// HealthPolicyIgnore always publishes the container's records.
+	HealthPolicyIgnore = "ignore"
+	// HealthPolicyRunning withholds the records of containers that are
+	// not running or are paused.
+	HealthPolicyRunning = "running"
+	// HealthPolicyHealthy also withholds the records of running containers
+	// with a health check that is not healthy, including while it is
+	// starting.
+	HealthPolicyHealthy = "healthy"
+)
+
+// HealthPolicy is the policy used for containers without a 'dns.health'
+// label.
+var HealthPolicy = HealthPolicyHealthy
+
+// RecordStatus is whether the records of a container are served, and why.
+type RecordStatus struct {
+	Serving bool
+	Reason  string
+}
+
+func (r RecordStatus) String() string {
+	if r.Serving {
+		return "serving (" + r.Reason + ")"
+	}
+
+	return "withheld (" + r.Reason + ")"
+}
+
+// ParseHealthPolicy parses a health policy name.
+func ParseHealthPolicy(value string) (string, error) {
+	switch policy := strings.ToLower(strings.TrimSpace(value)); policy {
+	case HealthPolicyIgnore, HealthPolicyRunning, HealthPolicyHealthy:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid health policy, must be '%s', '%s' or '%s': %s",
+			HealthPolicyIgnore, HealthPolicyRunning, HealthPolicyHealthy, value)
+	}
+}
+
+// setState updates the container's state from an inspect of the
+// container.
+func (c *Container) setState(containerState *types.ContainerState) {
+	if containerState == nil {
+		return
+	}
+
+	c.Running = containerState.Running
+	c.Paused = containerState.Paused
+	c.Health = ""
+
+	if containerState.Health != nil && containerState.Health.Status != types.NoHealthcheck {
+		c.Health = containerState.Health.Status
+	}
+}
+
+// RecordStatus returns whether the container's records are served
+// according to its health policy, using defaultPolicy if the container has
+// none.
+func (c *Container) RecordStatus(defaultPolicy string) RecordStatus {
+	policy := c.HealthPolicy
+	if len(policy) == 0 {
+		policy = defaultPolicy
+	}
+
+	switch {
+	case policy == HealthPolicyIgnore:
+		return RecordStatus{Serving: true, Reason: "health policy ignore"}
+	case !c.Running:
+		return RecordStatus{Serving: false, Reason: "not running"}
+	case c.Paused:
+		return RecordStatus{Serving: false, Reason: "paused"}
+	case policy != HealthPolicyHealthy || len(c.Health) == 0:
+		return RecordStatus{Serving: true, Reason: "running"}
+	case c.Health == types.Healthy:
+		return RecordStatus{Serving: true, Reason: "healthy"}
+	default:
+		return RecordStatus{Serving: false, Reason: "health " + c.Health}
+	}
+}
@@ -0,0 +1,204 @@
+package state
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DNSNamesLabel    = "dns.names"
+	DNSTTLLabel      = "dns.ttl"
+	DNSExcludeLabel  = "dns.exclude"
+	DNSNetworksLabel = "dns.networks"
+	DNSZoneLabel     = "dns.zone"
+	DNSDisableLabel  = "dns.disable"
+	DNSHealthLabel   = "dns.health"
+	DNSServicesLabel = "dns.services"
+)
+
+// DNSConfig is the dns configuration of a container, set with 'dns.*'
+// container labels.
+type DNSConfig struct {
+	// Names are extra names of the container. Names without a trailing dot
+	// are relative to the zone.
+	Names []string
+	// TTL overrides the default ttl of the container's records if not
+	// zero.
+	TTL uint32
+	// Exclude hides the container, no names are published.
+	Exclude bool
+	// Networks restricts the networks, by name, the container's names are
+	// published for.
+	Networks []string
+	// Zone the container's unqualified names are published in instead of
+	// the domain. Network scoped names are always published in the zone
+	// of the network.
+	Zone string
+	// Services are symbolic names of container ports, published as SRV
+	// records.
+	Services []Port
+}
+
+// NetworkDNSConfig is the dns configuration of a network, set with 'dns.*'
+// network labels.
+type NetworkDNSConfig struct {
+	// Zone the network's names are published in instead of
+	// '<network>.<domain>'.
+	Zone string
+	// Disable hides the network, no names or reverse zones are published.
+	Disable bool
+}
+
+// parseDNSConfig parses the dns labels of a container. Invalid labels are
+// reported as an error while the remaining labels are still used.
+func parseDNSConfig(labels map[string]string) (DNSConfig, error) {
+	var config DNSConfig
+	var errs []string
+
+	if value, ok := labels[DNSNamesLabel]; ok {
+		for _, name := range splitLabelList(value) {
+			if _, ok := dns.IsDomainName(name); !ok {
+				errs = append(errs, fmt.Sprintf("%s: invalid name '%s'", DNSNamesLabel, name))
+				continue
+			}
+
+			config.Names = append(config.Names, strings.ToLower(name))
+		}
+	}
+
+	if value, ok := labels[DNSTTLLabel]; ok {
+		ttl, err := strconv.ParseUint(strings.TrimSpace(value), 10, 31)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid ttl '%s'", DNSTTLLabel, value))
+		} else {
+			config.TTL = uint32(ttl)
+		}
+	}
+
+	if value, ok := labels[DNSExcludeLabel]; ok {
+		exclude, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid boolean '%s'", DNSExcludeLabel, value))
+		} else {
+			config.Exclude = exclude
+		}
+	}
+
+	if value, ok := labels[DNSNetworksLabel]; ok {
+		config.Networks = splitLabelList(value)
+	}
+
+	if value, ok := labels[DNSZoneLabel]; ok {
+		zone, err := parseZoneLabel(value)
+		switch {
+		case err != nil:
+			errs = append(errs, err.Error())
+		case !containerZoneAllowed(zone):
+			errs = append(errs, fmt.Sprintf("%s: zone '%s' is not within the domain or a search zone", DNSZoneLabel, zone))
+		default:
+			config.Zone = zone
+		}
+	}
+
+	if value, ok := labels[DNSServicesLabel]; ok {
+		services, err := parseServicesLabel(value)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		config.Services = services
+	}
+
+	if len(errs) != 0 {
+		return config, fmt.Errorf("invalid dns labels: %s", strings.Join(errs, ", "))
+	}
+
+	return config, nil
+}
+
+// parseNetworkDNSConfig parses the dns labels of a network. Invalid labels
+// are reported as an error while the remaining labels are still used.
+func parseNetworkDNSConfig(labels map[string]string) (NetworkDNSConfig, error) {
+	var config NetworkDNSConfig
+	var errs []string
+
+	if value, ok := labels[DNSZoneLabel]; ok {
+		zone, err := parseZoneLabel(value)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			config.Zone = zone
+		}
+	}
+
+	if value, ok := labels[DNSDisableLabel]; ok {
+		disable, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid boolean '%s'", DNSDisableLabel, value))
+		} else {
+			config.Disable = disable
+		}
+	}
+
+	if len(errs) != 0 {
+		return config, fmt.Errorf("invalid dns labels: %s", strings.Join(errs, ", "))
+	}
+
+	return config, nil
+}
+
+func parseZoneLabel(value string) (string, error) {
+	zone := strings.TrimSpace(value)
+
+	if _, ok := dns.IsDomainName(zone); !ok || len(zone) == 0 || zone == "." {
+		return "", fmt.Errorf("%s: invalid zone '%s'", DNSZoneLabel, value)
+	}
+
+	return dns.Fqdn(strings.ToLower(zone)), nil
+}
+
+// containerZoneAllowed returns true if a container may publish its names
+// in zone, which must be within the domain or one of the search zones so
+// containers cannot take over zones that should be forwarded.
+func containerZoneAllowed(zone string) bool {
+	for _, allowed := range append([]string{Domain}, SearchZones...) {
+		if dns.IsSubDomain(dns.Fqdn(strings.ToLower(allowed)), zone) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PublishedOn returns true if the container's names are published for
+// the network.
+func (c *DNSConfig) PublishedOn(networkName string) bool {
+	if c.Exclude {
+		return false
+	}
+	if len(c.Networks) == 0 {
+		return true
+	}
+
+	for _, name := range c.Networks {
+		if strings.EqualFold(name, networkName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitLabelList(value string) []string {
+	var values []string
+
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
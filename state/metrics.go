@@ -0,0 +1,106 @@
+package state
+
+import (
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "docker_container_dns"
+
+var (
+	eventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_events_received_total",
+		Help:      "Docker events received from the event streams.",
+	}, []string{"type", "action"})
+
+	eventsHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_events_handled_total",
+		Help:      "Docker events handled successfully.",
+	}, []string{"type", "action"})
+
+	eventsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_events_failed_total",
+		Help:      "Docker events that failed to be handled.",
+	}, []string{"type", "action"})
+
+	eventStreamReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_event_stream_reconnects_total",
+		Help:      "Reconnects of the docker event streams.",
+	}, []string{"stream"})
+
+	dockerRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_api_request_duration_seconds",
+		Help:      "Latency of docker api requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		eventsReceived,
+		eventsHandled,
+		eventsFailed,
+		eventStreamReconnects,
+		dockerRequestDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "networks",
+			Help:      "Networks in the current state snapshot.",
+		}, func() float64 {
+			return float64(len(Current().Networks))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "endpoints",
+			Help:      "Container endpoints in the current state snapshot.",
+		}, func() float64 {
+			var endpoints int
+			for _, nw := range Current().Networks {
+				endpoints += len(nw.ContainerEndpoints)
+			}
+			return float64(endpoints)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "records",
+			Help:      "Records generated from the current state snapshot.",
+		}, func() float64 {
+			return float64(Current().RecordCount())
+		}),
+	)
+}
+
+// eventAction returns the action of an event without the status appended
+// to health status actions, keeping the action label bounded.
+func eventAction(msg events.Message) string {
+	return strings.TrimSpace(strings.SplitN(msg.Action, ":", 2)[0])
+}
+
+func observeEventReceived(msg events.Message) {
+	eventsReceived.WithLabelValues(msg.Type, eventAction(msg)).Inc()
+}
+
+func observeEventHandled(msg events.Message, err error) {
+	if err != nil {
+		eventsFailed.WithLabelValues(msg.Type, eventAction(msg)).Inc()
+	} else {
+		eventsHandled.WithLabelValues(msg.Type, eventAction(msg)).Inc()
+	}
+}
+
+func observeDockerRequest(call string, started time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	dockerRequestDuration.WithLabelValues(call, result).Observe(time.Since(started).Seconds())
+}
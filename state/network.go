@@ -4,18 +4,37 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
+	"reflect"
+	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/network"
 )
 
 type ContainerEndpoint struct {
+	NetworkID     string
 	ContainerID   string
 	ContainerName string
 	IPv4Address   string
 	IPv6Address   string
+
+	// Aliases and link aliases are only valid on the network of the
+	// endpoint. Links are in the 'container:alias' format, naming the
+	// linked container and the alias it is known as by this container.
+	Aliases    []string
+	Links      []string
+	Hostname   string
+	Domainname string
+
+	// Ports are the exposed and published container ports, which are
+	// reachable on the addresses of every endpoint of the container.
+	Ports []Port
+
+	Labels map[string]string
+	DNS    DNSConfig
 }
 
 func (e *ContainerEndpoint) String() string {
@@ -27,18 +46,65 @@ func (e *ContainerEndpoint) String() string {
 	if len(e.IPv6Address) != 0 {
 		v += " "+e.IPv6Address
 	}
+	if len(e.Aliases) != 0 {
+		v += " aliases:" + strings.Join(e.Aliases, ",")
+	}
+	if len(e.Links) != 0 {
+		v += " links:" + strings.Join(e.Links, ",")
+	}
+	if fqdn := e.FQDN(); len(fqdn) != 0 {
+		v += " hostname:" + fqdn
+	}
+	if len(e.Ports) != 0 {
+		var ports []string
+		for _, port := range e.Ports {
+			ports = append(ports, port.String())
+		}
+
+		v += " ports:" + strings.Join(ports, ",")
+	}
 
 	return v
 }
 
+// FQDN returns the configured hostname of the container, qualified with
+// the configured domain name if set.
+func (e *ContainerEndpoint) FQDN() string {
+	if len(e.Hostname) == 0 || len(e.Domainname) == 0 {
+		return e.Hostname
+	}
+
+	return e.Hostname + "." + e.Domainname
+}
+
 type Network struct {
 	ID                 string
 	Name               string
+	Subnets            []*net.IPNet
+	Gateways           []net.IP
+	Labels             map[string]string
+	DNS                NetworkDNSConfig
 	ContainerEndpoints map[string]*ContainerEndpoint
 }
 
 func (n *Network) String() string {
-	return fmt.Sprintf("id:%s name:%s", n.ID[:12], n.Name)
+	v := fmt.Sprintf("id:%s name:%s", n.ID[:12], n.Name)
+
+	for _, subnet := range n.Subnets {
+		v += " " + subnet.String()
+	}
+
+	return v
+}
+
+func (n *Network) isGateway(ip net.IP) bool {
+	for _, gateway := range n.Gateways {
+		if gateway.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (n *Network) CompactString() string {
@@ -46,27 +112,28 @@ func (n *Network) CompactString() string {
 }
 
 type networkList struct {
+	*eventStream
+
 	Networks map[string]*Network
-	Msgs     <-chan events.Message
-	Errs     <-chan error
 }
 
-func NewNetworkList(ctx context.Context, cli *client.Client) *networkList {
+// NetworkEventActions are the network events handled by the list, and
+// subscribed to by default.
+var NetworkEventActions = []string{"create", "destroy", "connect", "disconnect"}
+
+// NewNetworkList subscribes to the network events with the given actions,
+// which must be a subset of NetworkEventActions.
+func NewNetworkList(ctx context.Context, cli DockerClient, actions []string) *networkList {
 	filter := filters.NewArgs()
 	filter.Add("type", events.NetworkEventType)
-	filter.Add("event", "create")
-	filter.Add("event", "destroy")
-	filter.Add("event", "connect")
-	filter.Add("event", "disconnect")
 
-	msgs, errs := cli.Events(ctx, types.EventsOptions{
-		Filters: filter,
-	})
+	for _, action := range actions {
+		filter.Add("event", action)
+	}
 
 	return &networkList{
-		Networks: make(map[string]*Network),
-		Msgs:     msgs,
-		Errs:     errs,
+		eventStream: newEventStream(ctx, cli, "network", filter),
+		Networks:    make(map[string]*Network),
 	}
 }
 
@@ -93,7 +160,7 @@ func (m *networkList) HandleEvent(ctx context.Context, msg events.Message) error
 	switch msg.Action {
 	case "create":
 		// log.Printf("network->create: ID:%s %v", msg.Actor.ID, msg.Actor.Attributes)
-		err = m.handleCreate(msg)
+		err = m.handleCreate(ctx, msg)
 	case "destroy":
 		// log.Printf("network->destroy: ID:%s %v", msg.Actor.ID, msg.Actor.Attributes)
 		err = m.handleDestroy(msg)
@@ -105,6 +172,8 @@ func (m *networkList) HandleEvent(ctx context.Context, msg events.Message) error
 		err = m.handleDisconnect(msg)
 	}
 
+	observeEventHandled(msg, err)
+
 	if err != nil {
 		log.Printf("network %s handler error: %v", msg.Action, err)
 	}
@@ -112,25 +181,29 @@ func (m *networkList) HandleEvent(ctx context.Context, msg events.Message) error
 	return nil
 }
 
-func (m *networkList) handleCreate(msg events.Message) error {
+func (m *networkList) handleCreate(ctx context.Context, msg events.Message) error {
 	networkID, networkName := msg.Actor.ID, msg.Actor.Attributes["name"]
 
 	if len(networkName) == 0 {
 		return fmt.Errorf("message does not contains a valid network name")
 	}
 
-	if _, exists := m.Networks[networkID]; exists {
-		return fmt.Errorf("skipping already known network: %s", networkName)
+	if nw, exists := m.Networks[networkID]; exists {
+		log.Printf("skipping already known network: %v", nw)
+		return nil
 	}
 
-	nw := &Network{
-		ID:                 networkID,
-		Name:               networkName,
-		ContainerEndpoints: make(map[string]*ContainerEndpoint),
+	networkInspect, err := dockerNetworkInspect(ctx, networkID)
+	if err != nil {
+		log.Printf("could not inspect created network, adding without subnets: %s: %v", networkName, err)
+
+		networkInspect = types.NetworkResource{
+			ID:   networkID,
+			Name: networkName,
+		}
 	}
-	m.Networks[networkID] = nw
 
-	log.Printf("added network: %v", nw)
+	m.addNetwork(networkInspect)
 	return nil
 }
 
@@ -159,22 +232,15 @@ func (m *networkList) handleConnect(ctx context.Context, msg events.Message) err
 
 	nw, exists := m.Networks[networkID]
 	if !exists {
-		return fmt.Errorf("could not find network id: %s", networkID[:12])
-	}
+		networkInspect, err := dockerNetworkInspect(ctx, networkID)
+		if err != nil {
+			return fmt.Errorf("could not find network id: %s: %v", networkID[:12], err)
+		}
 
-	if _, exists := nw.ContainerEndpoints[containerID]; exists {
-		return fmt.Errorf("container id already exists on network '%s': %s", nw.CompactString(), networkID[:12])
+		nw = m.addNetwork(networkInspect)
 	}
 
-	endpoint := &ContainerEndpoint{
-		ContainerID:   containerID,
-		ContainerName: containerInspect.Name,
-		IPv4Address:   networkEndpoint.IPAddress,
-		IPv6Address:   networkEndpoint.GlobalIPv6Address,
-	}
-	nw.ContainerEndpoints[containerID] = endpoint
-
-	log.Printf("container connected to network '%s': %v", nw.CompactString(), endpoint)
+	m.addEndpoint(nw, containerInspect, networkEndpoint)
 	return nil
 }
 
@@ -196,3 +262,201 @@ func (m *networkList) handleDisconnect(msg events.Message) error {
 	log.Printf("container disconnected from network '%s': %v", nw.CompactString(), endpoint)
 	return nil
 }
+
+// Sync reconciles the list with the networks and container endpoints
+// currently known by the docker daemon. Networks and endpoints already in
+// the list are updated and those no longer known are removed, so events
+// received during or after the sync can be applied as usual.
+func (m *networkList) Sync(ctx context.Context) error {
+	cli, err := dockerClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list networks: %v", err)
+	}
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("could not list containers: %v", err)
+	}
+
+	knownNetworks := make(map[string]bool)
+	knownEndpoints := make(map[string]map[string]bool)
+
+	for _, networkResource := range networks {
+		knownNetworks[networkResource.ID] = true
+		knownEndpoints[networkResource.ID] = make(map[string]bool)
+
+		if nw, exists := m.Networks[networkResource.ID]; exists {
+			m.updateNetwork(nw, networkResource)
+		} else {
+			m.addNetwork(networkResource)
+		}
+	}
+
+	for _, container := range containers {
+		containerInspect, err := dockerContainerInspect(ctx, container.ID)
+		if err == errContainerNotFound {
+			log.Printf("network sync skipping removed container %s", container.ID[:12])
+			continue
+		}
+		if err != nil {
+			// The endpoints are kept until docker reports the container
+			// is gone, so a failed inspect does not remove its records.
+			log.Printf("network sync keeping endpoints of container %s: %v", container.ID[:12], err)
+
+			for _, nw := range m.Networks {
+				if _, exists := nw.ContainerEndpoints[container.ID]; exists && knownEndpoints[nw.ID] != nil {
+					knownEndpoints[nw.ID][container.ID] = true
+				}
+			}
+			continue
+		}
+
+		// Docker disconnects stopped containers from their networks, while
+		// created and paused containers keep their endpoints.
+		if containerInspect.State != nil && (containerInspect.State.Status == "exited" || containerInspect.State.Status == "dead") {
+			continue
+		}
+
+		for _, networkEndpoint := range containerInspect.NetworkSettings.Networks {
+			nw, exists := m.Networks[networkEndpoint.NetworkID]
+			if !exists {
+				log.Printf("network sync skipping container %s endpoint on unknown network: %s", container.ID[:12], networkEndpoint.NetworkID[:12])
+				continue
+			}
+
+			knownEndpoints[nw.ID][containerInspect.ID] = true
+			m.addEndpoint(nw, containerInspect, networkEndpoint)
+		}
+	}
+
+	for networkID, nw := range m.Networks {
+		if !knownNetworks[networkID] {
+			delete(m.Networks, networkID)
+			log.Printf("removed stale network: %v", nw)
+			continue
+		}
+
+		for containerID, endpoint := range nw.ContainerEndpoints {
+			if !knownEndpoints[networkID][containerID] {
+				delete(nw.ContainerEndpoints, containerID)
+				log.Printf("removed stale container endpoint from network '%s': %v", nw.CompactString(), endpoint)
+			}
+		}
+	}
+
+	log.Printf("network sync found %d networks and %d containers", len(networks), len(containers))
+	return nil
+}
+
+func (m *networkList) addNetwork(networkResource types.NetworkResource) *Network {
+	nw := newNetwork(networkResource)
+	m.Networks[nw.ID] = nw
+
+	log.Printf("added network: %v", nw)
+	return nw
+}
+
+// updateNetwork replaces the name, labels, subnets and dns config of a
+// known network, keeping its endpoints.
+func (m *networkList) updateNetwork(nw *Network, networkResource types.NetworkResource) {
+	updated := newNetwork(networkResource)
+	updated.ContainerEndpoints = nw.ContainerEndpoints
+
+	m.Networks[nw.ID] = updated
+
+	if updated.String() != nw.String() || !reflect.DeepEqual(updated.Labels, nw.Labels) {
+		log.Printf("updated network: %v", updated)
+	}
+}
+
+func newNetwork(networkResource types.NetworkResource) *Network {
+	nw := &Network{
+		ID:                 networkResource.ID,
+		Name:               networkResource.Name,
+		Labels:             networkResource.Labels,
+		ContainerEndpoints: make(map[string]*ContainerEndpoint),
+	}
+
+	dnsConfig, err := parseNetworkDNSConfig(nw.Labels)
+	if err != nil {
+		log.Printf("network '%s' has %v", nw.CompactString(), err)
+	}
+	nw.DNS = dnsConfig
+
+	for _, config := range networkResource.IPAM.Config {
+		if len(config.Subnet) == 0 {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(config.Subnet)
+		if err != nil {
+			log.Printf("skipping invalid subnet on network '%s': %v", nw.CompactString(), err)
+			continue
+		}
+
+		nw.Subnets = append(nw.Subnets, subnet)
+
+		if gateway := net.ParseIP(config.Gateway); gateway != nil {
+			nw.Gateways = append(nw.Gateways, gateway)
+		}
+	}
+
+	return nw
+}
+
+// addEndpoint adds or replaces the container's endpoint on the network.
+func (m *networkList) addEndpoint(nw *Network, containerInspect types.ContainerJSON, networkEndpoint *network.EndpointSettings) {
+	endpoint := &ContainerEndpoint{
+		NetworkID:     nw.ID,
+		ContainerID:   containerInspect.ID,
+		ContainerName: strings.TrimPrefix(containerInspect.Name, "/"),
+		IPv4Address:   networkEndpoint.IPAddress,
+		IPv6Address:   networkEndpoint.GlobalIPv6Address,
+		Links:         networkEndpoint.Links,
+	}
+
+	shortID := endpoint.ContainerID
+	if len(shortID) > 12 {
+		shortID = shortID[:12]
+	}
+
+	for _, alias := range networkEndpoint.Aliases {
+		// Docker adds the short container id as an alias on user defined
+		// networks, which would only clutter the name index.
+		if alias == endpoint.ContainerName || alias == shortID {
+			continue
+		}
+
+		endpoint.Aliases = append(endpoint.Aliases, alias)
+	}
+
+	if containerInspect.Config != nil {
+		// Docker sets the hostname to the short container id unless
+		// configured, which is skipped like the alias.
+		if hostname := containerInspect.Config.Hostname; hostname != shortID {
+			endpoint.Hostname = hostname
+		}
+		endpoint.Domainname = containerInspect.Config.Domainname
+		endpoint.Labels = containerInspect.Config.Labels
+	}
+
+	dnsConfig, err := parseDNSConfig(endpoint.Labels)
+	if err != nil {
+		log.Printf("container %s on network '%s' has %v", endpoint.ContainerName, nw.CompactString(), err)
+	}
+	endpoint.DNS = dnsConfig
+	endpoint.Ports = containerPorts(containerInspect, dnsConfig.Services)
+
+	if _, exists := nw.ContainerEndpoints[endpoint.ContainerID]; exists {
+		log.Printf("container endpoint updated on network '%s': %v", nw.CompactString(), endpoint)
+	} else {
+		log.Printf("container connected to network '%s': %v", nw.CompactString(), endpoint)
+	}
+
+	nw.ContainerEndpoints[endpoint.ContainerID] = endpoint
+}
@@ -0,0 +1,182 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+	"github.com/miekg/dns"
+)
+
+// Port is a container port that service records are published for.
+// Service is the symbolic service name of the port, set with the
+// 'dns.services' label.
+type Port struct {
+	Number  uint16
+	Proto   string
+	Service string
+}
+
+func (p Port) String() string {
+	v := fmt.Sprintf("%d/%s", p.Number, p.Proto)
+
+	if len(p.Service) != 0 {
+		v = p.Service + "=" + v
+	}
+
+	return v
+}
+
+// ServiceRecord is the target of an SRV record, the container port on the
+// address of an endpoint.
+type ServiceRecord struct {
+	Endpoint *ContainerEndpoint
+	Port     Port
+	Target   string
+}
+
+// parseServicesLabel parses symbolic service names in the
+// 'name=port[/proto][,...]' format.
+func parseServicesLabel(value string) ([]Port, error) {
+	var ports []Port
+
+	for _, service := range splitLabelList(value) {
+		parts := strings.SplitN(service, "=", 2)
+		if len(parts) != 2 {
+			return ports, fmt.Errorf("%s: invalid service '%s', must be 'name=port[/proto]'", DNSServicesLabel, service)
+		}
+
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 || strings.Contains(name, ".") {
+			return ports, fmt.Errorf("%s: invalid service name '%s'", DNSServicesLabel, parts[0])
+		}
+
+		port, ok := parsePort(nat.Port(strings.TrimSpace(parts[1])))
+		if !ok {
+			return ports, fmt.Errorf("%s: invalid service port '%s'", DNSServicesLabel, parts[1])
+		}
+
+		port.Service = name
+		ports = append(ports, port)
+	}
+
+	return ports, nil
+}
+
+func parsePort(value nat.Port) (Port, bool) {
+	proto, number := nat.SplitProtoPort(string(value))
+
+	n, err := nat.ParsePort(number)
+	if err != nil || n == 0 {
+		return Port{}, false
+	}
+
+	switch proto = strings.ToLower(proto); proto {
+	case "tcp", "udp", "sctp":
+		return Port{Number: uint16(n), Proto: proto}, true
+	default:
+		return Port{}, false
+	}
+}
+
+// containerPorts returns the exposed and published ports of the container,
+// along with the ports of named services, sorted by protocol and number.
+func containerPorts(containerInspect types.ContainerJSON, services []Port) []Port {
+	known := make(map[Port]int)
+	var ports []Port
+
+	add := func(port Port) {
+		key := Port{Number: port.Number, Proto: port.Proto}
+
+		if idx, exists := known[key]; exists {
+			if len(port.Service) != 0 {
+				ports[idx].Service = port.Service
+			}
+			return
+		}
+
+		known[key] = len(ports)
+		ports = append(ports, port)
+	}
+
+	if containerInspect.Config != nil {
+		for value := range containerInspect.Config.ExposedPorts {
+			if port, ok := parsePort(value); ok {
+				add(port)
+			}
+		}
+	}
+
+	if containerInspect.NetworkSettings != nil {
+		for value := range containerInspect.NetworkSettings.Ports {
+			if port, ok := parsePort(value); ok {
+				add(port)
+			}
+		}
+	}
+
+	for _, port := range services {
+		add(port)
+	}
+
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Proto != ports[j].Proto {
+			return ports[i].Proto < ports[j].Proto
+		}
+
+		return ports[i].Number < ports[j].Number
+	})
+
+	return ports
+}
+
+// addServiceNames adds the SRV names of the endpoint's ports, both
+// '_<port>._<proto>' and '_<service>._<proto>' for named services, below
+// the container names and the compose service name. The target is the
+// network qualified container name, which only has the endpoint's
+// addresses.
+func (s *Snapshot) addServiceNames(nw *Network, e *ContainerEndpoint) {
+	if len(e.Ports) == 0 {
+		return
+	}
+
+	target := s.qualify(s.NetworkZone(nw), e.ContainerName)
+	names := s.CanonicalNames(e)
+
+	if composeNames := e.ComposeNames(); len(composeNames) != 0 {
+		names = append(names, s.qualify(s.EndpointZone(e), composeNames[0]))
+	}
+
+	for _, port := range e.Ports {
+		record := &ServiceRecord{Endpoint: e, Port: port, Target: target}
+
+		prefixes := []string{fmt.Sprintf("_%d._%s.", port.Number, port.Proto)}
+		if len(port.Service) != 0 {
+			prefixes = append(prefixes, "_"+port.Service+"._"+port.Proto+".")
+		}
+
+		for _, name := range names {
+			for _, prefix := range prefixes {
+				s.addService(prefix+name, record)
+			}
+		}
+	}
+}
+
+func (s *Snapshot) addService(name string, record *ServiceRecord) {
+	if !s.RecordStatus(record.Endpoint.ContainerID).Serving {
+		s.addNode(name)
+		return
+	}
+
+	s.services[name] = append(s.services[name], record)
+	s.addNode(name)
+}
+
+// LookupServices returns the service records of a fully qualified SRV
+// name.
+func (s *Snapshot) LookupServices(name string) []*ServiceRecord {
+	return s.services[dns.Fqdn(strings.ToLower(name))]
+}
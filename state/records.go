@@ -0,0 +1,121 @@
+package state
+
+import (
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// Record is a resource record generated from the snapshot, along with the
+// endpoint it was generated for.
+type Record struct {
+	RR       dns.RR
+	Endpoint *ContainerEndpoint
+}
+
+// RecordCount returns the number of records of the snapshot, as returned
+// by Records.
+func (s *Snapshot) RecordCount() int {
+	return s.recordCount
+}
+
+// Records returns the A, AAAA, SRV and PTR records of the snapshot, sorted
+// by name and type. All records of a name and type share the lowest ttl
+// of their endpoints, using defaultTTL for endpoints without a ttl label.
+func (s *Snapshot) Records(defaultTTL uint32) []*Record {
+	var records []*Record
+
+	endpointTTL := func(e *ContainerEndpoint) uint32 {
+		if e.DNS.TTL != 0 {
+			return e.DNS.TTL
+		}
+		return defaultTTL
+	}
+
+	// add appends the records of one name and type, deduplicating equal
+	// records and setting the shared ttl.
+	add := func(rrs []*Record) {
+		seen := make(map[string]bool)
+		var ttl uint32
+
+		for i, record := range rrs {
+			if t := endpointTTL(record.Endpoint); i == 0 || t < ttl {
+				ttl = t
+			}
+		}
+
+		for _, record := range rrs {
+			record.RR.Header().Ttl = ttl
+
+			if key := record.RR.String(); !seen[key] {
+				seen[key] = true
+				records = append(records, record)
+			}
+		}
+	}
+
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET}
+	}
+
+	for name, endpoints := range s.names {
+		var a, aaaa []*Record
+
+		for _, e := range endpoints {
+			if ip := net.ParseIP(e.IPv4Address); ip != nil {
+				a = append(a, &Record{RR: &dns.A{Hdr: header(name, dns.TypeA), A: ip}, Endpoint: e})
+			}
+			if ip := net.ParseIP(e.IPv6Address); ip != nil {
+				aaaa = append(aaaa, &Record{RR: &dns.AAAA{Hdr: header(name, dns.TypeAAAA), AAAA: ip}, Endpoint: e})
+			}
+		}
+
+		add(a)
+		add(aaaa)
+	}
+
+	for name, services := range s.services {
+		var srv []*Record
+
+		for _, service := range services {
+			srv = append(srv, &Record{
+				RR: &dns.SRV{
+					Hdr:    header(name, dns.TypeSRV),
+					Port:   service.Port.Number,
+					Target: service.Target,
+				},
+				Endpoint: service.Endpoint,
+			})
+		}
+
+		add(srv)
+	}
+
+	for name, endpoints := range s.reverseNames {
+		var ptr []*Record
+
+		for _, e := range endpoints {
+			for _, target := range s.CanonicalNames(e) {
+				ptr = append(ptr, &Record{RR: &dns.PTR{Hdr: header(name, dns.TypePTR), Ptr: target}, Endpoint: e})
+			}
+		}
+
+		add(ptr)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i].RR.Header(), records[j].RR.Header()
+
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Rrtype != b.Rrtype {
+			return a.Rrtype < b.Rrtype
+		}
+
+		return records[i].RR.String() < records[j].RR.String()
+	})
+
+	return records
+}
@@ -0,0 +1,206 @@
+package state
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// ReverseZone is an in-addr.arpa or ip6.arpa zone derived from the
+// subnets of the tracked networks.
+//
+// The zone name is the subnet prefix rounded down to an octet or nibble
+// boundary, so a zone may cover addresses outside the subnets. Only
+// addresses within Subnets are considered part of the zone.
+type ReverseZone struct {
+	Name    string
+	Subnets []*net.IPNet
+}
+
+// Contains returns true if ip is within one of the zone's subnets.
+func (z *ReverseZone) Contains(ip net.IP) bool {
+	for _, subnet := range z.Subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReverseZones returns the reverse zones, ordered with the most specific
+// zone first.
+func (s *Snapshot) ReverseZones() []*ReverseZone {
+	return s.reverseZones
+}
+
+// ReverseZone returns the reverse zone the name belongs to. Names of
+// complete addresses are only part of a zone if the address is within
+// one of the zone's subnets.
+func (s *Snapshot) ReverseZone(name string) (*ReverseZone, bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	for _, zone := range s.reverseZones {
+		if !dns.IsSubDomain(zone.Name, name) {
+			continue
+		}
+
+		if ip := ReverseNameIP(name); ip != nil && !zone.Contains(ip) {
+			continue
+		}
+
+		return zone, true
+	}
+
+	return nil, false
+}
+
+// LookupReverse returns the endpoints with the address of a fully
+// qualified in-addr.arpa or ip6.arpa name. The boolean result is false if
+// the name does not exist, including as an empty non-terminal.
+func (s *Snapshot) LookupReverse(name string) ([]*ContainerEndpoint, bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	return s.reverseNames[name], s.reverseNodes[name]
+}
+
+func (s *Snapshot) addReverseZones() {
+	zones := make(map[string]*ReverseZone)
+
+	for _, nw := range s.Networks {
+		if nw.DNS.Disable {
+			continue
+		}
+
+		for _, subnet := range nw.Subnets {
+			name := reverseZoneName(subnet)
+			if len(name) == 0 {
+				continue
+			}
+
+			zone, exists := zones[name]
+			if !exists {
+				zone = &ReverseZone{Name: name}
+				zones[name] = zone
+				s.reverseZones = append(s.reverseZones, zone)
+			}
+
+			zone.Subnets = append(zone.Subnets, subnet)
+		}
+	}
+
+	sort.Slice(s.reverseZones, func(i, j int) bool {
+		if len(s.reverseZones[i].Name) != len(s.reverseZones[j].Name) {
+			return len(s.reverseZones[i].Name) > len(s.reverseZones[j].Name)
+		}
+
+		return s.reverseZones[i].Name < s.reverseZones[j].Name
+	})
+
+	for address, endpoints := range s.addresses {
+		name, err := dns.ReverseAddr(address)
+		if err != nil {
+			continue
+		}
+
+		zone, exists := s.ReverseZone(name)
+		if !exists {
+			continue
+		}
+
+		s.reverseNames[name] = endpoints
+
+		for ; !s.reverseNodes[name] && dns.IsSubDomain(zone.Name, name); name = parentName(name) {
+			s.reverseNodes[name] = true
+		}
+	}
+
+	for _, zone := range s.reverseZones {
+		s.reverseNodes[zone.Name] = true
+	}
+}
+
+// reverseZoneName returns the name of the smallest in-addr.arpa or
+// ip6.arpa zone containing the subnet.
+func reverseZoneName(subnet *net.IPNet) string {
+	ones, bits := subnet.Mask.Size()
+
+	if ip := subnet.IP.To4(); ip != nil && bits == 8*net.IPv4len {
+		labels := []string{"in-addr.arpa."}
+
+		for i := 0; i < ones/8; i++ {
+			labels = append([]string{strconv.Itoa(int(ip[i]))}, labels...)
+		}
+
+		return strings.Join(labels, ".")
+	}
+
+	if ip := subnet.IP.To16(); ip != nil && bits == 8*net.IPv6len {
+		labels := []string{"ip6.arpa."}
+
+		for i := 0; i < ones/4; i++ {
+			nibble := ip[i/2] >> 4
+			if i%2 == 1 {
+				nibble = ip[i/2] & 0x0f
+			}
+
+			labels = append([]string{hexDigits[nibble : nibble+1]}, labels...)
+		}
+
+		return strings.Join(labels, ".")
+	}
+
+	return ""
+}
+
+// ReverseNameIP returns the address of a complete in-addr.arpa or
+// ip6.arpa name, or nil if name is not one.
+func ReverseNameIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv6len)
+
+		for i, label := range labels {
+			nibble := strings.Index(hexDigits, label)
+			if len(label) != 1 || nibble == -1 {
+				return nil
+			}
+
+			idx := len(labels) - 1 - i
+
+			if idx%2 == 0 {
+				ip[idx/2] |= byte(nibble) << 4
+			} else {
+				ip[idx/2] |= byte(nibble)
+			}
+		}
+
+		return ip
+	}
+
+	return nil
+}
@@ -0,0 +1,456 @@
+package state
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Snapshot is an immutable view of the networks and containers, with
+// indexes used to answer queries. A new snapshot is published after each
+// batch of events, and readers can hold on to a snapshot for as long as
+// they need a consistent view without any locking.
+//
+// Neither the snapshot nor anything reachable from it may be modified.
+type Snapshot struct {
+	Version      uint64
+	Domain       string
+	SearchZones  []string
+	HealthPolicy string
+	Nameserver   string
+	Networks     map[string]*Network
+	Containers   map[string]*Container
+
+	// NameserverAddresses are the glue addresses of Nameserver.
+	NameserverAddresses []net.IP
+
+	serials   map[string]uint32
+	history   map[string][]*ZoneChange
+	status    map[string]RecordStatus
+	names     map[string][]*ContainerEndpoint
+	nodes     map[string]bool
+	addresses map[string][]*ContainerEndpoint
+	services  map[string][]*ServiceRecord
+	endpoints map[string][]*ContainerEndpoint
+	zones     []string
+
+	reverseZones []*ReverseZone
+	reverseNames map[string][]*ContainerEndpoint
+	reverseNodes map[string]bool
+
+	recordCount int
+}
+
+var (
+	current atomic.Value
+	version uint64
+)
+
+func init() {
+	current.Store(newSnapshot(0, Domain, nil, HealthPolicy, nil, nil))
+}
+
+// Current returns the most recently published snapshot, which is never
+// nil.
+func Current() *Snapshot {
+	return current.Load().(*Snapshot)
+}
+
+// Publish builds a new snapshot from the container and network lists and
+// makes it current.
+//
+// Publish must only be called from the goroutine that handles events, as
+// the lists are read without synchronization.
+func Publish() *Snapshot {
+	var networks map[string]*Network
+	var containers map[string]*Container
+
+	if Networks != nil {
+		networks = Networks.Networks
+	}
+	if Containers != nil {
+		containers = Containers.Containers
+	}
+
+	version++
+
+	snapshot := newSnapshot(version, Domain, SearchZones, HealthPolicy, networks, containers)
+	snapshot.Nameserver = Nameserver
+	snapshot.NameserverAddresses = NameserverAddresses
+
+	// The records are built once per snapshot for both the zone serials and
+	// the record count, which is read on every metrics scrape.
+	records := snapshot.Records(DefaultTTL)
+	snapshot.recordCount = len(records)
+
+	zoneSerials = snapshot.assignSerials(zoneSerials, SerialScheme, records, DefaultTTL, time.Now())
+
+	current.Store(snapshot)
+
+	return snapshot
+}
+
+func newSnapshot(version uint64, domain string, searchZones []string, healthPolicy string, networks map[string]*Network, containers map[string]*Container) *Snapshot {
+	s := &Snapshot{
+		Version:      version,
+		Domain:       dns.Fqdn(strings.ToLower(domain)),
+		HealthPolicy: healthPolicy,
+		Networks:     make(map[string]*Network, len(networks)),
+		Containers:   make(map[string]*Container, len(containers)),
+		status:       make(map[string]RecordStatus, len(containers)),
+		names:        make(map[string][]*ContainerEndpoint),
+		nodes:        make(map[string]bool),
+		addresses:    make(map[string][]*ContainerEndpoint),
+		services:     make(map[string][]*ServiceRecord),
+		endpoints:    make(map[string][]*ContainerEndpoint),
+
+		reverseNames: make(map[string][]*ContainerEndpoint),
+		reverseNodes: make(map[string]bool),
+	}
+
+	s.addZone(s.Domain)
+
+	for _, zone := range searchZones {
+		s.SearchZones = append(s.SearchZones, dns.Fqdn(strings.ToLower(zone)))
+	}
+
+	for id, container := range containers {
+		c := *container
+		s.Containers[id] = &c
+		s.status[id] = c.RecordStatus(healthPolicy)
+	}
+
+	for id, nw := range networks {
+		nwCopy := &Network{
+			ID:                 nw.ID,
+			Name:               nw.Name,
+			Subnets:            nw.Subnets,
+			Gateways:           nw.Gateways,
+			Labels:             nw.Labels,
+			DNS:                nw.DNS,
+			ContainerEndpoints: make(map[string]*ContainerEndpoint, len(nw.ContainerEndpoints)),
+		}
+		s.Networks[id] = nwCopy
+
+		if !nw.DNS.Disable {
+			s.addZone(s.NetworkZone(nwCopy))
+		}
+
+		for containerID, endpoint := range nw.ContainerEndpoints {
+			e := *endpoint
+			nwCopy.ContainerEndpoints[containerID] = &e
+
+			s.endpoints[id] = append(s.endpoints[id], &e)
+
+			if nw.DNS.Disable || !e.DNS.PublishedOn(nw.Name) {
+				continue
+			}
+
+			if s.RecordStatus(containerID).Serving {
+				s.addAddress(e.IPv4Address, &e)
+				s.addAddress(e.IPv6Address, &e)
+			}
+
+			s.addEndpointNames(nwCopy, &e)
+			s.addServiceNames(nwCopy, &e)
+		}
+
+		if !nw.DNS.Disable {
+			s.addLinkNames(nwCopy)
+		}
+	}
+
+	s.addReverseZones()
+
+	return s
+}
+
+// NetworkZone returns the zone the network's names are published in,
+// '<network>.<domain>' unless set with a network label.
+func (s *Snapshot) NetworkZone(nw *Network) string {
+	if len(nw.DNS.Zone) != 0 {
+		return nw.DNS.Zone
+	}
+
+	return s.qualify(s.Domain, nw.Name)
+}
+
+// IsNetworkZone returns true if zone is the zone of a network.
+func (s *Snapshot) IsNetworkZone(zone string) bool {
+	for _, nw := range s.Networks {
+		if !nw.DNS.Disable && strings.EqualFold(s.NetworkZone(nw), zone) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientNetworks returns the networks with a subnet containing ip. The
+// gateway addresses of networks belong to the host, which is not
+// considered to be on the network.
+func (s *Snapshot) ClientNetworks(ip net.IP) []*Network {
+	var networks []*Network
+
+	for _, nw := range s.Networks {
+		if nw.isGateway(ip) {
+			continue
+		}
+
+		for _, subnet := range nw.Subnets {
+			if subnet.Contains(ip) {
+				networks = append(networks, nw)
+				break
+			}
+		}
+	}
+
+	return networks
+}
+
+// NetworkByName returns the network named name.
+func (s *Snapshot) NetworkByName(name string) (*Network, bool) {
+	for _, nw := range s.Networks {
+		if strings.EqualFold(nw.Name, name) {
+			return nw, true
+		}
+	}
+
+	return nil, false
+}
+
+// RecordStatus returns whether the records of the container are served.
+// Containers with unknown state are served, as the endpoint may have been
+// seen before the container.
+func (s *Snapshot) RecordStatus(containerID string) RecordStatus {
+	if status, exists := s.status[containerID]; exists {
+		return status
+	}
+
+	return RecordStatus{Serving: true, Reason: "unknown state"}
+}
+
+// EndpointZone returns the zone the endpoint's unqualified names are
+// published in.
+func (s *Snapshot) EndpointZone(e *ContainerEndpoint) string {
+	if len(e.DNS.Zone) != 0 {
+		return e.DNS.Zone
+	}
+
+	return s.Domain
+}
+
+// CanonicalNames returns the container name and the network qualified
+// container name of the endpoint.
+func (s *Snapshot) CanonicalNames(e *ContainerEndpoint) []string {
+	names := []string{s.qualify(s.EndpointZone(e), e.ContainerName)}
+
+	if nw, exists := s.Networks[e.NetworkID]; exists {
+		names = append(names, s.qualify(s.NetworkZone(nw), e.ContainerName))
+	}
+
+	return names
+}
+
+// addEndpointNames adds the names of the endpoint. Network aliases and the
+// configured hostname are scoped to the network the endpoint is on.
+func (s *Snapshot) addEndpointNames(nw *Network, e *ContainerEndpoint) {
+	zone, networkZone := s.EndpointZone(e), s.NetworkZone(nw)
+
+	s.addZone(zone)
+
+	for _, name := range s.CanonicalNames(e) {
+		s.addName(name, e)
+	}
+
+	for _, name := range e.ComposeNames() {
+		s.addName(s.qualify(zone, name), e)
+	}
+
+	for _, alias := range e.Aliases {
+		s.addName(s.qualify(networkZone, alias), e)
+	}
+
+	if len(e.Hostname) != 0 {
+		s.addName(s.qualify(networkZone, e.Hostname), e)
+
+		if len(e.Domainname) != 0 {
+			s.addAbsoluteName(dns.Fqdn(e.FQDN()), zone, e)
+		}
+	}
+
+	for _, name := range e.DNS.Names {
+		if dns.IsFqdn(name) {
+			s.addAbsoluteName(name, zone, e)
+		} else {
+			s.addName(s.qualify(zone, name), e)
+		}
+	}
+}
+
+// addAbsoluteName adds a fully qualified name only if it is within the
+// domain or the endpoint's zone, as we are not authoritative for anything
+// else.
+func (s *Snapshot) addAbsoluteName(name, zone string, e *ContainerEndpoint) {
+	name = strings.ToLower(name)
+
+	if dns.IsSubDomain(s.Domain, name) || dns.IsSubDomain(zone, name) {
+		s.addName(name, e)
+	}
+}
+
+// addLinkNames adds the aliases of legacy container links as names of the
+// linked containers, scoped to the network of the linking container.
+func (s *Snapshot) addLinkNames(nw *Network) {
+	for _, e := range nw.ContainerEndpoints {
+		for _, link := range e.Links {
+			parts := strings.SplitN(strings.TrimPrefix(link, "/"), ":", 2)
+
+			target, alias := parts[0], parts[0]
+			if len(parts) == 2 {
+				alias = parts[1]
+			}
+
+			for _, linked := range nw.ContainerEndpoints {
+				if strings.EqualFold(linked.ContainerName, target) && linked.DNS.PublishedOn(nw.Name) {
+					s.addName(s.qualify(s.NetworkZone(nw), alias), linked)
+				}
+			}
+		}
+	}
+}
+
+// LookupName returns the endpoints of a fully qualified name. The boolean
+// result is false if the name does not exist at all, which is different
+// from an existing name without endpoints such as the domain itself or
+// '<network>.<domain>'.
+//
+// Names directly within the domain are first looked up in each of the
+// search zones, returning the endpoints of the first zone with a match.
+func (s *Snapshot) LookupName(name string) ([]*ContainerEndpoint, bool) {
+	name = s.ResolveName(name)
+
+	return s.names[name], s.nodes[name]
+}
+
+// ResolveName returns the name LookupName answers name with, which is the
+// name in the first search zone with endpoints for names directly within
+// the domain.
+func (s *Snapshot) ResolveName(name string) string {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	if zone, _ := s.Zone(name); zone == s.Domain && name != s.Domain {
+		relative := strings.TrimSuffix(name, s.Domain)
+
+		for _, searchZone := range s.SearchZones {
+			if len(s.names[relative+searchZone]) != 0 {
+				return relative + searchZone
+			}
+		}
+	}
+
+	return name
+}
+
+// LookupAddress returns the endpoints with the address ip.
+func (s *Snapshot) LookupAddress(ip net.IP) []*ContainerEndpoint {
+	return s.addresses[ip.String()]
+}
+
+// NetworkEndpoints returns the endpoints on the network with id networkID.
+func (s *Snapshot) NetworkEndpoints(networkID string) []*ContainerEndpoint {
+	return s.endpoints[networkID]
+}
+
+// Zones returns the zones names are published in, ordered with the most
+// specific zone first. The domain is always included.
+func (s *Snapshot) Zones() []string {
+	return s.zones
+}
+
+// Zone returns the most specific zone the name is within.
+func (s *Snapshot) Zone(name string) (string, bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	for _, zone := range s.zones {
+		if dns.IsSubDomain(zone, name) {
+			return zone, true
+		}
+	}
+
+	return "", false
+}
+
+// qualify joins the labels with the zone, returning a lower case fully
+// qualified name.
+func (s *Snapshot) qualify(zone string, labels ...string) string {
+	return strings.ToLower(strings.Join(labels, ".")) + "." + zone
+}
+
+func (s *Snapshot) addZone(zone string) {
+	for _, z := range s.zones {
+		if z == zone {
+			return
+		}
+	}
+
+	s.zones = append(s.zones, zone)
+	s.nodes[zone] = true
+
+	sort.Slice(s.zones, func(i, j int) bool {
+		if dns.CountLabel(s.zones[i]) != dns.CountLabel(s.zones[j]) {
+			return dns.CountLabel(s.zones[i]) > dns.CountLabel(s.zones[j])
+		}
+
+		return s.zones[i] < s.zones[j]
+	})
+}
+
+// addName adds the endpoint to the name. The names of endpoints with
+// withheld records still exist, so they are answered with NODATA until the
+// container recovers.
+func (s *Snapshot) addName(name string, endpoint *ContainerEndpoint) {
+	if !s.RecordStatus(endpoint.ContainerID).Serving {
+		s.addNode(name)
+		return
+	}
+
+	for _, e := range s.names[name] {
+		if e == endpoint {
+			return
+		}
+	}
+
+	s.names[name] = append(s.names[name], endpoint)
+	s.addNode(name)
+}
+
+// addNode marks name and all its parents within the zone as existing, so
+// they are answered with NODATA rather than NXDOMAIN. Zone apexes are
+// always marked, which ends the walk.
+func (s *Snapshot) addNode(name string) {
+	for ; !s.nodes[name] && name != "."; name = parentName(name) {
+		s.nodes[name] = true
+	}
+}
+
+func (s *Snapshot) addAddress(address string, endpoint *ContainerEndpoint) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return
+	}
+
+	s.addresses[ip.String()] = append(s.addresses[ip.String()], endpoint)
+}
+
+func parentName(name string) string {
+	if idx, end := dns.NextLabel(name, 0); !end {
+		return name[idx:]
+	}
+
+	return "."
+}
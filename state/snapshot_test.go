@@ -0,0 +1,755 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func testID(prefix string, n int) string {
+	return fmt.Sprintf("%s%063x", prefix, n)[:64]
+}
+
+func testContainerJSON(id, name string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:   id,
+			Name: "/" + name,
+		},
+	}
+}
+
+func testNetworkResource(id, name string, subnets ...string) types.NetworkResource {
+	networkResource := types.NetworkResource{
+		ID:   id,
+		Name: name,
+	}
+
+	for _, subnet := range subnets {
+		networkResource.IPAM.Config = append(networkResource.IPAM.Config, network.IPAMConfig{Subnet: subnet})
+	}
+
+	return networkResource
+}
+
+func resetTestState() {
+	Domain = "docker."
+	SearchZones = nil
+	Networks = &networkList{Networks: make(map[string]*Network)}
+	Containers = &containerList{Containers: make(map[string]*Container)}
+}
+
+func TestSnapshotLookup(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend", "172.20.0.0/16", "fd00::/64"))
+	Networks.addEndpoint(nw, testContainerJSON(testID("c", 1), "Web"), &network.EndpointSettings{
+		IPAddress:         "172.20.0.2",
+		GlobalIPv6Address: "fd00::2",
+	})
+
+	snapshot := Publish()
+
+	if snapshot != Current() {
+		t.Fatalf("published snapshot is not current")
+	}
+
+	for _, name := range []string{"web.docker.", "WEB.backend.docker", "web.backend.docker."} {
+		endpoints, exists := snapshot.LookupName(name)
+		if !exists || len(endpoints) != 1 || endpoints[0].IPv4Address != "172.20.0.2" {
+			t.Errorf("unexpected lookup of %s: %v %v", name, endpoints, exists)
+		}
+	}
+
+	for _, name := range []string{"docker.", "backend.docker."} {
+		if endpoints, exists := snapshot.LookupName(name); !exists || len(endpoints) != 0 {
+			t.Errorf("expected %s to exist without endpoints: %v %v", name, endpoints, exists)
+		}
+	}
+
+	for _, name := range []string{"db.docker.", "web.frontend.docker.", "web.example.com."} {
+		if _, exists := snapshot.LookupName(name); exists {
+			t.Errorf("expected %s to not exist", name)
+		}
+	}
+
+	if endpoints := snapshot.LookupAddress(net.ParseIP("fd00:0::2")); len(endpoints) != 1 {
+		t.Errorf("unexpected address lookup: %v", endpoints)
+	}
+	if endpoints := snapshot.NetworkEndpoints(nw.ID); len(endpoints) != 1 {
+		t.Errorf("unexpected network endpoints: %v", endpoints)
+	}
+}
+
+func TestSnapshotAliases(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend"))
+
+	web := testContainerJSON(testID("c", 1), "proj_web_1")
+	web.Config = &container.Config{Hostname: "www", Domainname: "example.docker"}
+
+	Networks.addEndpoint(nw, web, &network.EndpointSettings{
+		IPAddress: "172.20.0.2",
+		Aliases:   []string{"web", testID("c", 1)[:12]},
+	})
+	Networks.addEndpoint(nw, testContainerJSON(testID("c", 2), "client"), &network.EndpointSettings{
+		IPAddress: "172.20.0.3",
+		Links:     []string{"proj_web_1:legacy"},
+	})
+
+	db := testContainerJSON(testID("c", 3), "db")
+	db.Config = &container.Config{Hostname: testID("c", 3)[:12]}
+
+	Networks.addEndpoint(nw, db, &network.EndpointSettings{
+		IPAddress: "172.20.0.4",
+		Aliases:   []string{testID("c", 3)[:12]},
+	})
+
+	snapshot := Publish()
+
+	for _, name := range []string{"web.backend.docker.", "www.backend.docker.", "www.example.docker.", "legacy.backend.docker."} {
+		endpoints, _ := snapshot.LookupName(name)
+		if len(endpoints) != 1 || endpoints[0].ContainerName != "proj_web_1" {
+			t.Errorf("unexpected lookup of %s: %v", name, endpoints)
+		}
+	}
+
+	for _, name := range []string{"web.docker.", testID("c", 1)[:12] + ".backend.docker.", testID("c", 3)[:12] + ".backend.docker.", testID("c", 3)[:12] + ".docker."} {
+		if endpoints, _ := snapshot.LookupName(name); len(endpoints) != 0 {
+			t.Errorf("expected no endpoints for %s: %v", name, endpoints)
+		}
+	}
+
+	if endpoints, _ := snapshot.LookupName("db.backend.docker."); len(endpoints) != 1 || len(endpoints[0].Hostname) != 0 {
+		t.Errorf("expected default hostname to be skipped: %v", endpoints)
+	}
+}
+
+func TestSnapshotHexAliases(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend"))
+
+	// Hex names that prefix the container id are only skipped when equal to
+	// the short id.
+	db := testContainerJSON(testID("db", 1), "proj_db_1")
+	db.Config = &container.Config{Hostname: "db0"}
+
+	Networks.addEndpoint(nw, db, &network.EndpointSettings{
+		IPAddress: "172.20.0.2",
+		Aliases:   []string{"db", testID("db", 1)[:12]},
+	})
+
+	snapshot := Publish()
+
+	for _, name := range []string{"db.backend.docker.", "db0.backend.docker."} {
+		endpoints, _ := snapshot.LookupName(name)
+		if len(endpoints) != 1 || endpoints[0].ContainerName != "proj_db_1" {
+			t.Errorf("unexpected lookup of %s: %v", name, endpoints)
+		}
+	}
+
+	if endpoints, _ := snapshot.LookupName(testID("db", 1)[:12] + ".backend.docker."); len(endpoints) != 0 {
+		t.Errorf("expected short id alias to be skipped: %v", endpoints)
+	}
+}
+
+func TestSnapshotCompose(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend"))
+
+	for i := 1; i <= 2; i++ {
+		replica := testContainerJSON(testID("c", i), fmt.Sprintf("myproj-web-%d", i))
+		replica.Config = &container.Config{Labels: map[string]string{
+			ComposeProjectLabel:         "myproj",
+			ComposeServiceLabel:         "web",
+			ComposeContainerNumberLabel: fmt.Sprint(i),
+		}}
+
+		Networks.addEndpoint(nw, replica, &network.EndpointSettings{IPAddress: fmt.Sprintf("172.20.0.%d", i+1)})
+	}
+
+	snapshot := Publish()
+
+	if endpoints, _ := snapshot.LookupName("web.myproj.docker."); len(endpoints) != 2 {
+		t.Errorf("expected service name to include all replicas: %v", endpoints)
+	}
+	if endpoints, _ := snapshot.LookupName("2.web.myproj.docker."); len(endpoints) != 1 || endpoints[0].IPv4Address != "172.20.0.3" {
+		t.Errorf("unexpected replica lookup: %v", endpoints)
+	}
+	if _, exists := snapshot.LookupName("myproj.docker."); !exists {
+		t.Errorf("expected project name to exist")
+	}
+}
+
+func TestSnapshotLabels(t *testing.T) {
+	resetTestState()
+	SearchZones = []string{"internal"}
+
+	backend := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend"))
+	frontend := Networks.addNetwork(testNetworkResource(testID("a", 2), "frontend"))
+
+	labelled := func(n int, name string, labels map[string]string) types.ContainerJSON {
+		c := testContainerJSON(testID("c", n), name)
+		c.Config = &container.Config{Labels: labels}
+		return c
+	}
+
+	api := labelled(1, "api", map[string]string{
+		DNSNamesLabel:    "rest, api.example.internal.",
+		DNSNetworksLabel: "backend",
+		DNSZoneLabel:     "example.internal",
+		DNSTTLLabel:      "120",
+	})
+	hidden := labelled(2, "hidden", map[string]string{DNSExcludeLabel: "true"})
+	takeover := labelled(3, "takeover", map[string]string{DNSZoneLabel: "com"})
+	internal := labelled(4, "internal", map[string]string{DNSZoneLabel: "apps.docker"})
+
+	for _, nw := range []*Network{backend, frontend} {
+		Networks.addEndpoint(nw, api, &network.EndpointSettings{IPAddress: "172.20.0.2"})
+		Networks.addEndpoint(nw, hidden, &network.EndpointSettings{IPAddress: "172.20.0.3"})
+	}
+
+	Networks.addEndpoint(backend, takeover, &network.EndpointSettings{IPAddress: "172.20.0.4"})
+	Networks.addEndpoint(backend, internal, &network.EndpointSettings{IPAddress: "172.20.0.5"})
+
+	snapshot := Publish()
+
+	if zone, ok := snapshot.Zone("rest.example.internal."); !ok || zone != "example.internal." {
+		t.Errorf("unexpected zone: %s %v", zone, ok)
+	}
+
+	if _, ok := snapshot.Zone("takeover.com."); ok {
+		t.Errorf("expected zone outside the domain and search zones to be ignored")
+	}
+	if endpoints, _ := snapshot.LookupName("takeover.docker."); len(endpoints) != 1 {
+		t.Errorf("expected container with an ignored zone in the domain: %v", endpoints)
+	}
+	if endpoints, _ := snapshot.LookupName("internal.apps.docker."); len(endpoints) != 1 {
+		t.Errorf("expected zone within the domain to be used: %v", endpoints)
+	}
+
+	for _, name := range []string{"api.example.internal.", "api.backend.docker.", "rest.example.internal."} {
+		endpoints, _ := snapshot.LookupName(name)
+		if len(endpoints) != 1 || endpoints[0].DNS.TTL != 120 {
+			t.Errorf("unexpected lookup of %s: %v", name, endpoints)
+		}
+	}
+
+	for _, name := range []string{"api.docker.", "api.frontend.docker.", "hidden.docker.", "hidden.backend.docker."} {
+		if endpoints, _ := snapshot.LookupName(name); len(endpoints) != 0 {
+			t.Errorf("expected no endpoints for %s: %v", name, endpoints)
+		}
+	}
+
+	if _, err := parseDNSConfig(map[string]string{DNSTTLLabel: "-1", DNSExcludeLabel: "maybe"}); err == nil {
+		t.Errorf("expected invalid labels to return an error")
+	}
+}
+
+func TestSnapshotHealth(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend"))
+
+	event := func(n int, action string) {
+		Containers.HandleEvent(context.Background(), events.Message{
+			Type:   events.ContainerEventType,
+			Action: action,
+			Actor:  events.Actor{ID: testID("c", n)},
+		})
+	}
+
+	for n, labels := range []map[string]string{
+		nil,
+		{DNSHealthLabel: HealthPolicyRunning},
+		{DNSHealthLabel: HealthPolicyIgnore},
+	} {
+		c := testContainerJSON(testID("c", n), fmt.Sprintf("web%d", n))
+		c.Config = &container.Config{Labels: labels}
+		c.State = &types.ContainerState{Running: true, Health: &types.Health{Status: types.Starting}}
+
+		Containers.Containers[c.ID] = newContainerFromInspect(c)
+		Networks.addEndpoint(nw, c, &network.EndpointSettings{IPAddress: fmt.Sprintf("172.20.0.%d", n+2)})
+	}
+
+	serving := func(expected ...bool) {
+		t.Helper()
+
+		snapshot := Publish()
+
+		for n, expect := range expected {
+			name := fmt.Sprintf("web%d.docker.", n)
+			endpoints, exists := snapshot.LookupName(name)
+
+			if !exists || (len(endpoints) != 0) != expect || snapshot.RecordStatus(testID("c", n)).Serving != expect {
+				t.Errorf("unexpected lookup of %s, expected serving %v: %v %v %v", name, expect, endpoints, exists, snapshot.RecordStatus(testID("c", n)))
+			}
+			if addressed := len(snapshot.LookupAddress(net.ParseIP(fmt.Sprintf("172.20.0.%d", n+2)))) != 0; addressed != expect {
+				t.Errorf("unexpected address lookup of %s, expected serving %v", name, expect)
+			}
+		}
+	}
+
+	serving(false, true, true)
+
+	event(0, "health_status: healthy")
+	serving(true, true, true)
+
+	event(0, "health_status: unhealthy")
+	event(1, "pause")
+	serving(false, false, true)
+
+	event(0, "health_status: healthy")
+	event(1, "unpause")
+	serving(true, true, true)
+
+	for n := 0; n < 3; n++ {
+		event(n, "kill")
+		event(n, "die")
+	}
+	serving(false, false, true)
+
+	event(0, "start")
+	event(1, "start")
+	serving(false, true, true)
+
+	if _, err := ParseHealthPolicy("sometimes"); err == nil {
+		t.Errorf("expected invalid health policy to return an error")
+	}
+}
+
+func TestSnapshotServices(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend"))
+
+	for n := 1; n <= 2; n++ {
+		c := testContainerJSON(testID("c", n), fmt.Sprintf("shop_api_%d", n))
+		c.Config = &container.Config{
+			ExposedPorts: nat.PortSet{"8080/tcp": {}, "53/udp": {}},
+			Labels: map[string]string{
+				ComposeProjectLabel: "shop",
+				ComposeServiceLabel: "api",
+				DNSServicesLabel:    "http=8080, metrics=9090/tcp",
+			},
+		}
+		c.NetworkSettings = &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: nat.PortMap{"8080/tcp": nil}},
+		}
+
+		Networks.addEndpoint(nw, c, &network.EndpointSettings{IPAddress: fmt.Sprintf("172.20.0.%d", n+1)})
+	}
+
+	snapshot := Publish()
+
+	for name, expected := range map[string]int{
+		"_http._tcp.api.shop.docker.":           2,
+		"_9090._tcp.api.shop.docker.":           2,
+		"_8080._tcp.shop_api_1.docker.":         1,
+		"_53._udp.shop_api_2.backend.docker.":   1,
+		"_metrics._tcp.shop_api_1.docker.":      1,
+		"_http._udp.api.shop.docker.":           0,
+		"_8080._tcp.shop_api_1.example.docker.": 0,
+	} {
+		if services := snapshot.LookupServices(name); len(services) != expected {
+			t.Errorf("unexpected service lookup of %s: %v", name, services)
+		}
+	}
+
+	services := snapshot.LookupServices("_HTTP._tcp.shop_api_1.docker")
+	if len(services) != 1 || services[0].Port.Number != 8080 || services[0].Target != "shop_api_1.backend.docker." {
+		t.Fatalf("unexpected service record: %v", services)
+	}
+
+	if endpoints, exists := snapshot.LookupName(services[0].Target); !exists || len(endpoints) != 1 {
+		t.Errorf("unexpected lookup of service target: %v %v", endpoints, exists)
+	}
+	if _, exists := snapshot.LookupName("_tcp.api.shop.docker."); !exists {
+		t.Errorf("expected service parent to exist")
+	}
+
+	if _, err := parseServicesLabel("http=80, dns=53/icmp"); err == nil {
+		t.Errorf("expected invalid services label to return an error")
+	}
+}
+
+func TestSnapshotRecords(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend", "172.20.0.0/16"))
+
+	web := testContainerJSON(testID("c", 1), "web")
+	web.Config = &container.Config{
+		ExposedPorts: nat.PortSet{"80/tcp": {}},
+		Labels:       map[string]string{DNSTTLLabel: "10"},
+	}
+
+	Networks.addEndpoint(nw, web, &network.EndpointSettings{IPAddress: "172.20.0.2", Aliases: []string{"www"}})
+	Networks.addEndpoint(nw, testContainerJSON(testID("c", 2), "db"), &network.EndpointSettings{IPAddress: "172.20.0.3", Aliases: []string{"www"}})
+
+	snapshot := Publish()
+
+	var records []string
+
+	for _, record := range snapshot.Records(30) {
+		records = append(records, record.RR.String())
+	}
+
+	if snapshot.RecordCount() != len(records) {
+		t.Errorf("unexpected record count: %d", snapshot.RecordCount())
+	}
+
+	expected := []string{
+		"2.0.20.172.in-addr.arpa.\t10\tIN\tPTR\tweb.backend.docker.",
+		"2.0.20.172.in-addr.arpa.\t10\tIN\tPTR\tweb.docker.",
+		"3.0.20.172.in-addr.arpa.\t30\tIN\tPTR\tdb.backend.docker.",
+		"3.0.20.172.in-addr.arpa.\t30\tIN\tPTR\tdb.docker.",
+		"_80._tcp.web.backend.docker.\t10\tIN\tSRV\t0 0 80 web.backend.docker.",
+		"_80._tcp.web.docker.\t10\tIN\tSRV\t0 0 80 web.backend.docker.",
+		"db.backend.docker.\t30\tIN\tA\t172.20.0.3",
+		"db.docker.\t30\tIN\tA\t172.20.0.3",
+		"web.backend.docker.\t10\tIN\tA\t172.20.0.2",
+		"web.docker.\t10\tIN\tA\t172.20.0.2",
+		"www.backend.docker.\t10\tIN\tA\t172.20.0.2",
+		"www.backend.docker.\t10\tIN\tA\t172.20.0.3",
+	}
+
+	if strings.Join(records, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected records:\n%s", strings.Join(records, "\n"))
+	}
+}
+
+func TestSnapshotSerials(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "serials", "172.30.0.0/16"))
+
+	first := Publish()
+	zone, reverseZone := "serials.docker.", "30.172.in-addr.arpa."
+
+	if first.Serial(zone) == 0 || first.Serial(reverseZone) == 0 {
+		t.Fatalf("expected serials to be assigned: %d %d", first.Serial(zone), first.Serial(reverseZone))
+	}
+
+	if unchanged := Publish(); unchanged.Serial(zone) != first.Serial(zone) {
+		t.Errorf("expected serial to be kept without changes: %d %d", first.Serial(zone), unchanged.Serial(zone))
+	}
+
+	Networks.addEndpoint(nw, testContainerJSON(testID("c", 1), "web"), &network.EndpointSettings{IPAddress: "172.30.0.2"})
+
+	changed := Publish()
+
+	if changed.Serial(zone) <= first.Serial(zone) || changed.Serial(reverseZone) <= first.Serial(reverseZone) {
+		t.Errorf("expected serials to increment: %d %d", changed.Serial(zone), changed.Serial(reverseZone))
+	}
+
+	if soa := changed.SOA(zone, 30); soa.Serial != changed.Serial(zone) || soa.Ns != "ns.docker." {
+		t.Errorf("unexpected soa: %v", soa)
+	}
+
+	var records []string
+	for _, record := range changed.ZoneRecords(zone, 30) {
+		records = append(records, record.RR.String())
+	}
+
+	if expected := "web.serials.docker.\t30\tIN\tA\t172.30.0.2"; strings.Join(records, "\n") != expected {
+		t.Errorf("unexpected zone records:\n%s", strings.Join(records, "\n"))
+	}
+
+	records = nil
+	for _, record := range changed.ZoneRecords("docker.", 30) {
+		records = append(records, record.RR.String())
+	}
+
+	if expected := "serials.docker.\t30\tIN\tNS\tns.docker.\nweb.docker.\t30\tIN\tA\t172.30.0.2"; strings.Join(records, "\n") != expected {
+		t.Errorf("expected delegation in parent zone records:\n%s", strings.Join(records, "\n"))
+	}
+
+	changes, ok := changed.ZoneChanges(zone, first.Serial(zone))
+	if !ok || len(changes) != 1 || changes[0].From != first.Serial(zone) || changes[0].To != changed.Serial(zone) {
+		t.Fatalf("unexpected zone changes: %v %v", changes, ok)
+	}
+	if len(changes[0].Removed) != 0 || len(changes[0].Added) != 1 || changes[0].Added[0].String() != "web.serials.docker.\t30\tIN\tA\t172.30.0.2" {
+		t.Errorf("unexpected zone change: %+v", changes[0])
+	}
+
+	if changes, ok := changed.ZoneChanges(zone, changed.Serial(zone)); !ok || len(changes) != 0 {
+		t.Errorf("expected no changes since the current serial: %v %v", changes, ok)
+	}
+	if _, ok := changed.ZoneChanges(zone, first.Serial(zone)-1); ok {
+		t.Errorf("expected unknown serial to not be in the history")
+	}
+}
+
+func TestSnapshotSeedSerials(t *testing.T) {
+	resetTestState()
+
+	SerialScheme = SerialSchemeDateCounter
+	defer func() { SerialScheme = SerialSchemeUnixTime }()
+
+	zone := "seeded.docker."
+	Networks.addNetwork(testNetworkResource(testID("a", 1), "seeded"))
+
+	// A restart seeds the serial served earlier the same day, which is
+	// higher than the first date-counter serial of today.
+	SeedSerials(map[string]uint32{"Seeded.docker": 2999123105})
+
+	first := Publish()
+
+	if serial := first.Serial(zone); serial != 2999123106 {
+		t.Errorf("expected seeded serial to be incremented: %d", serial)
+	}
+	if changes, ok := first.ZoneChanges(zone, 2999123105); ok {
+		t.Errorf("expected no history from the seeded serial: %v", changes)
+	}
+
+	SeedSerials(map[string]uint32{zone: 1})
+
+	if serial := Publish().Serial(zone); serial != first.Serial(zone) {
+		t.Errorf("expected seeding to not replace known serials: %d", serial)
+	}
+}
+
+func TestChildZones(t *testing.T) {
+	zones := []string{"web.backend.docker.", "backend.docker.", "frontend.docker.", "docker.", "example."}
+
+	if children := childZones(zones, "docker."); strings.Join(children, " ") != "backend.docker. frontend.docker." {
+		t.Errorf("unexpected child zones of docker.: %v", children)
+	}
+	if children := childZones(zones, "backend.docker."); strings.Join(children, " ") != "web.backend.docker." {
+		t.Errorf("unexpected child zones of backend.docker.: %v", children)
+	}
+}
+
+func TestNextSerial(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		scheme   string
+		previous uint32
+		expected uint32
+	}{
+		{SerialSchemeUnixTime, 0, uint32(now.Unix())},
+		{SerialSchemeUnixTime, uint32(now.Unix()), uint32(now.Unix()) + 1},
+		{SerialSchemeDateCounter, 0, 2021060100},
+		{SerialSchemeDateCounter, 2021053107, 2021060100},
+		{SerialSchemeDateCounter, 2021060100, 2021060101},
+		{SerialSchemeDateCounter, 2021060199, 2021060200},
+	} {
+		if serial := NextSerial(tc.scheme, tc.previous, now); serial != tc.expected {
+			t.Errorf("unexpected %s serial after %d: %d", tc.scheme, tc.previous, serial)
+		}
+	}
+}
+
+func TestSnapshotNetworkZones(t *testing.T) {
+	resetTestState()
+
+	backendResource := testNetworkResource(testID("a", 1), "backend", "172.20.0.0/16")
+	backendResource.Labels = map[string]string{DNSZoneLabel: "backend.internal"}
+	disabledResource := testNetworkResource(testID("a", 2), "disabled", "172.21.0.0/16")
+	disabledResource.Labels = map[string]string{DNSDisableLabel: "true"}
+
+	backend := Networks.addNetwork(backendResource)
+	frontend := Networks.addNetwork(testNetworkResource(testID("a", 3), "frontend", "172.22.0.0/16"))
+	disabled := Networks.addNetwork(disabledResource)
+
+	Networks.addEndpoint(backend, testContainerJSON(testID("c", 1), "web"), &network.EndpointSettings{IPAddress: "172.20.0.2"})
+	Networks.addEndpoint(frontend, testContainerJSON(testID("c", 1), "web"), &network.EndpointSettings{IPAddress: "172.22.0.2"})
+	Networks.addEndpoint(disabled, testContainerJSON(testID("c", 2), "db"), &network.EndpointSettings{IPAddress: "172.21.0.2"})
+
+	SearchZones = []string{"frontend.docker", "backend.internal"}
+	snapshot := Publish()
+
+	for name, expected := range map[string]string{
+		"web.backend.internal.": "172.20.0.2",
+		"web.frontend.docker.":  "172.22.0.2",
+		"web.docker.":           "172.22.0.2",
+	} {
+		if endpoints, _ := snapshot.LookupName(name); len(endpoints) != 1 || endpoints[0].IPv4Address != expected {
+			t.Errorf("unexpected lookup of %s: %v", name, endpoints)
+		}
+	}
+
+	for _, name := range []string{"web.backend.docker.", "db.docker.", "db.disabled.docker.", "disabled.docker."} {
+		if _, exists := snapshot.LookupName(name); exists {
+			t.Errorf("expected %s to not exist", name)
+		}
+	}
+
+	if _, ok := snapshot.ReverseZone("2.0.21.172.in-addr.arpa."); ok {
+		t.Errorf("expected no reverse zone for disabled network")
+	}
+}
+
+func TestSnapshotClientNetworks(t *testing.T) {
+	resetTestState()
+
+	networkResource := testNetworkResource(testID("a", 1), "backend", "172.20.0.0/16")
+	networkResource.IPAM.Config[0].Gateway = "172.20.0.1"
+
+	Networks.addNetwork(networkResource)
+	snapshot := Publish()
+
+	if networks := snapshot.ClientNetworks(net.ParseIP("172.20.0.5")); len(networks) != 1 || networks[0].Name != "backend" {
+		t.Errorf("unexpected client networks: %v", networks)
+	}
+
+	for _, address := range []string{"172.20.0.1", "10.0.0.1"} {
+		if networks := snapshot.ClientNetworks(net.ParseIP(address)); len(networks) != 0 {
+			t.Errorf("expected %s to not be on a network: %v", address, networks)
+		}
+	}
+}
+
+func TestSnapshotReverse(t *testing.T) {
+	resetTestState()
+
+	nw := Networks.addNetwork(testNetworkResource(testID("a", 1), "backend", "10.9.8.0/22", "fd00::/64"))
+	Networks.addEndpoint(nw, testContainerJSON(testID("c", 1), "web"), &network.EndpointSettings{
+		IPAddress:         "10.9.9.3",
+		GlobalIPv6Address: "fd00::2",
+	})
+
+	snapshot := Publish()
+
+	for _, name := range []string{"3.9.9.10.in-addr.arpa.", "2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."} {
+		zone, ok := snapshot.ReverseZone(name)
+		if !ok {
+			t.Fatalf("expected %s to be in a reverse zone", name)
+		}
+
+		endpoints, exists := snapshot.LookupReverse(name)
+		if !exists || len(endpoints) != 1 || endpoints[0].ContainerName != "web" {
+			t.Errorf("unexpected reverse lookup of %s in zone %s: %v %v", name, zone.Name, endpoints, exists)
+		}
+	}
+
+	if zone, ok := snapshot.ReverseZone("4.9.9.10.in-addr.arpa."); !ok || zone.Name != "9.10.in-addr.arpa." {
+		t.Errorf("unexpected reverse zone for unknown address in subnet: %v %v", zone, ok)
+	} else if _, exists := snapshot.LookupReverse("4.9.9.10.in-addr.arpa."); exists {
+		t.Errorf("expected unknown address in subnet to not exist")
+	}
+
+	if _, ok := snapshot.ReverseZone("3.99.9.10.in-addr.arpa."); ok {
+		t.Errorf("expected address outside of subnets to not be in a reverse zone")
+	}
+
+	if ip := ReverseNameIP("3.9.9.10.in-addr.arpa."); !ip.Equal(net.ParseIP("10.9.9.3")) {
+		t.Errorf("unexpected reverse name address: %v", ip)
+	}
+}
+
+func TestSnapshotConcurrentReaders(t *testing.T) {
+	resetTestState()
+
+	const (
+		iterations = 500
+		readers    = 4
+		window     = 10
+	)
+
+	networkID := testID("a", 1)
+
+	Networks.HandleEvent(context.Background(), events.Message{
+		Type:   events.NetworkEventType,
+		Action: "create",
+		Actor:  events.Actor{ID: networkID, Attributes: map[string]string{"name": "backend"}},
+	})
+	Publish()
+
+	done := make(chan struct{})
+	errs := make(chan error, readers)
+
+	var wg sync.WaitGroup
+
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			var lastVersion uint64
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				snapshot := Current()
+				if snapshot.Version < lastVersion {
+					errs <- fmt.Errorf("snapshot version went backwards: %d < %d", snapshot.Version, lastVersion)
+					return
+				}
+				lastVersion = snapshot.Version
+
+				endpoints := snapshot.NetworkEndpoints(networkID)
+				if len(endpoints) > window {
+					errs <- fmt.Errorf("snapshot %d has %d endpoints", snapshot.Version, len(endpoints))
+					return
+				}
+
+				for _, endpoint := range endpoints {
+					byName, _ := snapshot.LookupName(endpoint.ContainerName + ".backend.docker.")
+					byAddress := snapshot.LookupAddress(net.ParseIP(endpoint.IPv4Address))
+
+					if len(byName) != 1 || byName[0] != endpoint || len(byAddress) != 1 || byAddress[0] != endpoint {
+						errs <- fmt.Errorf("snapshot %d has inconsistent indexes for %v", snapshot.Version, endpoint)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < iterations; i++ {
+		nw := Networks.Networks[networkID]
+
+		Networks.addEndpoint(nw, testContainerJSON(testID("c", i), fmt.Sprintf("c%d", i)), &network.EndpointSettings{
+			IPAddress: fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+		})
+
+		if i >= window {
+			Networks.HandleEvent(context.Background(), events.Message{
+				Type:   events.NetworkEventType,
+				Action: "disconnect",
+				Actor:  events.Actor{ID: networkID, Attributes: map[string]string{"container": testID("c", i-window)}},
+			})
+		}
+
+		Publish()
+	}
+
+	close(done)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if endpoints := Current().NetworkEndpoints(networkID); len(endpoints) != window {
+		t.Errorf("expected %d endpoints after last publish, got %d", window, len(endpoints))
+	}
+}
@@ -2,29 +2,89 @@ package state
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
-	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 )
 
 var (
 	Containers *containerList
 	Networks   *networkList
+
+	// Domain is the zone container names are published in, and must be
+	// set before the first snapshot is published.
+	Domain = "docker."
+
+	// SearchZones are searched in order for names directly within the
+	// domain, before falling back to the names of all networks.
+	SearchZones []string
 )
 
+// Sync populates the container and network lists from the docker api,
+// removing anything no longer known. It is used both at startup and to
+// reconcile state after the event streams have reconnected.
+//
+// The lists should already be subscribed to events, which are queued by
+// the event stream until handled and should be applied after Sync
+// returns.
+func Sync(ctx context.Context) error {
+	if err := Containers.Sync(ctx); err != nil {
+		return fmt.Errorf("container sync failed: %v", err)
+	}
+	if err := Networks.Sync(ctx); err != nil {
+		return fmt.Errorf("network sync failed: %v", err)
+	}
+
+	return nil
+}
+
+// DockerClient is the part of the docker api used to follow networks
+// and containers, implemented by *client.Client.
+type DockerClient interface {
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+}
+
+var _ DockerClient = (*client.Client)(nil)
+
+func dockerClient(ctx context.Context) (DockerClient, error) {
+	cli, ok := ctx.Value("client").(DockerClient)
+	if !ok {
+		return nil, fmt.Errorf("could not get docker client from context")
+	}
+
+	return cli, nil
+}
+
+// errContainerNotFound is returned when docker reports that a container
+// does not exist, as opposed to failing to inspect it.
+var errContainerNotFound = errors.New("container not found")
+
 func dockerContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
 	if len(containerID) == 0 {
 		return types.ContainerJSON{}, fmt.Errorf("empty containerID argument")
 	}
 
-	cli, ok := ctx.Value("client").(*client.Client)
-	if !ok {
-		return types.ContainerJSON{}, fmt.Errorf("could not get docker client from context")
+	cli, err := dockerClient(ctx)
+	if err != nil {
+		return types.ContainerJSON{}, err
 	}
 
+	started := time.Now()
 	containerInspect, err := cli.ContainerInspect(ctx, containerID)
+	observeDockerRequest("container_inspect", started, err)
+
+	if client.IsErrNotFound(err) {
+		return types.ContainerJSON{}, errContainerNotFound
+	}
 	if err != nil {
 		return types.ContainerJSON{}, fmt.Errorf("could not inspect container: %v", err)
 	}
@@ -32,6 +92,27 @@ func dockerContainerInspect(ctx context.Context, containerID string) (types.Cont
 	return containerInspect, nil
 }
 
+func dockerNetworkInspect(ctx context.Context, networkID string) (types.NetworkResource, error) {
+	if len(networkID) == 0 {
+		return types.NetworkResource{}, fmt.Errorf("empty networkID argument")
+	}
+
+	cli, err := dockerClient(ctx)
+	if err != nil {
+		return types.NetworkResource{}, err
+	}
+
+	started := time.Now()
+	networkInspect, err := cli.NetworkInspect(ctx, networkID, types.NetworkInspectOptions{})
+	observeDockerRequest("network_inspect", started, err)
+
+	if err != nil {
+		return types.NetworkResource{}, fmt.Errorf("could not inspect network: %v", err)
+	}
+
+	return networkInspect, nil
+}
+
 func dockerContainerInspectAndNetworkEndpoint(ctx context.Context, containerID, networkID string) (types.ContainerJSON, *network.EndpointSettings, error) {
 	containerInspect, err := dockerContainerInspect(ctx, containerID)
 	if err != nil {
@@ -0,0 +1,127 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/rakshasa/docker-container-dns/dockertest"
+)
+
+func TestSync(t *testing.T) {
+	resetTestState()
+
+	cli := &dockertest.Client{}
+	ctx := context.WithValue(context.Background(), "client", cli)
+
+	backend := dockertest.Network(testID("a", 1), "backend", "172.20.0.0/16")
+	cli.AddNetwork(backend)
+
+	web := dockertest.Container(testID("c", 1), "web", nil)
+	dockertest.Connect(web, backend, "172.20.0.2", "")
+	cli.AddContainer(web)
+
+	stopped := dockertest.Container(testID("c", 2), "db", nil)
+	stopped.State = &types.ContainerState{Status: "exited"}
+	cli.AddContainer(stopped)
+
+	if err := Sync(ctx); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	nw, exists := Networks.Networks[backend.ID]
+	if !exists || len(nw.Subnets) != 1 || len(nw.ContainerEndpoints) != 1 || nw.ContainerEndpoints[web.ID].IPv4Address != "172.20.0.2" {
+		t.Fatalf("unexpected network after sync: %v", nw)
+	}
+
+	if len(Containers.Containers) != 2 || !Containers.Containers[web.ID].Running || Containers.Containers[stopped.ID].Running {
+		t.Errorf("unexpected containers after sync: %v", Containers.Containers)
+	}
+
+	if endpoints, _ := Publish().LookupName("web.backend.docker."); len(endpoints) != 1 {
+		t.Errorf("expected synced endpoint to be published: %v", endpoints)
+	}
+
+	cli.FailInspect(web.ID, errors.New("connection reset"))
+
+	if err := Sync(ctx); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if len(nw.ContainerEndpoints) != 1 || len(Containers.Containers) != 2 {
+		t.Errorf("expected endpoints to be kept when inspect fails: %v %v", nw.ContainerEndpoints, Containers.Containers)
+	}
+
+	cli.FailInspect(web.ID, errdefs.NotFound(errors.New("no such container")))
+
+	if err := Sync(ctx); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if len(nw.ContainerEndpoints) != 0 || len(Containers.Containers) != 1 {
+		t.Errorf("expected endpoints of containers not found to be removed: %v %v", nw.ContainerEndpoints, Containers.Containers)
+	}
+
+	cli.FailInspect(web.ID, nil)
+	cli.RemoveContainer(web.ID)
+	cli.RemoveContainer(stopped.ID)
+
+	if err := Sync(ctx); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if len(nw.ContainerEndpoints) != 0 || len(Containers.Containers) != 0 {
+		t.Errorf("expected removed containers to be removed: %v %v", nw.ContainerEndpoints, Containers.Containers)
+	}
+
+	if err := Sync(context.Background()); err == nil {
+		t.Errorf("expected sync without a docker client to fail")
+	}
+}
+
+func TestSyncUpdatesNetworks(t *testing.T) {
+	resetTestState()
+
+	cli := &dockertest.Client{}
+	ctx := context.WithValue(context.Background(), "client", cli)
+
+	backend := dockertest.Network(testID("a", 1), "backend", "172.20.0.0/16")
+	cli.AddNetwork(backend)
+
+	created := dockertest.Container(testID("c", 1), "web", nil)
+	created.State = &types.ContainerState{Status: "created"}
+	dockertest.Connect(created, backend, "", "")
+	cli.AddContainer(created)
+
+	exited := dockertest.Container(testID("c", 2), "db", nil)
+	exited.State = &types.ContainerState{Status: "exited"}
+	dockertest.Connect(exited, backend, "", "")
+	cli.AddContainer(exited)
+
+	if err := Sync(ctx); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	endpoints := Networks.Networks[backend.ID].ContainerEndpoints
+	if _, exists := endpoints[created.ID]; !exists || len(endpoints) != 1 {
+		t.Errorf("expected only the endpoint of the created container: %v", endpoints)
+	}
+
+	// Networks already known are refreshed on resync, keeping endpoints.
+	backend.Labels = map[string]string{DNSZoneLabel: "backend.internal"}
+	cli.AddNetwork(backend)
+
+	if err := Sync(ctx); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	nw := Networks.Networks[backend.ID]
+	if nw.Labels[DNSZoneLabel] != "backend.internal" || nw.DNS.Zone != "backend.internal." {
+		t.Errorf("expected network labels to be updated: %v %+v", nw.Labels, nw.DNS)
+	}
+	if _, exists := nw.ContainerEndpoints[created.ID]; !exists {
+		t.Errorf("expected endpoints to be kept on updated network: %v", nw.ContainerEndpoints)
+	}
+}
@@ -0,0 +1,351 @@
+package state
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	SerialSchemeUnixTime    = "unixtime"
+	SerialSchemeDateCounter = "date-counter"
+
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 86400
+
+	// maxZoneHistory limits the changes kept per zone for incremental
+	// zone transfers.
+	maxZoneHistory = 100
+)
+
+var (
+	// SerialScheme selects how zone serials are incremented.
+	SerialScheme = SerialSchemeUnixTime
+
+	// DefaultTTL is the ttl of records in the zone history for endpoints
+	// without a ttl label, which must match the ttl of zone transfers.
+	DefaultTTL uint32 = 30
+
+	// Nameserver is the primary nameserver of the SOA and NS records,
+	// 'ns.<domain>' if empty.
+	Nameserver string
+
+	// NameserverAddresses are published as the A and AAAA records of the
+	// nameserver, which are required glue when it is within the zones.
+	NameserverAddresses []net.IP
+
+	// zoneSerials holds the serial, records and history of every zone
+	// seen, so serials keep increasing when a zone is removed and added
+	// again.
+	zoneSerials = make(map[string]zoneSerial)
+)
+
+type zoneSerial struct {
+	serial  uint32
+	records map[string]dns.RR
+	history []*ZoneChange
+	// seeded serials were served by a previous run with unknown records,
+	// so the next snapshot increments them without a history entry.
+	seeded bool
+}
+
+// ZoneChange is the difference between two serials of a zone, as sent in
+// incremental zone transfers. Records have the ttl they had in full zone
+// transfers of the serials, using DefaultTTL for endpoints without a ttl
+// label.
+type ZoneChange struct {
+	From    uint32
+	To      uint32
+	Removed []dns.RR
+	Added   []dns.RR
+}
+
+// ParseSerialScheme validates a serial scheme.
+func ParseSerialScheme(value string) (string, error) {
+	switch value {
+	case SerialSchemeUnixTime, SerialSchemeDateCounter:
+		return value, nil
+	}
+
+	return "", fmt.Errorf("unknown serial scheme '%s', must be one of: %s, %s", value, SerialSchemeUnixTime, SerialSchemeDateCounter)
+}
+
+// NextSerial returns the serial following previous. The unixtime scheme
+// uses the current time and the date-counter scheme uses 'YYYYMMDDnn',
+// both incrementing previous instead if it is not lower.
+func NextSerial(scheme string, previous uint32, now time.Time) uint32 {
+	var serial uint32
+
+	switch scheme {
+	case SerialSchemeDateCounter:
+		now = now.UTC()
+		serial = uint32(now.Year())*1000000 + uint32(now.Month())*10000 + uint32(now.Day())*100
+	default:
+		serial = uint32(now.Unix())
+	}
+
+	if serial <= previous {
+		return previous + 1
+	}
+
+	return serial
+}
+
+// SeedSerials sets the last serials served by a previous run, so serials
+// keep increasing across restarts. Zones that already have a serial are
+// left alone.
+//
+// SeedSerials must be called from the goroutine that handles events,
+// before the snapshot that should use the serials is published.
+func SeedSerials(serials map[string]uint32) {
+	for zone, serial := range serials {
+		zone = dns.Fqdn(strings.ToLower(zone))
+
+		if _, exists := zoneSerials[zone]; !exists {
+			zoneSerials[zone] = zoneSerial{serial: serial, seeded: true}
+		}
+	}
+}
+
+// AuthoritativeZones returns the names of the forward zones followed by
+// the reverse zones.
+func (s *Snapshot) AuthoritativeZones() []string {
+	zones := append([]string(nil), s.zones...)
+
+	for _, zone := range s.reverseZones {
+		zones = append(zones, zone.Name)
+	}
+
+	return zones
+}
+
+// ZoneRecords returns the records of the names whose most specific zone
+// is zone, excluding the SOA and NS records of the apex. Authoritative
+// zones nested within zone are delegated with NS records.
+func (s *Snapshot) ZoneRecords(zone string, defaultTTL uint32) []*Record {
+	return s.zoneRecords(s.Records(defaultTTL), defaultTTL)[zone]
+}
+
+// ZoneChanges returns the changes of zone since serial from, oldest first,
+// or false if the history does not reach back to from.
+func (s *Snapshot) ZoneChanges(zone string, from uint32) ([]*ZoneChange, bool) {
+	history := s.history[zone]
+
+	if from == s.Serial(zone) {
+		return nil, true
+	}
+
+	for i, change := range history {
+		if change.From == from {
+			return history[i:], true
+		}
+	}
+
+	return nil, false
+}
+
+// Serial returns the serial of zone, which increments each time the
+// records of the zone change.
+func (s *Snapshot) Serial(zone string) uint32 {
+	return s.serials[strings.ToLower(zone)]
+}
+
+// SOA returns the SOA record of zone, using ttl as both the record ttl
+// and the negative caching ttl.
+func (s *Snapshot) SOA(zone string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      s.nameserver(),
+		Mbox:    "hostmaster." + s.Domain,
+		Serial:  s.Serial(zone),
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  ttl,
+	}
+}
+
+// NS returns the NS record of zone.
+func (s *Snapshot) NS(zone string, ttl uint32) *dns.NS {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+		Ns:  s.nameserver(),
+	}
+}
+
+// NameserverRecords returns the A and AAAA records of the nameserver if
+// name is the nameserver, or nil if it has no addresses.
+func (s *Snapshot) NameserverRecords(name string, ttl uint32) []dns.RR {
+	if !strings.EqualFold(dns.Fqdn(name), s.nameserver()) {
+		return nil
+	}
+
+	var rrs []dns.RR
+
+	for _, ip := range s.NameserverAddresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			rrs = append(rrs, &dns.A{Hdr: dns.RR_Header{Name: s.nameserver(), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip4})
+		} else {
+			rrs = append(rrs, &dns.AAAA{Hdr: dns.RR_Header{Name: s.nameserver(), Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: ip})
+		}
+	}
+
+	return rrs
+}
+
+func (s *Snapshot) nameserver() string {
+	if len(s.Nameserver) != 0 {
+		return s.Nameserver
+	}
+
+	return "ns." + s.Domain
+}
+
+// zoneRecords returns the records of every authoritative zone, with
+// delegations first, from the snapshot's records with defaultTTL.
+func (s *Snapshot) zoneRecords(all []*Record, defaultTTL uint32) map[string][]*Record {
+	zones := s.AuthoritativeZones()
+	records := make(map[string][]*Record, len(zones))
+
+	for _, zone := range zones {
+		records[zone] = nil
+
+		for _, child := range childZones(zones, zone) {
+			records[zone] = append(records[zone], &Record{RR: s.NS(child, defaultTTL)})
+		}
+	}
+
+	// The nameserver's addresses are glue of the zone containing it.
+	if zone := s.recordZone(s.nameserver()); len(zone) != 0 {
+		for _, rr := range s.NameserverRecords(s.nameserver(), defaultTTL) {
+			records[zone] = append(records[zone], &Record{RR: rr})
+		}
+	}
+
+	for _, record := range all {
+		if zone := s.recordZone(record.RR.Header().Name); len(zone) != 0 {
+			records[zone] = append(records[zone], record)
+		}
+	}
+
+	return records
+}
+
+func (s *Snapshot) recordZone(name string) string {
+	if zone, ok := s.Zone(name); ok {
+		return zone
+	}
+	if zone, ok := s.ReverseZone(name); ok {
+		return zone.Name
+	}
+
+	return ""
+}
+
+// assignSerials sets the serial of each zone, incrementing the previous
+// serial of zones whose records changed and adding the change to the
+// zone's history. The returned map replaces previous.
+func (s *Snapshot) assignSerials(previous map[string]zoneSerial, scheme string, all []*Record, defaultTTL uint32, now time.Time) map[string]zoneSerial {
+	next := make(map[string]zoneSerial, len(previous))
+	for zone, serial := range previous {
+		next[zone] = serial
+	}
+
+	s.serials = make(map[string]uint32)
+	s.history = make(map[string][]*ZoneChange)
+
+	for zone, records := range s.zoneRecords(all, defaultTTL) {
+		current := make(map[string]dns.RR, len(records))
+		for _, record := range records {
+			current[record.RR.String()] = record.RR
+		}
+
+		serial, exists := next[zone]
+
+		if change := diffRecords(serial.records, current); !exists || serial.seeded || change != nil {
+			to := NextSerial(scheme, serial.serial, now)
+			history := serial.history
+
+			if exists && !serial.seeded {
+				change.From, change.To = serial.serial, to
+
+				if len(history) >= maxZoneHistory {
+					history = history[len(history)-maxZoneHistory+1:]
+				}
+
+				// Limiting the capacity makes append copy the history, which is
+				// shared with previous snapshots.
+				history = append(history[:len(history):len(history)], change)
+			}
+
+			serial = zoneSerial{serial: to, records: current, history: history}
+			next[zone] = serial
+		}
+
+		s.serials[zone] = serial.serial
+		s.history[zone] = serial.history
+	}
+
+	return next
+}
+
+// diffRecords returns the records removed and added between two record
+// sets keyed by their string representation, or nil if they are equal.
+func diffRecords(previous, current map[string]dns.RR) *ZoneChange {
+	change := &ZoneChange{}
+
+	for key, rr := range previous {
+		if _, exists := current[key]; !exists {
+			change.Removed = append(change.Removed, rr)
+		}
+	}
+	for key, rr := range current {
+		if _, exists := previous[key]; !exists {
+			change.Added = append(change.Added, rr)
+		}
+	}
+
+	if len(change.Removed) == 0 && len(change.Added) == 0 {
+		return nil
+	}
+
+	sortRRs(change.Removed)
+	sortRRs(change.Added)
+
+	return change
+}
+
+func sortRRs(rrs []dns.RR) {
+	sort.Slice(rrs, func(i, j int) bool { return rrs[i].String() < rrs[j].String() })
+}
+
+// childZones returns the zones directly below zone, without another zone
+// in between.
+func childZones(zones []string, zone string) []string {
+	var children []string
+
+	for _, child := range zones {
+		if child == zone || !dns.IsSubDomain(zone, child) {
+			continue
+		}
+
+		direct := true
+
+		for _, other := range zones {
+			if other != zone && other != child && dns.IsSubDomain(zone, other) && dns.IsSubDomain(other, child) {
+				direct = false
+			}
+		}
+
+		if direct {
+			children = append(children, child)
+		}
+	}
+
+	return children
+}
@@ -0,0 +1,88 @@
+package tsig
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Fudge is the allowed clock skew of signed messages, in seconds.
+const Fudge = 300
+
+// Key is a shared secret used to sign messages.
+type Key struct {
+	Algorithm string
+	Name      string
+	Secret    string
+}
+
+// ParseKey parses a key in the '[algorithm:]name:secret' format used by
+// 'dig -y', defaulting to hmac-sha256.
+func ParseKey(value string) (*Key, error) {
+	parts := strings.Split(value, ":")
+
+	key := &Key{Algorithm: dns.HmacSHA256}
+
+	switch len(parts) {
+	case 2:
+		key.Name, key.Secret = parts[0], parts[1]
+	case 3:
+		key.Algorithm, key.Name, key.Secret = dns.Fqdn(strings.ToLower(parts[0])), parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("tsig key must be '[algorithm:]name:secret'")
+	}
+
+	switch key.Algorithm {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+	default:
+		return nil, fmt.Errorf("unsupported tsig algorithm '%s'", strings.TrimSuffix(key.Algorithm, "."))
+	}
+
+	if _, ok := dns.IsDomainName(key.Name); !ok || len(key.Name) == 0 || len(key.Secret) == 0 {
+		return nil, fmt.Errorf("tsig key must have a name and a secret")
+	}
+
+	key.Name = dns.Fqdn(strings.ToLower(key.Name))
+
+	return key, nil
+}
+
+// ParseKeys parses a list of keys, returning them by name.
+func ParseKeys(values []string) (map[string]*Key, error) {
+	keys := make(map[string]*Key, len(values))
+
+	for _, value := range values {
+		key, err := ParseKey(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := keys[key.Name]; exists {
+			return nil, fmt.Errorf("duplicate tsig key '%s'", key.Name)
+		}
+
+		keys[key.Name] = key
+	}
+
+	return keys, nil
+}
+
+// Secrets returns the secrets of keys by name, as used by dns clients and
+// servers.
+func Secrets(keys map[string]*Key) map[string]string {
+	secrets := make(map[string]string, len(keys))
+
+	for name, key := range keys {
+		secrets[name] = key.Secret
+	}
+
+	return secrets
+}
+
+// Sign adds a signature by key to m, if key is not nil.
+func (key *Key) Sign(m *dns.Msg) {
+	if key != nil {
+		m.SetTsig(key.Name, key.Algorithm, Fudge, time.Now().Unix())
+	}
+}
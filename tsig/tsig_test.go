@@ -0,0 +1,38 @@
+package tsig
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("Update-Key:" + testSecret)
+	if err != nil || key.Name != "update-key." || key.Algorithm != dns.HmacSHA256 || key.Secret != testSecret {
+		t.Errorf("unexpected key: %+v %v", key, err)
+	}
+
+	key, err = ParseKey("hmac-sha512:update-key:" + testSecret)
+	if err != nil || key.Algorithm != dns.HmacSHA512 {
+		t.Errorf("unexpected key: %+v %v", key, err)
+	}
+
+	for _, value := range []string{"", "update-key", "hmac-md5:update-key:" + testSecret, "update-key:"} {
+		if _, err := ParseKey(value); err == nil {
+			t.Errorf("expected error for tsig key %q", value)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys([]string{"a:" + testSecret, "hmac-sha1:b:" + testSecret})
+	if err != nil || len(keys) != 2 || keys["b."].Algorithm != dns.HmacSHA1 {
+		t.Errorf("unexpected keys: %v %v", keys, err)
+	}
+
+	if _, err := ParseKeys([]string{"a:" + testSecret, "A.:" + testSecret}); err == nil {
+		t.Errorf("expected error for duplicate keys")
+	}
+}
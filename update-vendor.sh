@@ -6,6 +6,9 @@ MODULE_PATH="github.com/rakshasa/docker-container-dns"
 
 GO_MODULES=(
   "github.com/docker/docker@v20.10.6"
+  "github.com/miekg/dns@v1.1.43"
+  "github.com/prometheus/client_golang@v1.11.0"
+  "gopkg.in/yaml.v2@v2.4.0"
 )
 
 set -xeu
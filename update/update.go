@@ -0,0 +1,370 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/state"
+	"github.com/rakshasa/docker-container-dns/tsig"
+)
+
+// DefaultOwner is the default owner label of the ownership records.
+const DefaultOwner = "docker-container-dns"
+
+// maxOwnershipSize bounds the rdata of each ownership TXT record, keeping
+// updates well below the message size limit.
+const maxOwnershipSize = 1024
+
+// Updater pushes the A, AAAA and PTR records of the current snapshot to an
+// external server with RFC 2136 dynamic updates, sending the records
+// added and removed since the last update.
+//
+// The names owned by the updater are listed in TXT records at
+// '_<owner>.<zone>' of each zone, replaced in the same update as the
+// records. The first update reconciles each zone, removing the records of
+// previously owned names that are no longer published. Names that are not
+// owned are never removed, so records added by others are left alone.
+//
+// Records are sent to the most specific of Zones containing their name,
+// skipping records outside of Zones.
+type Updater struct {
+	Server   string
+	Zones    []string
+	Owner    string
+	TTL      uint32
+	Interval time.Duration
+	TSIG     *tsig.Key
+
+	client     *dns.Client
+	notify     chan struct{}
+	reconciled bool
+	pushed     map[string]map[string]dns.RR
+}
+
+func NewUpdater(server string, zones []string, owner string, ttl uint32, interval time.Duration, key *tsig.Key) *Updater {
+	u := &Updater{
+		Server:   server,
+		Owner:    owner,
+		TTL:      ttl,
+		Interval: interval,
+		TSIG:     key,
+		client:   &dns.Client{Net: "tcp"},
+		notify:   make(chan struct{}, 1),
+		pushed:   make(map[string]map[string]dns.RR),
+	}
+
+	for _, zone := range zones {
+		u.Zones = append(u.Zones, dns.Fqdn(strings.ToLower(zone)))
+	}
+
+	if key != nil {
+		u.client.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+
+	return u
+}
+
+// Notify schedules an update from the current snapshot without blocking.
+func (u *Updater) Notify() {
+	select {
+	case u.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends updates on each notification until ctx is done. Failed
+// updates are retried after Interval with a full reconcile.
+func (u *Updater) Run(ctx context.Context) {
+	for {
+		select {
+		case <-u.notify:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := u.Update(state.Current()); err != nil {
+			log.Printf("dynamic update of %s failed, retrying in %v: %v", u.Server, u.Interval, err)
+			u.Notify()
+		}
+
+		select {
+		case <-time.After(u.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Update sends the changes of the snapshot's records to the server.
+func (u *Updater) Update(snapshot *state.Snapshot) error {
+	return u.update(u.records(snapshot))
+}
+
+// records returns the A, AAAA and PTR records of the snapshot by zone,
+// keyed by their string representation.
+func (u *Updater) records(snapshot *state.Snapshot) map[string]map[string]dns.RR {
+	records := make(map[string]map[string]dns.RR)
+
+	add := func(zone string, rr dns.RR) {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypePTR:
+			records[zone][rr.String()] = rr
+		}
+	}
+
+	for _, zone := range u.Zones {
+		records[zone] = make(map[string]dns.RR)
+	}
+
+	for _, record := range snapshot.Records(u.TTL) {
+		if zone := enclosingZone(u.Zones, record.RR.Header().Name); len(zone) != 0 {
+			add(zone, record.RR)
+		}
+	}
+
+	return records
+}
+
+func (u *Updater) update(records map[string]map[string]dns.RR) error {
+	if !u.reconciled {
+		for zone, rrs := range records {
+			if err := u.reconcile(zone, rrs); err != nil {
+				return fmt.Errorf("could not reconcile zone %s: %v", zone, err)
+			}
+		}
+
+		u.pushed = records
+		u.reconciled = true
+		return nil
+	}
+
+	var zones []string
+	for zone := range u.pushed {
+		zones = append(zones, zone)
+	}
+	for zone := range records {
+		if _, exists := u.pushed[zone]; !exists {
+			zones = append(zones, zone)
+		}
+	}
+
+	sort.Strings(zones)
+
+	for _, zone := range zones {
+		if err := u.updateZone(zone, u.pushed[zone], records[zone]); err != nil {
+			u.reconciled = false
+			return fmt.Errorf("could not update zone %s: %v", zone, err)
+		}
+
+		if rrs, exists := records[zone]; exists {
+			u.pushed[zone] = rrs
+		} else {
+			delete(u.pushed, zone)
+		}
+	}
+
+	return nil
+}
+
+// updateZone sends the difference between the pushed and current records
+// of a zone, replacing the ownership record if the owned names changed.
+func (u *Updater) updateZone(zone string, pushed, current map[string]dns.RR) error {
+	var removed, inserted []dns.RR
+
+	for key, rr := range pushed {
+		if _, exists := current[key]; !exists {
+			removed = append(removed, dns.Copy(rr))
+		}
+	}
+	for key, rr := range current {
+		if _, exists := pushed[key]; !exists {
+			inserted = append(inserted, dns.Copy(rr))
+		}
+	}
+
+	if len(removed) == 0 && len(inserted) == 0 {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Remove(sortRRs(removed))
+
+	if names := ownedNames(current); strings.Join(ownedNames(pushed), " ") != strings.Join(names, " ") {
+		u.replaceOwnership(m, zone, names)
+	}
+
+	m.Insert(sortRRs(inserted))
+
+	if err := u.exchange(m); err != nil {
+		return err
+	}
+
+	log.Printf("dynamic update of zone %s: %d removed, %d added", zone, len(removed), len(inserted))
+	return nil
+}
+
+// reconcile replaces the records of the names owned by a previous run and
+// inserts the current records, removing stale names entirely.
+func (u *Updater) reconcile(zone string, current map[string]dns.RR) error {
+	previous, err := u.queryOwnership(zone)
+	if err != nil {
+		return err
+	}
+
+	names := ownedNames(current)
+	if len(previous) == 0 && len(names) == 0 {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+
+	for _, name := range previous {
+		for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR} {
+			m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: rrtype}}})
+		}
+	}
+
+	u.replaceOwnership(m, zone, names)
+
+	var inserted []dns.RR
+	for _, rr := range current {
+		inserted = append(inserted, dns.Copy(rr))
+	}
+
+	m.Insert(sortRRs(inserted))
+
+	if err := u.exchange(m); err != nil {
+		return err
+	}
+
+	log.Printf("dynamic update of zone %s reconciled: %d previously owned names, %d records", zone, len(previous), len(inserted))
+	return nil
+}
+
+// OwnershipName returns the name of the ownership record of zone.
+func (u *Updater) OwnershipName(zone string) string {
+	return "_" + u.Owner + "." + zone
+}
+
+func (u *Updater) queryOwnership(zone string) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(u.OwnershipName(zone), dns.TypeTXT)
+
+	r, err := u.sign(m)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return nil, nil
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("ownership query failed: %s", dns.RcodeToString[r.Rcode])
+	}
+
+	var names []string
+
+	for _, rr := range r.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, u.OwnershipName(zone)) {
+			for _, name := range txt.Txt {
+				if dns.IsSubDomain(zone, name) {
+					names = append(names, dns.Fqdn(strings.ToLower(name)))
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+func (u *Updater) replaceOwnership(m *dns.Msg, zone string, names []string) {
+	hdr := dns.RR_Header{Name: u.OwnershipName(zone), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: u.TTL}
+
+	m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: hdr}})
+
+	m.Insert(ownershipRecords(hdr, names))
+}
+
+// ownershipRecords splits names across TXT records with rdata of at most
+// maxOwnershipSize bytes.
+func ownershipRecords(hdr dns.RR_Header, names []string) []dns.RR {
+	var rrs []dns.RR
+	var txt []string
+	size := 0
+
+	for _, name := range names {
+		if len(txt) != 0 && size+len(name)+1 > maxOwnershipSize {
+			rrs = append(rrs, &dns.TXT{Hdr: hdr, Txt: txt})
+			txt, size = nil, 0
+		}
+
+		txt = append(txt, name)
+		size += len(name) + 1
+	}
+
+	if len(txt) != 0 {
+		rrs = append(rrs, &dns.TXT{Hdr: hdr, Txt: txt})
+	}
+
+	return rrs
+}
+
+// exchange sends an update, returning an error unless it succeeded.
+func (u *Updater) exchange(m *dns.Msg) error {
+	r, err := u.sign(m)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update refused: %s", dns.RcodeToString[r.Rcode])
+	}
+
+	return nil
+}
+
+func (u *Updater) sign(m *dns.Msg) (*dns.Msg, error) {
+	u.TSIG.Sign(m)
+
+	r, _, err := u.client.Exchange(m, u.Server)
+	return r, err
+}
+
+// ownedNames returns the sorted names of records.
+func ownedNames(records map[string]dns.RR) []string {
+	seen := make(map[string]bool)
+	var names []string
+
+	for _, rr := range records {
+		if name := rr.Header().Name; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func sortRRs(rrs []dns.RR) []dns.RR {
+	sort.Slice(rrs, func(i, j int) bool { return rrs[i].String() < rrs[j].String() })
+	return rrs
+}
+
+// enclosingZone returns the most specific of zones containing name.
+func enclosingZone(zones []string, name string) string {
+	var match string
+
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, name) && dns.CountLabel(zone) >= dns.CountLabel(match) {
+			match = zone
+		}
+	}
+
+	return match
+}
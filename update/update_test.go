@@ -0,0 +1,268 @@
+package update
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/tsig"
+)
+
+const (
+	testKeyName = "update-key."
+	testSecret  = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// testServer is a stand-in for an authoritative server accepting signed
+// dynamic updates for a single zone.
+type testServer struct {
+	mu      sync.Mutex
+	records []dns.RR
+	updates int
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(m)
+		return
+	}
+
+	switch r.Opcode {
+	case dns.OpcodeUpdate:
+		s.updates++
+		s.apply(r.Ns)
+	case dns.OpcodeQuery:
+		for _, rr := range s.records {
+			if strings.EqualFold(rr.Header().Name, r.Question[0].Name) && rr.Header().Rrtype == r.Question[0].Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+
+	m.SetTsig(testKeyName, dns.HmacSHA256, tsig.Fudge, int64(r.IsTsig().TimeSigned))
+	w.WriteMsg(m)
+}
+
+func (s *testServer) apply(rrs []dns.RR) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			s.remove(func(r dns.RR) bool { return dns.IsDuplicate(r, rr) })
+			s.records = append(s.records, rr)
+		case dns.ClassANY:
+			s.remove(func(r dns.RR) bool {
+				return r.Header().Name == hdr.Name && (hdr.Rrtype == dns.TypeANY || r.Header().Rrtype == hdr.Rrtype)
+			})
+		case dns.ClassNONE:
+			deleted := dns.Copy(rr)
+			deleted.Header().Class = dns.ClassINET
+			s.remove(func(r dns.RR) bool { return dns.IsDuplicate(r, deleted) })
+		}
+	}
+}
+
+func (s *testServer) remove(match func(dns.RR) bool) {
+	var kept []dns.RR
+
+	for _, rr := range s.records {
+		if !match(rr) {
+			kept = append(kept, rr)
+		}
+	}
+
+	s.records = kept
+}
+
+func (s *testServer) dump() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+	for _, rr := range s.records {
+		lines = append(lines, rr.String())
+	}
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func startTestServer(t *testing.T, records ...string) (*testServer, string) {
+	s := &testServer{}
+
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("invalid test record: %v", err)
+		}
+		s.records = append(s.records, rr)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          l,
+		Handler:           s,
+		TsigSecret:        map[string]string{testKeyName: testSecret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	<-started
+
+	return s, l.Addr().String()
+}
+
+func testRecords(t *testing.T, zone string, records ...string) map[string]map[string]dns.RR {
+	rrs := make(map[string]dns.RR)
+
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("invalid test record: %v", err)
+		}
+		rrs[rr.String()] = rr
+	}
+
+	return map[string]map[string]dns.RR{zone: rrs}
+}
+
+func TestUpdaterUpdate(t *testing.T) {
+	s, addr := startTestServer(t,
+		`_docker-container-dns.docker. 30 IN TXT "stale.docker."`,
+		"stale.docker. 30 IN A 172.20.0.9",
+		"manual.docker. 300 IN A 10.0.0.1",
+	)
+
+	key, _ := tsig.ParseKey("update-key:" + testSecret)
+	u := NewUpdater(addr, nil, DefaultOwner, 30, 0, key)
+
+	// The first update reconciles the zone, removing the stale name while
+	// leaving records that were never owned.
+	if err := u.update(testRecords(t, "docker.", "web.docker. 30 IN A 172.20.0.2")); err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+
+	expected := strings.Join([]string{
+		"_docker-container-dns.docker.\t30\tIN\tTXT\t\"web.docker.\"",
+		"manual.docker.\t300\tIN\tA\t10.0.0.1",
+		"web.docker.\t30\tIN\tA\t172.20.0.2",
+	}, "\n")
+
+	if records := s.dump(); records != expected {
+		t.Errorf("unexpected records after reconcile:\n%s", records)
+	}
+
+	if err := u.update(testRecords(t, "docker.", "web.docker. 30 IN A 172.20.0.2", "db.docker. 30 IN A 172.20.0.3")); err != nil {
+		t.Fatalf("could not update: %v", err)
+	}
+	if err := u.update(testRecords(t, "docker.", "db.docker. 30 IN A 172.20.0.3")); err != nil {
+		t.Fatalf("could not update: %v", err)
+	}
+
+	expected = strings.Join([]string{
+		"_docker-container-dns.docker.\t30\tIN\tTXT\t\"db.docker.\"",
+		"db.docker.\t30\tIN\tA\t172.20.0.3",
+		"manual.docker.\t300\tIN\tA\t10.0.0.1",
+	}, "\n")
+
+	if records := s.dump(); records != expected {
+		t.Errorf("unexpected records after updates:\n%s", records)
+	}
+
+	// Unchanged records do not send an update.
+	updates := s.updates
+	if err := u.update(testRecords(t, "docker.", "db.docker. 30 IN A 172.20.0.3")); err != nil || s.updates != updates {
+		t.Errorf("expected no update for unchanged records: %d %v", s.updates-updates, err)
+	}
+}
+
+func TestUpdaterOwnershipSplit(t *testing.T) {
+	s, addr := startTestServer(t)
+
+	key, _ := tsig.ParseKey("update-key:" + testSecret)
+	u := NewUpdater(addr, nil, DefaultOwner, 30, 0, key)
+
+	var records []string
+	for i := 0; i < 500; i++ {
+		records = append(records, fmt.Sprintf("container-with-a-long-name-%03d.backend.docker. 30 IN A 172.20.%d.%d", i, i/250, i%250+1))
+	}
+
+	if err := u.update(testRecords(t, "docker.", records...)); err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+
+	txts := 0
+	for _, rr := range strings.Split(s.dump(), "\n") {
+		if strings.HasPrefix(rr, "_docker-container-dns.docker.") {
+			txts++
+		}
+	}
+	if txts < 2 {
+		t.Errorf("expected owned names to be split across txt records: %d", txts)
+	}
+
+	for _, rr := range ownershipRecords(dns.RR_Header{Name: u.OwnershipName("docker.")}, ownedNames(testRecords(t, "docker.", records...)["docker."])) {
+		if size := dns.Len(rr) - len(rr.Header().Name) - 11; size > maxOwnershipSize {
+			t.Errorf("ownership record rdata exceeds bound: %d", size)
+		}
+	}
+
+	names, err := u.queryOwnership("docker.")
+	if err != nil || len(names) != len(records) {
+		t.Errorf("unexpected owned names: %d %v", len(names), err)
+	}
+}
+
+func TestUpdaterRefused(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	key, _ := tsig.ParseKey("other-key:" + testSecret)
+	u := NewUpdater(addr, nil, DefaultOwner, 30, 0, key)
+
+	if err := u.update(testRecords(t, "docker.", "web.docker. 30 IN A 172.20.0.2")); err == nil {
+		t.Errorf("expected update with unknown key to fail")
+	}
+	if u.reconciled {
+		t.Errorf("expected failed update to be reconciled again")
+	}
+}
+
+func TestEnclosingZone(t *testing.T) {
+	zones := []string{"docker.", "backend.docker.", "20.172.in-addr.arpa."}
+
+	for name, expected := range map[string]string{
+		"web.docker.":              "docker.",
+		"web.backend.docker.":      "backend.docker.",
+		"2.0.20.172.in-addr.arpa.": "20.172.in-addr.arpa.",
+		"example.com.":             "",
+	} {
+		if zone := enclosingZone(zones, name); zone != expected {
+			t.Errorf("unexpected zone of %s: %s", name, zone)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package zonefile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/atomicfile"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+// Exporter writes each authoritative zone of the current snapshot as a
+// master file in Dir, named by FileName. A zone file is only written when
+// its serial changed, and files of zones that no longer exist are
+// removed.
+//
+// Exports are rate limited to one per Interval, with notifications during
+// the interval coalesced into a single export of the latest snapshot.
+type Exporter struct {
+	Dir      string
+	TTL      uint32
+	Interval time.Duration
+
+	notify  chan struct{}
+	serials map[string]uint32
+}
+
+func NewExporter(dir string, ttl uint32, interval time.Duration) *Exporter {
+	return &Exporter{
+		Dir:      dir,
+		TTL:      ttl,
+		Interval: interval,
+		notify:   make(chan struct{}, 1),
+		serials:  make(map[string]uint32),
+	}
+}
+
+// Notify schedules an export of the current snapshot without blocking.
+func (e *Exporter) Notify() {
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run exports the zones on each notification until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-e.notify:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := e.Export(state.Current()); err != nil {
+			log.Printf("zone export to %s: %v", e.Dir, err)
+		}
+
+		select {
+		case <-time.After(e.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Export writes the zones of the snapshot whose serial changed since the
+// last export, and removes the files of zones no longer in the snapshot.
+// Failing zones are retried on the next export.
+func (e *Exporter) Export(snapshot *state.Snapshot) error {
+	var firstErr error
+
+	zones := make(map[string]bool)
+
+	for _, zone := range snapshot.AuthoritativeZones() {
+		zones[zone] = true
+
+		serial := snapshot.Serial(zone)
+		if written, exists := e.serials[zone]; exists && written == serial {
+			continue
+		}
+
+		path := filepath.Join(e.Dir, FileName(zone))
+
+		if err := atomicfile.WriteFile(path, Render(snapshot, zone, e.TTL), 0644); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("could not write zone %s: %v", zone, err)
+			}
+			continue
+		}
+
+		e.serials[zone] = serial
+
+		log.Printf("zone file %s written with serial %d", path, serial)
+	}
+
+	for zone := range e.serials {
+		if zones[zone] {
+			continue
+		}
+
+		path := filepath.Join(e.Dir, FileName(zone))
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("could not remove zone %s: %v", zone, err)
+			}
+			continue
+		}
+
+		delete(e.serials, zone)
+
+		log.Printf("zone file %s removed", path)
+	}
+
+	return firstErr
+}
+
+// ReadSerials returns the SOA serials of the zone files in dir by zone,
+// as written by a previous run. Files that cannot be parsed are skipped.
+func ReadSerials(dir string) (map[string]uint32, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.zone"))
+	if err != nil {
+		return nil, err
+	}
+
+	serials := make(map[string]uint32)
+
+	for _, path := range paths {
+		zone, serial, err := readSerial(path)
+		if err != nil {
+			log.Printf("zone file %s skipped: %v", path, err)
+			continue
+		}
+
+		serials[zone] = serial
+	}
+
+	return serials, nil
+}
+
+// readSerial returns the zone and serial of the SOA record of a zone file.
+func readSerial(path string) (string, uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	zp := dns.NewZoneParser(f, "", path)
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return strings.ToLower(soa.Hdr.Name), soa.Serial, nil
+		}
+	}
+
+	if err := zp.Err(); err != nil {
+		return "", 0, err
+	}
+
+	return "", 0, fmt.Errorf("no SOA record")
+}
+
+// FileName returns the name of the master file of zone, e.g.
+// 'backend.docker.zone'.
+func FileName(zone string) string {
+	return strings.TrimSuffix(zone, ".") + ".zone"
+}
+
+// Write writes zone as a master file.
+func Write(w io.Writer, snapshot *state.Snapshot, zone string, ttl uint32) error {
+	_, err := w.Write(Render(snapshot, zone, ttl))
+	return err
+}
+
+// Render returns zone as an RFC 1035 master file, starting with the SOA
+// and NS records of the apex.
+func Render(snapshot *state.Snapshot, zone string, ttl uint32) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "$ORIGIN %s\n", zone)
+	fmt.Fprintf(&buf, "$TTL %d\n", ttl)
+
+	buf.WriteString(snapshot.SOA(zone, ttl).String() + "\n")
+	buf.WriteString(snapshot.NS(zone, ttl).String() + "\n")
+
+	for _, record := range snapshot.ZoneRecords(zone, ttl) {
+		buf.WriteString(record.RR.String() + "\n")
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,133 @@
+package zonefile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rakshasa/docker-container-dns/state"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestRender(t *testing.T) {
+	rendered := string(Render(state.Current(), "docker.", 30))
+
+	lines := strings.Split(strings.TrimSuffix(rendered, "\n"), "\n")
+	if len(lines) != 4 || lines[0] != "$ORIGIN docker." || lines[1] != "$TTL 30" {
+		t.Fatalf("unexpected zone file:\n%s", rendered)
+	}
+
+	zp := dns.NewZoneParser(strings.NewReader(rendered), "", "")
+
+	var types []uint16
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		types = append(types, rr.Header().Rrtype)
+	}
+
+	if err := zp.Err(); err != nil {
+		t.Fatalf("could not parse zone file: %v", err)
+	}
+	if len(types) != 2 || types[0] != dns.TypeSOA || types[1] != dns.TypeNS {
+		t.Errorf("unexpected record types: %v", types)
+	}
+}
+
+func TestExporterExport(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, FileName("old.docker."))
+
+	if err := ioutil.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatalf("could not write stale zone file: %v", err)
+	}
+
+	e := NewExporter(dir, 30, 0)
+	e.serials["old.docker."] = 1
+
+	if err := e.Export(state.Current()); err != nil {
+		t.Fatalf("could not export zones: %v", err)
+	}
+
+	path := filepath.Join(dir, "docker.zone")
+
+	if data, err := ioutil.ReadFile(path); err != nil || !strings.HasPrefix(string(data), "$ORIGIN docker.\n") {
+		t.Errorf("unexpected zone file: %q %v", data, err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected stale zone file to be removed: %v", err)
+	}
+
+	// Zones with an unchanged serial are not written again.
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("could not remove zone file: %v", err)
+	}
+	if err := e.Export(state.Current()); err != nil {
+		t.Fatalf("could not export zones: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected unchanged zone to not be written: %v", err)
+	}
+}
+
+func TestReadSerials(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker.zone"), Render(state.Current(), "docker.", 30), 0644); err != nil {
+		t.Fatalf("could not write zone file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "invalid.docker.zone"), []byte("not a zone\n"), 0644); err != nil {
+		t.Fatalf("could not write zone file: %v", err)
+	}
+
+	serials, err := ReadSerials(dir)
+	if err != nil {
+		t.Fatalf("could not read serials: %v", err)
+	}
+	if len(serials) != 1 || serials["docker."] != state.Current().Serial("docker.") {
+		t.Errorf("unexpected serials: %v", serials)
+	}
+}
+
+func TestRenderNameserverGlue(t *testing.T) {
+	state.NameserverAddresses = []net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53")}
+	defer func() {
+		state.NameserverAddresses = nil
+		state.Publish()
+	}()
+
+	snapshot := state.Publish()
+
+	zp := dns.NewZoneParser(bytes.NewReader(Render(snapshot, "docker.", 30)), "", "")
+
+	var nameserver string
+	addresses := make(map[string][]string)
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			nameserver = rr.Ns
+		case *dns.A:
+			addresses[rr.Hdr.Name] = append(addresses[rr.Hdr.Name], rr.A.String())
+		case *dns.AAAA:
+			addresses[rr.Hdr.Name] = append(addresses[rr.Hdr.Name], rr.AAAA.String())
+		}
+	}
+
+	if err := zp.Err(); err != nil {
+		t.Fatalf("could not parse zone file: %v", err)
+	}
+	if !dns.IsSubDomain("docker.", nameserver) {
+		t.Fatalf("expected the default nameserver within the zone: %s", nameserver)
+	}
+	if strings.Join(addresses[nameserver], " ") != "192.0.2.53 2001:db8::53" {
+		t.Errorf("expected glue for the in-zone nameserver %s: %v", nameserver, addresses)
+	}
+}